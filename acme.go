@@ -0,0 +1,139 @@
+package locus
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeChallengePrefix is the path HTTP-01 challenges are served from.
+const acmeChallengePrefix = "/.well-known/acme-challenge/"
+
+// ACMEConfig specifies how certificates should be obtained from an ACME
+// certificate authority, such as Let's Encrypt.
+type ACMEConfig struct {
+	// CacheDir is the directory where account keys and issued certificates are
+	// stored. Required.
+	CacheDir string
+
+	// Email is an optional contact address for the ACME account.
+	Email string
+
+	// DirectoryURL is the ACME server's directory endpoint. Defaults to the Let's
+	// Encrypt production directory.
+	DirectoryURL string
+
+	// CAFile optionally specifies a PEM bundle used to verify the ACME server,
+	// useful for test servers such as Pebble that use their own roots.
+	CAFile string
+}
+
+// EnableACME configures locus to obtain and renew certificates for every exact
+// host bound by a config. Certificates are requested on the first TLS
+// handshake for a host that doesn't already have a certificate from
+// AddCertificate. HTTP-01 challenges are answered by ServeHTTP, TLS-ALPN-01
+// challenges on the TLS listener.
+func (locus *Locus) EnableACME(cfg ACMEConfig) error {
+	if cfg.CacheDir == "" {
+		return errors.New("acme requires a cache directory")
+	}
+
+	client := &acme.Client{DirectoryURL: cfg.DirectoryURL}
+	if cfg.CAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return fmt.Errorf("unable to read acme CA file: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in acme CA file %s", cfg.CAFile)
+		}
+		client.HTTPClient = &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		}}
+	}
+
+	locus.acme = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cfg.CacheDir),
+		HostPolicy: locus.acmeHostPolicy,
+		Email:      cfg.Email,
+		Client:     client,
+	}
+
+	// Calling HTTPHandler enables the HTTP-01 challenge. Only challenge requests
+	// are ever routed to it, so no fallback is needed.
+	locus.acmeHandler = locus.acme.HTTPHandler(nil)
+	return nil
+}
+
+// ACMEHosts returns the hosts that certificates will be requested for, when
+// ACME is enabled. Wildcard and glob hosts are skipped, as they can't be
+// verified with HTTP-01 or TLS-ALPN-01 challenges, as are IP addresses.
+func (locus *Locus) ACMEHosts() []string {
+	if locus.acme == nil {
+		return nil
+	}
+	hosts := []string{}
+	seen := map[string]bool{}
+	for _, c := range locus.CurrentConfigs() {
+		for _, p := range c.hosts {
+			if p.host != "" && !p.wild && p.glob == nil && net.ParseIP(p.host) == nil && !seen[p.host] {
+				seen[p.host] = true
+				hosts = append(hosts, p.host)
+			}
+		}
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// acmeHostPolicy only allows certificates for hosts that are exactly bound by
+// a config, to avoid arbitrary SNI values triggering issuance.
+func (locus *Locus) acmeHostPolicy(_ context.Context, host string) error {
+	host, _ = splitHost(strings.ToLower(host))
+	for _, h := range locus.ACMEHosts() {
+		if h == host {
+			return nil
+		}
+	}
+	return fmt.Errorf("acme: host %q not bound by any config", host)
+}
+
+// isACMEChallenge returns true if the request is for an HTTP-01 challenge
+// that locus should answer itself.
+func (locus *Locus) isACMEChallenge(req *http.Request) bool {
+	return locus.acmeHandler != nil && strings.HasPrefix(req.URL.Path, acmeChallengePrefix)
+}
+
+// getCertificate satisfies tls.Config.GetCertificate. Certificates added via
+// AddCertificate take precedence, then ACME is consulted for allowed hosts,
+// finally falling back to the default certificate.
+func (locus *Locus) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if locus.acme != nil && isALPNChallenge(hello) {
+		return locus.acme.GetCertificate(hello)
+	}
+	if cert := locus.certs.lookup(hello.ServerName); cert != nil {
+		return cert, nil
+	}
+	if locus.acme != nil && hello.ServerName != "" {
+		if err := locus.acmeHostPolicy(context.Background(), hello.ServerName); err == nil {
+			return locus.acme.GetCertificate(hello)
+		}
+	}
+	return locus.certs.getCertificate(hello)
+}
+
+func isALPNChallenge(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto
+}
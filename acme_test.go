@@ -0,0 +1,381 @@
+package locus
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dpup/locus/upstream"
+)
+
+func newACMELocus(t *testing.T) (*Locus, func()) {
+	dir, err := ioutil.TempDir("", "locus-acme")
+	checkError(t, err, "creating temp dir")
+
+	locus := New()
+	checkError(t, locus.EnableACME(ACMEConfig{CacheDir: dir}), "enabling acme")
+
+	for _, bind := range []string{"//www.mysite.com/about", "//api.mysite.com:8080", "//.mysite.com", "//[::1]:8443", "/search"} {
+		cfg := locus.NewConfig()
+		cfg.Bind(bind)
+		cfg.Upstream(upstream.Single("http://localhost:1"))
+	}
+	globbed := locus.NewConfig()
+	globbed.BindHosts("*.eu.mysite.com", "mysite.eu")
+	globbed.Upstream(upstream.Single("http://localhost:1"))
+	return locus, func() { os.RemoveAll(dir) }
+}
+
+func TestACMEHosts(t *testing.T) {
+	locus, cleanup := newACMELocus(t)
+	defer cleanup()
+
+	expected := []string{"api.mysite.com", "mysite.eu", "www.mysite.com"}
+	if actual := locus.ACMEHosts(); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Unexpected ACME hosts, expected %v was %v", expected, actual)
+	}
+
+	var tests = []struct {
+		host    string
+		allowed bool
+	}{
+		{"www.mysite.com", true},
+		{"WWW.MYSITE.COM", true},
+		{"api.mysite.com", true},
+		{"api.mysite.com:5002", true},
+		{"foo.mysite.com", false},
+		{"de.eu.mysite.com", false},
+		{"mysite.com", false},
+		{"evil.com", false},
+	}
+	for _, tt := range tests {
+		err := locus.acmeHostPolicy(context.Background(), tt.host)
+		if (err == nil) != tt.allowed {
+			t.Errorf("Host policy for %s => %v, want allowed=%v", tt.host, err, tt.allowed)
+		}
+	}
+}
+
+func TestACMEDisabled(t *testing.T) {
+	locus := New()
+	if hosts := locus.ACMEHosts(); hosts != nil {
+		t.Errorf("Expected no ACME hosts when disabled, was %v", hosts)
+	}
+	if locus.isACMEChallenge(mustReq("http://www.mysite.com/.well-known/acme-challenge/abc")) {
+		t.Error("Challenges shouldn't be intercepted when ACME is disabled")
+	}
+}
+
+func TestACMERequiresCacheDir(t *testing.T) {
+	if err := New().EnableACME(ACMEConfig{}); err == nil {
+		t.Error("Expected error enabling ACME without a cache dir")
+	}
+}
+
+func TestACMEChallengeBeforeConfigMatching(t *testing.T) {
+	locus, cleanup := newACMELocus(t)
+	defer cleanup()
+
+	// www.mysite.com/.well-known is matched by the wildcard config, which would
+	// fail to proxy, but unknown tokens should be a 404 from the ACME handler.
+	req := httptest.NewRequest("GET", "http://www.mysite.com/.well-known/acme-challenge/unknown", nil)
+	rw := httptest.NewRecorder()
+	locus.ServeHTTP(rw, req)
+	if rw.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown challenge token, was %d", rw.Code)
+	}
+
+	// Challenges for hosts that aren't bound are refused.
+	req = httptest.NewRequest("GET", "http://evil.com/.well-known/acme-challenge/unknown", nil)
+	rw = httptest.NewRecorder()
+	locus.ServeHTTP(rw, req)
+	if rw.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for unbound host, was %d", rw.Code)
+	}
+}
+
+func TestACMEIssuesCertificatesForBoundHosts(t *testing.T) {
+	httpAddr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	httpsAddr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	ca := newTestCA(t, httpAddr)
+	defer ca.Close()
+
+	dir, err := ioutil.TempDir("", "locus-acme")
+	checkError(t, err, "creating temp dir")
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate().Raw})
+	checkError(t, ioutil.WriteFile(caFile, caPEM, 0600), "writing ca file")
+
+	locus := New()
+	locus.Listeners = []Listener{
+		{Name: "http", Addr: httpAddr},
+		{Name: "https", Addr: httpsAddr, Protocol: ListenerHTTPS},
+	}
+	checkError(t, locus.EnableACME(ACMEConfig{
+		CacheDir:     filepath.Join(dir, "cache"),
+		DirectoryURL: ca.URL,
+		CAFile:       caFile,
+	}), "enabling acme")
+	cfg := locus.NewConfig()
+	cfg.Bind("//www.mysite.com")
+	cfg.Upstream(upstream.Single("http://localhost:1"))
+	defer locus.Shutdown(context.Background())
+
+	go locus.ListenAndServe()
+	waitForListener(t, httpAddr)
+	waitForListener(t, httpsAddr)
+
+	conn, err := tls.Dial("tcp", httpsAddr, &tls.Config{ServerName: "www.mysite.com", RootCAs: ca.roots})
+	checkError(t, err, "dialing www.mysite.com")
+	leaf := conn.ConnectionState().PeerCertificates[0]
+	conn.Close()
+	if err := leaf.VerifyHostname("www.mysite.com"); err != nil {
+		t.Errorf("Unexpected certificate for www.mysite.com: %v", err)
+	}
+	if issued := ca.issuedCount(); issued != 1 {
+		t.Errorf("Expected 1 certificate to be issued, was %d", issued)
+	}
+
+	// Hosts that aren't bound don't get certificates.
+	_, err = tls.Dial("tcp", httpsAddr, &tls.Config{ServerName: "evil.com", RootCAs: ca.roots})
+	if err == nil {
+		t.Error("Expected handshake for evil.com to fail")
+	}
+	if issued := ca.issuedCount(); issued != 1 {
+		t.Errorf("Expected no certificates to be issued for evil.com, was %d", issued-1)
+	}
+}
+
+// testCA is a minimal ACME server. It offers HTTP-01 challenges, verifies them
+// by requesting the token from challengeAddr and signs CSRs with a test root.
+type testCA struct {
+	*httptest.Server
+	challengeAddr string
+	key           *ecdsa.PrivateKey
+	root          *x509.Certificate
+	roots         *x509.CertPool
+
+	mu     sync.Mutex
+	orders []*testOrder
+	issued int
+}
+
+type testOrder struct {
+	domain string
+	token  string
+	status string
+	cert   []byte
+}
+
+func newTestCA(t *testing.T, challengeAddr string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	checkError(t, err, "generating ca key")
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "locus test root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	checkError(t, err, "creating ca root")
+	root, err := x509.ParseCertificate(der)
+	checkError(t, err, "parsing ca root")
+
+	ca := &testCA{challengeAddr: challengeAddr, key: key, root: root, roots: x509.NewCertPool()}
+	ca.roots.AddCert(root)
+	ca.Server = httptest.NewTLSServer(http.HandlerFunc(ca.serveHTTP))
+	return ca
+}
+
+func (ca *testCA) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", "nonce")
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	var id int
+	switch {
+	case r.URL.Path == "/":
+		ca.writeJSON(w, http.StatusOK, map[string]string{
+			"newNonce":   ca.URL + "/new-nonce",
+			"newAccount": ca.URL + "/new-account",
+			"newOrder":   ca.URL + "/new-order",
+		})
+	case r.URL.Path == "/new-nonce":
+		w.WriteHeader(http.StatusOK)
+	case r.URL.Path == "/new-account":
+		w.Header().Set("Location", ca.URL+"/accounts/1")
+		ca.writeJSON(w, http.StatusCreated, map[string]string{"status": "valid"})
+	case r.URL.Path == "/new-order":
+		var req struct {
+			Identifiers []struct{ Value string }
+		}
+		if err := decodeJWSPayload(r, &req); err != nil || len(req.Identifiers) != 1 {
+			http.Error(w, "bad order", http.StatusBadRequest)
+			return
+		}
+		id = len(ca.orders)
+		ca.orders = append(ca.orders, &testOrder{
+			domain: req.Identifiers[0].Value,
+			token:  fmt.Sprintf("token%d", id),
+			status: "pending",
+		})
+		w.Header().Set("Location", fmt.Sprintf("%s/orders/%d", ca.URL, id))
+		ca.writeJSON(w, http.StatusCreated, ca.orderJSON(id))
+	case ca.scan(r, "/orders/%d", &id):
+		ca.writeJSON(w, http.StatusOK, ca.orderJSON(id))
+	case ca.scan(r, "/authz/%d", &id):
+		o := ca.orders[id]
+		status := "pending"
+		if o.status != "pending" {
+			status = "valid"
+		}
+		ca.writeJSON(w, http.StatusOK, map[string]interface{}{
+			"status":     status,
+			"identifier": map[string]string{"type": "dns", "value": o.domain},
+			"challenges": []map[string]string{{
+				"type":   "http-01",
+				"url":    fmt.Sprintf("%s/challenge/%d", ca.URL, id),
+				"token":  o.token,
+				"status": status,
+			}},
+		})
+	case ca.scan(r, "/challenge/%d", &id):
+		o := ca.orders[id]
+		if err := ca.verifyHTTP01(o); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		o.status = "ready"
+		ca.writeJSON(w, http.StatusOK, map[string]string{"status": "valid"})
+	case ca.scan(r, "/finalize/%d", &id):
+		var req struct{ CSR string }
+		if err := decodeJWSPayload(r, &req); err != nil {
+			http.Error(w, "bad finalize", http.StatusBadRequest)
+			return
+		}
+		o := ca.orders[id]
+		cert, err := ca.sign(o.domain, req.CSR)
+		if err != nil || o.status != "ready" {
+			http.Error(w, fmt.Sprintf("can't finalize: %v", err), http.StatusForbidden)
+			return
+		}
+		o.cert = cert
+		o.status = "valid"
+		ca.issued++
+		ca.writeJSON(w, http.StatusOK, ca.orderJSON(id))
+	case ca.scan(r, "/certs/%d", &id):
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: ca.orders[id].cert})
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: ca.root.Raw})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (ca *testCA) issuedCount() int {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	return ca.issued
+}
+
+// scan parses an id from the request path, returning false if it doesn't match
+// format or refers to an unknown order.
+func (ca *testCA) scan(r *http.Request, format string, id *int) bool {
+	n, err := fmt.Sscanf(r.URL.Path, format, id)
+	return err == nil && n == 1 && *id >= 0 && *id < len(ca.orders)
+}
+
+func (ca *testCA) orderJSON(id int) map[string]interface{} {
+	o := ca.orders[id]
+	res := map[string]interface{}{
+		"status":         o.status,
+		"identifiers":    []map[string]string{{"type": "dns", "value": o.domain}},
+		"authorizations": []string{fmt.Sprintf("%s/authz/%d", ca.URL, id)},
+		"finalize":       fmt.Sprintf("%s/finalize/%d", ca.URL, id),
+	}
+	if o.cert != nil {
+		res["certificate"] = fmt.Sprintf("%s/certs/%d", ca.URL, id)
+	}
+	return res
+}
+
+func (ca *testCA) writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// verifyHTTP01 fetches the challenge response from locus, as a real CA would.
+func (ca *testCA) verifyHTTP01(o *testOrder) error {
+	req, err := http.NewRequest("GET", "http://"+ca.challengeAddr+"/.well-known/acme-challenge/"+o.token, nil)
+	if err != nil {
+		return err
+	}
+	req.Host = o.domain
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK || !strings.HasPrefix(string(body), o.token+".") {
+		return fmt.Errorf("unexpected challenge response %d %q", res.StatusCode, body)
+	}
+	return nil
+}
+
+func (ca *testCA) sign(domain, csr string) ([]byte, error) {
+	der, err := base64.RawURLEncoding.DecodeString(csr)
+	if err != nil {
+		return nil, err
+	}
+	req, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(int64(ca.issued + 2)),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     req.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	return x509.CreateCertificate(rand.Reader, tmpl, ca.root, req.PublicKey, ca.key)
+}
+
+func decodeJWSPayload(r *http.Request, v interface{}) error {
+	var jws struct{ Payload string }
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		return err
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(payload, v)
+}
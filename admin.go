@@ -0,0 +1,157 @@
+package locus
+
+import (
+	"crypto/subtle"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/dpup/locus/tmpl"
+)
+
+// AdminConfig specifies the listener for locus's admin endpoints:
+//
+//	/debug/configs   debug page showing globals, metrics and configs
+//	/debug/reload    POST to reload configs from the config file, only if
+//	                 Username or AllowIPs is set
+//	/debug/vars      expvars
+//	/debug/metrics   metrics, once RegisterMetrics has been called
+//
+// These are never served on the public listeners.
+type AdminConfig struct {
+	// Addr is the host and port to listen on, such as "127.0.0.1:5558".
+	// Required.
+	Addr string
+
+	// Username and Password, if set, require requests to use basic auth.
+	Username string
+	Password string
+
+	// AllowIPs, if not empty, restricts requests to clients with one of these
+	// IPs, or in one of these CIDR ranges. The address of the connection is
+	// used, X-Forwarded-For is ignored.
+	AllowIPs []string
+}
+
+type adminSettings struct {
+	AdminConfig
+	allowed []*net.IPNet
+}
+
+// EnableAdmin starts an admin listener, alongside the public listeners, when
+// ListenAndServe is called. See AdminConfig.
+func (locus *Locus) EnableAdmin(cfg AdminConfig) error {
+	if cfg.Addr == "" {
+		return errors.New("admin listener requires an address")
+	}
+	if (cfg.Username == "") != (cfg.Password == "") {
+		return errors.New("admin basic auth requires both a username and a password")
+	}
+	admin := &adminSettings{AdminConfig: cfg}
+	for _, s := range cfg.AllowIPs {
+		ipNet, ok := parseIPNet(s)
+		if !ok {
+			return fmt.Errorf("invalid admin allowed IP '%s', should be an IP or CIDR range", s)
+		}
+		admin.allowed = append(admin.allowed, ipNet)
+	}
+	locus.admin = admin
+	return nil
+}
+
+// parseIPNet parses an IP or CIDR range. A single IP is returned as a network
+// containing only that IP.
+func parseIPNet(s string) (*net.IPNet, bool) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, false
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}, true
+	}
+	_, ipNet, err := net.ParseCIDR(s)
+	return ipNet, err == nil
+}
+
+// AdminAddr returns the address of the admin listener, or an empty string if
+// it isn't enabled.
+func (locus *Locus) AdminAddr() string {
+	if locus.admin == nil {
+		return ""
+	}
+	return locus.admin.Addr
+}
+
+// AdminHandler returns a handler for the admin endpoints, applying the basic
+// auth and IP restrictions passed to EnableAdmin. Used by the admin listener,
+// it can also be mounted on a custom server.
+func (locus *Locus) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/configs", func(rw http.ResponseWriter, req *http.Request) {
+		tmpl.ConfigsTemplate.Execute(rw, locus)
+	})
+	mux.HandleFunc("/debug/reload", locus.serveReload)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.Handle("/debug/metrics", http.DefaultServeMux)
+	mux.HandleFunc("/", func(rw http.ResponseWriter, req *http.Request) {
+		locus.renderError(rw, http.StatusNotFound)
+	})
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rrw := &recordingResponseWriter{ResponseWriter: rw}
+		if ok, reason := locus.admin.allows(req); !ok {
+			locus.elogf("rejecting admin request from %s: %s", req.RemoteAddr, reason)
+			locus.renderError(rrw, http.StatusForbidden)
+		} else if !locus.admin.authorized(req) {
+			rrw.Header().Set("WWW-Authenticate", `Basic realm="locus admin"`)
+			locus.renderError(rrw, http.StatusUnauthorized)
+		} else {
+			mux.ServeHTTP(rrw, req)
+		}
+		locus.alogf("admin %d %s %s %s - %s %q", rrw.Status(), req.Method, req.Host, req.URL,
+			req.RemoteAddr, req.Header.Get("User-Agent"))
+	})
+}
+
+// allows returns whether the client's IP may use the admin endpoints, and a
+// reason if it can't.
+func (a *adminSettings) allows(req *http.Request) (bool, string) {
+	if a == nil || len(a.allowed) == 0 {
+		return true, ""
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false, "unknown client address"
+	}
+	for _, n := range a.allowed {
+		if n.Contains(ip) {
+			return true, ""
+		}
+	}
+	return false, "IP not allowed"
+}
+
+// restricted returns true if the admin endpoints require basic auth or are
+// limited to certain IPs.
+func (a *adminSettings) restricted() bool {
+	return a != nil && (a.Username != "" || len(a.allowed) > 0)
+}
+
+// authorized returns true if basic auth isn't required, or the request has the
+// right credentials.
+func (a *adminSettings) authorized(req *http.Request) bool {
+	if a == nil || a.Username == "" {
+		return true
+	}
+	user, pass, ok := req.BasicAuth()
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(a.Username)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(a.Password)) == 1
+	return ok && userOK && passOK
+}
@@ -0,0 +1,123 @@
+package locus
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPublicListenerHidesAdmin(t *testing.T) {
+	locus, err := FromConfig([]byte(testSitesYAML))
+	checkError(t, err, "loading config")
+
+	for _, path := range []string{"/debug/configs", "/debug/vars", "/debug/metrics", "/debug/reload"} {
+		for _, method := range []string{"GET", "POST"} {
+			rw := httptest.NewRecorder()
+			locus.ServeHTTP(rw, httptest.NewRequest(method, "http://localhost"+path, nil))
+			if rw.Code != http.StatusNotFound {
+				t.Errorf("%s %s: expected 404 on public listener, was %d", method, path, rw.Code)
+			}
+		}
+	}
+}
+
+func TestAdminAccess(t *testing.T) {
+	locus := New()
+	checkError(t, locus.EnableAdmin(AdminConfig{
+		Addr:     "127.0.0.1:0",
+		Username: "ops",
+		Password: "secret",
+		AllowIPs: []string{"10.0.0.0/8", "::1", "192.0.2.1"},
+	}), "enabling admin")
+	admin := locus.AdminHandler()
+
+	var tests = []struct {
+		remoteAddr string
+		user       string
+		pass       string
+		path       string
+		expected   int
+	}{
+		{"10.1.2.3:5000", "ops", "secret", "/debug/configs", http.StatusOK},
+		{"[::1]:5000", "ops", "secret", "/debug/vars", http.StatusOK},
+		{"192.0.2.1:5000", "ops", "secret", "/debug/configs", http.StatusOK},
+		{"192.0.2.2:5000", "ops", "secret", "/debug/configs", http.StatusForbidden},
+		{"[2001:db8::1]:5000", "ops", "secret", "/debug/configs", http.StatusForbidden},
+		{"10.1.2.3:5000", "ops", "wrong", "/debug/configs", http.StatusUnauthorized},
+		{"10.1.2.3:5000", "", "", "/debug/configs", http.StatusUnauthorized},
+		{"10.1.2.3:5000", "ops", "secret", "/nope", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "http://localhost"+tt.path, nil)
+		req.RemoteAddr = tt.remoteAddr
+		// Forwarded addresses aren't trusted.
+		req.Header.Set("X-Forwarded-For", "10.0.0.1")
+		if tt.user != "" {
+			req.SetBasicAuth(tt.user, tt.pass)
+		}
+		rw := httptest.NewRecorder()
+		admin.ServeHTTP(rw, req)
+		if rw.Code != tt.expected {
+			t.Errorf("%s as %q from %s: expected %d, was %d", tt.path, tt.user, tt.remoteAddr, tt.expected, rw.Code)
+		}
+		if tt.expected == http.StatusUnauthorized && rw.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("Expected WWW-Authenticate header on 401")
+		}
+	}
+}
+
+func TestEnableAdminErrors(t *testing.T) {
+	var tests = []struct {
+		cfg      AdminConfig
+		expected string
+	}{
+		{AdminConfig{}, "admin listener requires an address"},
+		{AdminConfig{Addr: ":5558", Username: "ops"}, "admin basic auth requires both a username and a password"},
+		{AdminConfig{Addr: ":5558", AllowIPs: []string{"localhost"}}, "invalid admin allowed IP 'localhost', should be an IP or CIDR range"},
+		{AdminConfig{Addr: ":5558", AllowIPs: []string{"10.0.0.0/33"}}, "invalid admin allowed IP '10.0.0.0/33', should be an IP or CIDR range"},
+	}
+	for _, tt := range tests {
+		locus := New()
+		if err := locus.EnableAdmin(tt.cfg); err == nil || err.Error() != tt.expected {
+			t.Errorf("Expected error %q, was %v", tt.expected, err)
+		}
+		if locus.AdminAddr() != "" {
+			t.Errorf("Expected admin to remain disabled, was %q", locus.AdminAddr())
+		}
+	}
+}
+
+func TestAdminListener(t *testing.T) {
+	port := freePort(t)
+	adminPort := freePort(t)
+	locus, err := FromConfig([]byte(fmt.Sprintf(`
+globals:
+  port: %d
+  listen: [127.0.0.1]
+  admin:
+    address: 127.0.0.1:%d
+    allow_ips: [127.0.0.1]
+sites: []
+`, port, adminPort)))
+	checkError(t, err, "loading config")
+	defer locus.Shutdown(context.Background())
+
+	go locus.ListenAndServe()
+	public := fmt.Sprintf("127.0.0.1:%d", port)
+	admin := fmt.Sprintf("127.0.0.1:%d", adminPort)
+	waitForListener(t, public)
+	waitForListener(t, admin)
+
+	for addr, expected := range map[string]int{public: http.StatusNotFound, admin: http.StatusOK} {
+		res, err := http.Get("http://" + addr + "/debug/configs")
+		checkError(t, err, "requesting "+addr)
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != expected {
+			t.Errorf("%s: expected %d, was %d: %s", addr, expected, res.StatusCode, body)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package locus
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Headers set on proxied requests with the details of a verified client
+// certificate. Values sent by clients are always stripped, so upstreams can
+// trust them.
+const (
+	ClientCertSubjectHeader = "X-Client-Cert-Subject"
+	ClientCertSANHeader     = "X-Client-Cert-San"
+)
+
+// Modes for ClientAuthConfig.
+const (
+	// ClientAuthRequest asks clients for a certificate, verifying it if one is
+	// sent. Clients without a certificate can still connect.
+	ClientAuthRequest = "request"
+
+	// ClientAuthRequire rejects TLS handshakes without a valid certificate.
+	ClientAuthRequire = "require"
+)
+
+// ClientAuthConfig specifies how the TLS listener authenticates clients using
+// certificates.
+type ClientAuthConfig struct {
+	// Mode is one of ClientAuthRequest or ClientAuthRequire.
+	Mode string
+
+	// CAFile is a PEM bundle of CAs trusted to sign client certificates.
+	// Required.
+	CAFile string
+}
+
+// EnableClientAuth configures the TLS listener to request or require client
+// certificates. The subject and SANs of verified certificates are forwarded to
+// upstreams, and configs can be restricted to certain clients, see
+// ClientCertPolicy.
+func (locus *Locus) EnableClientAuth(cfg ClientAuthConfig) error {
+	var authType tls.ClientAuthType
+	switch cfg.Mode {
+	case ClientAuthRequest:
+		authType = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		authType = tls.RequireAndVerifyClientCert
+	default:
+		return fmt.Errorf("invalid client auth mode '%s', should be one of (%s, %s)",
+			cfg.Mode, ClientAuthRequest, ClientAuthRequire)
+	}
+	if cfg.CAFile == "" {
+		return errors.New("client auth requires a CA file")
+	}
+
+	pem, err := ioutil.ReadFile(cfg.CAFile)
+	if err != nil {
+		return fmt.Errorf("unable to read client CA file: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificates found in client CA file %s", cfg.CAFile)
+	}
+
+	locus.clientAuth = authType
+	locus.clientCAs = pool
+	return nil
+}
+
+// ClientAuthMode returns the mode client certificates are verified with, or an
+// empty string if client auth isn't enabled.
+func (locus *Locus) ClientAuthMode() string {
+	switch {
+	case locus.clientCAs == nil:
+		return ""
+	case locus.clientAuth == tls.RequireAndVerifyClientCert:
+		return ClientAuthRequire
+	default:
+		return ClientAuthRequest
+	}
+}
+
+// ClientCertPolicy restricts a config to clients that presented a certificate
+// which was verified by the TLS listener. Requests that don't satisfy the
+// policy are rejected with a 403.
+type ClientCertPolicy struct {
+	// Require rejects requests without a verified client certificate.
+	Require bool
+
+	// CommonNames, Organizations and SANs, if not empty, each require the
+	// certificate to have at least one of the listed values, and imply Require.
+	// SANs are compared against DNS names, email addresses, IPs and URIs.
+	CommonNames   []string
+	Organizations []string
+	SANs          []string
+}
+
+// Enabled returns true if the policy places any restriction on requests.
+func (p ClientCertPolicy) Enabled() bool {
+	return p.Require || len(p.CommonNames) > 0 || len(p.Organizations) > 0 || len(p.SANs) > 0
+}
+
+// allows returns whether the request satisfies the policy, and a reason if it
+// doesn't.
+func (p ClientCertPolicy) allows(req *http.Request) (bool, string) {
+	if !p.Enabled() {
+		return true, ""
+	}
+	cert := verifiedClientCert(req)
+	if cert == nil {
+		return false, "no verified client certificate"
+	}
+	if len(p.CommonNames) > 0 && !containsAny(p.CommonNames, cert.Subject.CommonName) {
+		return false, fmt.Sprintf("common name %q not allowed", cert.Subject.CommonName)
+	}
+	if len(p.Organizations) > 0 && !containsAny(p.Organizations, cert.Subject.Organization...) {
+		return false, fmt.Sprintf("organization %q not allowed", cert.Subject.Organization)
+	}
+	if len(p.SANs) > 0 && !containsAny(p.SANs, certSANs(cert)...) {
+		return false, fmt.Sprintf("SANs %q not allowed", certSANs(cert))
+	}
+	return true, ""
+}
+
+// String describes the policy for debug pages.
+func (p ClientCertPolicy) String() string {
+	if !p.Enabled() {
+		return "not required"
+	}
+	conds := []string{}
+	if len(p.CommonNames) > 0 {
+		conds = append(conds, "CN "+strings.Join(p.CommonNames, ", "))
+	}
+	if len(p.Organizations) > 0 {
+		conds = append(conds, "O "+strings.Join(p.Organizations, ", "))
+	}
+	if len(p.SANs) > 0 {
+		conds = append(conds, "SAN "+strings.Join(p.SANs, ", "))
+	}
+	if len(conds) == 0 {
+		return "required"
+	}
+	return "required with " + strings.Join(conds, "; ")
+}
+
+// verifiedClientCert returns the client certificate for a request, or nil if
+// the client didn't send one or it wasn't verified against the client CAs.
+func verifiedClientCert(req *http.Request) *x509.Certificate {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return req.TLS.VerifiedChains[0][0]
+}
+
+// certSANs returns every subject alternative name in the certificate.
+func certSANs(cert *x509.Certificate) []string {
+	sans := []string{}
+	sans = append(sans, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, u := range cert.URIs {
+		sans = append(sans, u.String())
+	}
+	return sans
+}
+
+// setClientCertHeaders removes any client cert headers sent by the client, then
+// sets them from the verified certificate, if there is one.
+func setClientCertHeaders(req *http.Request) {
+	req.Header.Del(ClientCertSubjectHeader)
+	req.Header.Del(ClientCertSANHeader)
+
+	cert := verifiedClientCert(req)
+	if cert == nil {
+		return
+	}
+	req.Header.Set(ClientCertSubjectHeader, cert.Subject.String())
+	if sans := certSANs(cert); len(sans) > 0 {
+		req.Header.Set(ClientCertSANHeader, strings.Join(sans, ", "))
+	}
+}
+
+func containsAny(allowed []string, values ...string) bool {
+	for _, v := range values {
+		for _, a := range allowed {
+			if a == v {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,210 @@
+package locus
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpup/locus/upstream"
+)
+
+// withClientCert sets req's TLS state as though cert had been verified by the
+// TLS listener.
+func withClientCert(req *http.Request, cert *x509.Certificate) *http.Request {
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	return req
+}
+
+func TestClientCertPolicy(t *testing.T) {
+	ops := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "alice", Organization: []string{"Ops"}},
+		EmailAddresses: []string{"alice@test.com"},
+		URIs:           []*url.URL{mustParseURL("spiffe://test.com/alice")},
+	}
+
+	var tests = []struct {
+		policy   ClientCertPolicy
+		cert     *x509.Certificate
+		expected bool
+	}{
+		{ClientCertPolicy{}, nil, true},
+		{ClientCertPolicy{Require: true}, nil, false},
+		{ClientCertPolicy{Require: true}, ops, true},
+		{ClientCertPolicy{CommonNames: []string{"alice", "bob"}}, ops, true},
+		{ClientCertPolicy{CommonNames: []string{"bob"}}, ops, false},
+		{ClientCertPolicy{CommonNames: []string{"alice"}}, nil, false},
+		{ClientCertPolicy{Organizations: []string{"Ops"}}, ops, true},
+		{ClientCertPolicy{Organizations: []string{"Eng"}}, ops, false},
+		{ClientCertPolicy{SANs: []string{"alice@test.com"}}, ops, true},
+		{ClientCertPolicy{SANs: []string{"spiffe://test.com/alice"}}, ops, true},
+		{ClientCertPolicy{SANs: []string{"bob@test.com"}}, ops, false},
+		{ClientCertPolicy{Organizations: []string{"Ops"}, SANs: []string{"bob@test.com"}}, ops, false},
+	}
+	for i, tt := range tests {
+		req := mustReq("https://admin.test.com/")
+		if tt.cert != nil {
+			withClientCert(req, tt.cert)
+		}
+		if ok, reason := tt.policy.allows(req); ok != tt.expected {
+			t.Errorf("Test %d: expected %v, was %v (%s)", i, tt.expected, ok, reason)
+		}
+	}
+}
+
+func TestClientCertHeaders(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "alice", Organization: []string{"Ops"}},
+		DNSNames: []string{"alice.test.com"},
+	}
+
+	d := &Director{UpstreamProvider: upstream.Single("http://upstream.com")}
+
+	// Headers sent by the client are stripped.
+	req := mustReq("https://test.com/")
+	req.Header.Set(ClientCertSubjectHeader, "CN=mallory")
+	req.Header.Set(ClientCertSANHeader, "mallory.test.com")
+	proxyreq, err := d.Direct(req)
+	checkError(t, err, "directing request")
+	if _, ok := proxyreq.Header[ClientCertSubjectHeader]; ok {
+		t.Errorf("Expected spoofed subject to be stripped, was %q", proxyreq.Header.Get(ClientCertSubjectHeader))
+	}
+	if _, ok := proxyreq.Header[ClientCertSANHeader]; ok {
+		t.Errorf("Expected spoofed SAN to be stripped, was %q", proxyreq.Header.Get(ClientCertSANHeader))
+	}
+
+	// And replaced with the verified certificate's details.
+	proxyreq, err = d.Direct(withClientCert(req, cert))
+	checkError(t, err, "directing request")
+	if s := proxyreq.Header.Get(ClientCertSubjectHeader); s != "CN=alice,O=Ops" {
+		t.Errorf("Unexpected subject header, was %q", s)
+	}
+	if s := proxyreq.Header.Get(ClientCertSANHeader); s != "alice.test.com" {
+		t.Errorf("Unexpected SAN header, was %q", s)
+	}
+}
+
+func TestClientAuthListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "locus")
+	checkError(t, err, "creating temp dir")
+	defer os.RemoveAll(dir)
+
+	serverCert, serverKey := writeTestCert(t, dir, "server", "locus.test")
+	opsCert, opsKey := writeTestCert(t, dir, "ops", "ops.internal")
+	strangerCert, strangerKey := writeTestCert(t, dir, "stranger", "stranger.internal")
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get(ClientCertSubjectHeader) + "|" + r.Header.Get(ClientCertSANHeader)))
+	}))
+	defer backend.Close()
+
+	start := func(mode string) *httptest.Server {
+		locus := New()
+		checkError(t, locus.AddCertificate(serverCert, serverKey), "adding certificate")
+		checkError(t, locus.EnableClientAuth(ClientAuthConfig{Mode: mode, CAFile: opsCert}), "enabling client auth")
+		admin := locus.NewConfig()
+		admin.BindHost("admin.test")
+		admin.Upstream(upstream.Single(backend.URL))
+		admin.ClientCert = ClientCertPolicy{CommonNames: []string{"ops.internal"}}
+		public := locus.NewConfig()
+		public.BindHost("public.test")
+		public.Upstream(upstream.Single(backend.URL))
+
+		s := httptest.NewUnstartedServer(locus)
+		s.TLS = locus.tlsConfig()
+		s.StartTLS()
+		return s
+	}
+
+	serverPEM, err := ioutil.ReadFile(serverCert)
+	checkError(t, err, "reading server cert")
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(serverPEM)
+	client := func(certFile, keyFile string) *http.Client {
+		cfg := &tls.Config{RootCAs: roots, ServerName: "locus.test"}
+		if certFile != "" {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			checkError(t, err, "loading client cert")
+			cfg.Certificates = []tls.Certificate{cert}
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+	}
+
+	var tests = []struct {
+		mode     string
+		host     string
+		certFile string
+		keyFile  string
+		expected int
+		body     string
+	}{
+		{ClientAuthRequest, "admin.test", opsCert, opsKey, http.StatusOK, "CN=ops.internal|ops.internal"},
+		{ClientAuthRequest, "admin.test", "", "", http.StatusForbidden, ""},
+		{ClientAuthRequest, "public.test", "", "", http.StatusOK, "|"},
+		{ClientAuthRequest, "public.test", opsCert, opsKey, http.StatusOK, "CN=ops.internal|ops.internal"},
+		// Clients don't offer certificates from CAs the listener doesn't trust.
+		{ClientAuthRequest, "public.test", strangerCert, strangerKey, http.StatusOK, "|"},
+		{ClientAuthRequest, "admin.test", strangerCert, strangerKey, http.StatusForbidden, ""},
+		{ClientAuthRequire, "public.test", "", "", 0, ""},
+		{ClientAuthRequire, "public.test", opsCert, opsKey, http.StatusOK, "CN=ops.internal|ops.internal"},
+	}
+	for i, tt := range tests {
+		s := start(tt.mode)
+		req, err := http.NewRequest("GET", s.URL, nil)
+		checkError(t, err, "creating request")
+		req.Host = tt.host
+		req.Header.Set(ClientCertSubjectHeader, "CN=mallory")
+
+		res, err := client(tt.certFile, tt.keyFile).Do(req)
+		if tt.expected == 0 {
+			if err == nil {
+				res.Body.Close()
+				t.Errorf("Test %d: expected handshake to fail, was %d", i, res.StatusCode)
+			}
+			s.Close()
+			continue
+		}
+		checkError(t, err, "making request")
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		s.Close()
+
+		if res.StatusCode != tt.expected {
+			t.Errorf("Test %d: expected %d, was %d", i, tt.expected, res.StatusCode)
+		} else if tt.body != "" && string(body) != tt.body {
+			t.Errorf("Test %d: expected upstream to see %q, was %q", i, tt.body, body)
+		}
+	}
+}
+
+func TestEnableClientAuthErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "locus")
+	checkError(t, err, "creating temp dir")
+	defer os.RemoveAll(dir)
+	garbage := filepath.Join(dir, "garbage.pem")
+	checkError(t, ioutil.WriteFile(garbage, []byte("not a cert"), 0600), "writing garbage")
+
+	var tests = []struct {
+		cfg      ClientAuthConfig
+		expected string
+	}{
+		{ClientAuthConfig{Mode: "optional", CAFile: garbage}, "invalid client auth mode 'optional', should be one of (request, require)"},
+		{ClientAuthConfig{Mode: ClientAuthRequire}, "client auth requires a CA file"},
+		{ClientAuthConfig{Mode: ClientAuthRequire, CAFile: garbage}, "no certificates found in client CA file " + garbage},
+	}
+	for _, tt := range tests {
+		locus := New()
+		if err := locus.EnableClientAuth(tt.cfg); err == nil || err.Error() != tt.expected {
+			t.Errorf("Expected error %q, was %v", tt.expected, err)
+		}
+		if locus.ClientAuthMode() != "" {
+			t.Errorf("Expected client auth to remain disabled, was %q", locus.ClientAuthMode())
+		}
+	}
+}
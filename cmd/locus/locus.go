@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	_ "expvar"
 	"flag"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/dpup/locus"
 	_ "github.com/dpup/locus/upstream/ecs"
@@ -21,8 +25,37 @@ func main() {
 		os.Exit(1)
 	}
 	proxy.RegisterMetricsWithDefaultRegistry()
-	if err := proxy.ListenAndServe(); err != nil {
+
+	// Reload sites from the config file on SIGHUP, keeping the current config if
+	// the new one is invalid.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := proxy.Reload(); err != nil {
+				log.Printf("error reloading %s, keeping current config: %v", *conf, err)
+			}
+		}
+	}()
+
+	// Stop accepting connections on SIGTERM or SIGINT, and give in flight
+	// requests until the drain timeout to complete.
+	drained := make(chan struct{})
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		<-term
+		ctx, cancel := context.WithTimeout(context.Background(), proxy.DrainTimeout)
+		defer cancel()
+		if err := proxy.Shutdown(ctx); err != nil {
+			log.Printf("error draining connections: %v", err)
+		}
+		close(drained)
+	}()
+
+	if err := proxy.ListenAndServe(); err != http.ErrServerClosed {
 		log.Println(err)
 		os.Exit(1)
 	}
+	<-drained
 }
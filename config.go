@@ -1,6 +1,7 @@
 package locus
 
 import (
+	"net/http"
 	"net/url"
 
 	"github.com/dpup/locus/upstream"
@@ -21,6 +22,45 @@ type Config struct {
 	// Redirect specfied a HTTP status code that should be issued along with a
 	// Location header. Should one of be 301, 302, 307.
 	Redirect int
+
+	// Retry specifies when failed requests should be resent to another
+	// upstream. By default requests are not retried.
+	Retry RetryPolicy
+
+	// ClientCert restricts the config to clients with a verified TLS client
+	// certificate. See Locus.EnableClientAuth.
+	ClientCert ClientCertPolicy
+
+	// Transport is used to make requests to the config's upstreams. If nil,
+	// a transport shared by all configs is used. See NewTransport.
+	Transport http.RoundTripper
+
+	// Listeners restricts the config to requests received on the named
+	// listeners. If empty, the config applies to every listener.
+	Listeners []string
+}
+
+// match is Matcher.match, additionally requiring that the request was received
+// on one of the config's listeners.
+func (c *Config) match(req *http.Request) (bool, string, map[string]string) {
+	if !c.servesListener(listenerName(req)) {
+		return false, "listener mismatch", nil
+	}
+	return c.Matcher.match(req)
+}
+
+// servesListener returns true if the config applies to requests received on
+// the named listener.
+func (c *Config) servesListener(name string) bool {
+	if len(c.Listeners) == 0 {
+		return true
+	}
+	for _, l := range c.Listeners {
+		if l == name {
+			return true
+		}
+	}
+	return false
 }
 
 // Bind uses an URL to define the host:port/path?query components to match on.
@@ -47,6 +87,35 @@ func (c *Config) BindLocation(requestURI string) {
 	c.PathPrefix = path
 }
 
+// BindPathExact matches requests whose path is exactly path. As with Bind, the
+// path is stripped when proxying to an upstream with a path.
+func (c *Config) BindPathExact(path string) {
+	c.Matcher.BindPathExact(path)
+	c.PathPrefix = path
+}
+
+// BindPathPrefix matches requests whose path starts with the segments in
+// prefix. As with Bind, the prefix is stripped when proxying to an upstream
+// with a path.
+func (c *Config) BindPathPrefix(prefix string) {
+	c.Matcher.BindPathPrefix(prefix)
+	c.PathPrefix = prefix
+}
+
+// BindPathRegexp matches requests whose whole path matches pattern. Named
+// groups can be referenced in the upstream's path, e.g. "/avatars/{id}.png".
+func (c *Config) BindPathRegexp(pattern string) error {
+	c.PathPrefix = ""
+	return c.Matcher.BindPathRegexp(pattern)
+}
+
+// BindPathTemplate matches requests whose path fits a template such as
+// "/users/{id}/avatar". Parameters can be referenced in the upstream's path.
+func (c *Config) BindPathTemplate(template string) error {
+	c.PathPrefix = ""
+	return c.Matcher.BindPathTemplate(template)
+}
+
 // Upstream specifies an UpstreamProvider to use when finding the destination
 // server.
 //
@@ -56,3 +125,23 @@ func (c *Config) BindLocation(requestURI string) {
 func (c *Config) Upstream(u upstream.Provider) {
 	c.Director.UpstreamProvider = u
 }
+
+// stop ends any background work being done by the config's upstreams, such as
+// health checks, and closes idle connections in its transport. Called when a
+// config is no longer in use.
+func (c *Config) stop() {
+	if c.UpstreamProvider != nil {
+		upstream.Stop(c.UpstreamProvider)
+	}
+	if t, ok := c.Transport.(interface{ CloseIdleConnections() }); ok {
+		t.CloseIdleConnections()
+	}
+}
+
+// stopConfigs stops cfgs once they are replaced, or when a config file fails to
+// load partway through.
+func stopConfigs(cfgs []*Config) {
+	for _, c := range cfgs {
+		c.stop()
+	}
+}
@@ -1,13 +1,38 @@
 package locus
 
 import (
+	"context"
 	"errors"
 	"net/http"
+	"net/url"
+	"regexp"
 	"strings"
 
 	"github.com/dpup/locus/upstream"
 )
 
+// errNoUpstream is returned when a provider has no upstreams to offer, such as
+// when every circuit breaker is open.
+var errNoUpstream = errors.New("no upstream available")
+
+// upstreamParam matches parameter references in upstream paths, such as {id}.
+var upstreamParam = regexp.MustCompile(`\{(\w+)\}`)
+
+type pathParamsKey struct{}
+
+// PathParams returns the parameters captured from the request path by a
+// config bound with BindPathRegexp or BindPathTemplate, or nil if there are
+// none.
+func PathParams(req *http.Request) map[string]string {
+	params, _ := req.Context().Value(pathParamsKey{}).(map[string]string)
+	return params
+}
+
+// withPathParams returns a shallow copy of req carrying params.
+func withPathParams(req *http.Request, params map[string]string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), pathParamsKey{}, params))
+}
+
 // Director specifies how to direct a request to an upstream backend.
 type Director struct {
 	// PathPrefix will be stripped from the incoming request path, iff the
@@ -61,23 +86,52 @@ type Director struct {
 //     request   = http://abc.com/def/ghi
 //     proxied   = http://upstream.com/xyz/ghi
 //
+// If the upstream path references parameters captured by a path regexp or
+// template, see PathParams, the proxied request's path is the upstream path
+// with the parameters substituted.
+//
+// Examples 4: Upstream path built from a template's parameters.
+//
+//     match     = /users/{id}/avatar
+//     upstream  = http://upstream.com/avatars/{id}.png
+//     request   = http://abc.com/users/123/avatar
+//     proxied   = http://upstream.com/avatars/123.png
+//
 func (d *Director) Direct(req *http.Request) (*http.Request, error) {
+	proxyreq, _, err := d.direct(req)
+	return proxyreq, err
+}
+
+// direct is Direct but also returns the upstream that was chosen, so that the
+// result of the proxied request can be reported back to the UpstreamProvider.
+func (d *Director) direct(req *http.Request) (*http.Request, *url.URL, error) {
 	upstream, err := d.UpstreamProvider.Get(req)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if upstream == nil {
-		// TODO: Make 503
-		return nil, errors.New("no upstream available")
+		return nil, nil, errNoUpstream
 	}
+	return d.directTo(req, upstream), upstream, nil
+}
 
+// directTo returns a copy of req, modified for proxying to upstream.
+func (d *Director) directTo(req *http.Request, upstream *url.URL) *http.Request {
 	req = copyRequest(req)
 
 	// Update destination.
 	req.URL.Scheme = upstream.Scheme
 	req.URL.Host = upstream.Host
 
-	if upstream.Path != "" {
+	if params := PathParams(req); len(params) > 0 && upstreamParam.MatchString(upstream.Path) {
+		req.URL.Path = upstreamParam.ReplaceAllStringFunc(upstream.Path, func(ref string) string {
+			if v, ok := params[ref[1:len(ref)-1]]; ok {
+				return v
+			}
+			return ref
+		})
+		req.URL.RawPath = ""
+	} else if upstream.Path != "" {
 		pathSuffix := strings.TrimPrefix(req.URL.Path, d.PathPrefix)
 		if pathSuffix == "" {
 			req.URL.Path = upstream.Path
@@ -86,6 +140,10 @@ func (d *Director) Direct(req *http.Request) (*http.Request, error) {
 		}
 	}
 
+	// Client cert headers are set before the config's own headers, so they can
+	// still be stripped or overridden.
+	setClientCertHeaders(req)
+
 	// Strip, set and add headers.
 	for _, h := range d.stripHeaders {
 		delete(req.Header, h)
@@ -103,7 +161,7 @@ func (d *Director) Direct(req *http.Request) (*http.Request, error) {
 		req.Header[k] = append(req.Header[k], v...)
 	}
 
-	return req, nil
+	return req
 }
 
 // AddHeader specifies a header to add to the proxied request.
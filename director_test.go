@@ -28,6 +28,26 @@ func TestPathForwarding(t *testing.T) {
 	}
 }
 
+func TestIPv6Forwarding(t *testing.T) {
+	dir := Director{UpstreamProvider: upstream.Single("http://[2001:db8::1]:8080/app")}
+	dir.SetHeader("Host", "[::1]:5555")
+
+	req := mustReq("http://[::1]:5555/users")
+	req.RemoteAddr = "[2001:db8::2]:41234"
+	proxyreq, err := dir.Direct(req)
+	checkError(t, err, "directing request")
+
+	if proxyreq.URL.Host != "[2001:db8::1]:8080" {
+		t.Errorf("Expected host to be '[2001:db8::1]:8080', was %s", proxyreq.URL.Host)
+	}
+	if proxyreq.URL.Path != "/app/users" {
+		t.Errorf("Expected path to be '/app/users', was %s", proxyreq.URL.Path)
+	}
+	if proxyreq.Host != "[::1]:5555" {
+		t.Errorf("Expected Host header to be '[::1]:5555', was %s", proxyreq.Host)
+	}
+}
+
 func TestPath(t *testing.T) {
 	dir := Director{
 		UpstreamProvider: upstream.Single("https://en.wikipedia.org/wiki/"),
@@ -80,3 +100,30 @@ func TestHeaders(t *testing.T) {
 		t.Errorf("Expected Referer to be overwritten, was %s", proxyReq.Header["Referer"])
 	}
 }
+
+func TestPathParams(t *testing.T) {
+	var tests = []struct {
+		upstream string
+		params   map[string]string
+		expected string
+	}{
+		{"http://cdn.com/avatars/{id}.png", map[string]string{"id": "123"}, "http://cdn.com/avatars/123.png"},
+		{"http://cdn.com/{user}/{file}", map[string]string{"user": "bob", "file": "css/site.css"}, "http://cdn.com/bob/css/site.css"},
+		{"http://cdn.com/{id}/{missing}", map[string]string{"id": "123"}, "http://cdn.com/123/%7Bmissing%7D"},
+		// Without parameters the upstream path is joined as usual.
+		{"http://cdn.com/{id}", nil, "http://cdn.com/%7Bid%7D/users/123/avatar"},
+		{"http://cdn.com/static", map[string]string{"id": "123"}, "http://cdn.com/static/users/123/avatar"},
+	}
+	for _, tt := range tests {
+		dir := Director{UpstreamProvider: upstream.Single(tt.upstream)}
+		req := mustReq("http://test.com/users/123/avatar")
+		if tt.params != nil {
+			req = withPathParams(req, tt.params)
+		}
+		proxyreq, err := dir.Direct(req)
+		checkError(t, err, "directing request")
+		if actual := proxyreq.URL.String(); actual != tt.expected {
+			t.Errorf("%s with %v => %s, want %s", tt.upstream, tt.params, actual, tt.expected)
+		}
+	}
+}
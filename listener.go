@@ -0,0 +1,205 @@
+package locus
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Protocols for Listener.
+const (
+	// ListenerHTTP serves HTTP/1.1 over TCP.
+	ListenerHTTP = "http"
+
+	// ListenerHTTPS serves HTTP/1.1 and HTTP/2 over TLS, using the certificates
+	// added with AddCertificate or EnableACME.
+	ListenerHTTPS = "https"
+
+	// ListenerH2C serves HTTP/1.1 and unencrypted HTTP/2 over TCP, for use
+	// behind load balancers that speak HTTP/2 to their backends.
+	ListenerH2C = "h2c"
+
+	// ListenerUnix serves HTTP/1.1 over a unix socket, Addr is the path of the
+	// socket.
+	ListenerUnix = "unix"
+)
+
+// Listener is an address that locus accepts connections on. Configs can be
+// restricted to requests received on certain listeners, see Config.Listeners.
+type Listener struct {
+	// Name identifies the listener in Config.Listeners and logs.
+	Name string
+
+	// Addr is a host and port, such as ":443" or "[::1]:8080", or for unix
+	// listeners the path of the socket.
+	Addr string
+
+	// Protocol is one of ListenerHTTP, ListenerHTTPS, ListenerH2C or
+	// ListenerUnix. Defaults to ListenerHTTP.
+	Protocol string
+
+	// ReadTimeout and WriteTimeout override Locus.ReadTimeout and
+	// Locus.WriteTimeout for the listener's connections.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// IdleTimeout is how long keep-alive connections are kept open waiting for
+	// the next request. Zero uses the read timeout.
+	IdleTimeout time.Duration
+}
+
+func (l Listener) String() string {
+	return fmt.Sprintf("%s: %s on %s", l.Name, l.protocol(), l.Addr)
+}
+
+func (l Listener) protocol() string {
+	if l.Protocol == "" {
+		return ListenerHTTP
+	}
+	return l.Protocol
+}
+
+// ResolvedListeners returns locus.Listeners or, if there are none, the
+// listeners implied by Port, TLSPort and ListenAddrs, named "http" and "https".
+func (locus *Locus) ResolvedListeners() []Listener {
+	if len(locus.Listeners) > 0 {
+		return locus.Listeners
+	}
+	addrs := locus.ListenAddrs
+	if len(addrs) == 0 {
+		addrs = []string{""}
+	}
+	listeners := []Listener{}
+	for _, addr := range addrs {
+		// IPv6 addresses may be given with or without brackets.
+		addr = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+		listeners = append(listeners, Listener{
+			Name:     ListenerHTTP,
+			Addr:     net.JoinHostPort(addr, strconv.Itoa(int(locus.Port))),
+			Protocol: ListenerHTTP,
+		})
+		if locus.TLSPort != 0 {
+			listeners = append(listeners, Listener{
+				Name:     ListenerHTTPS,
+				Addr:     net.JoinHostPort(addr, strconv.Itoa(int(locus.TLSPort))),
+				Protocol: ListenerHTTPS,
+			})
+		}
+	}
+	return listeners
+}
+
+// validateListeners returns an error if any of locus.Listeners are invalid.
+func (locus *Locus) validateListeners() error {
+	seen := map[string]bool{}
+	for _, l := range locus.Listeners {
+		if l.Name == "" {
+			return fmt.Errorf("missing name for listener on '%s'", l.Addr)
+		}
+		if seen[l.Name] {
+			return fmt.Errorf("duplicate listener '%s'", l.Name)
+		}
+		seen[l.Name] = true
+		if l.Addr == "" {
+			return fmt.Errorf("missing address for listener '%s'", l.Name)
+		}
+		switch l.protocol() {
+		case ListenerHTTP, ListenerH2C, ListenerUnix:
+		case ListenerHTTPS:
+			if locus.certs.empty() && locus.acme == nil {
+				return fmt.Errorf("listener '%s' uses https, but no certificates or acme configured", l.Name)
+			}
+		default:
+			return fmt.Errorf("invalid protocol '%s' for listener '%s', should be one of (%s, %s, %s, %s)",
+				l.Protocol, l.Name, ListenerHTTP, ListenerHTTPS, ListenerH2C, ListenerUnix)
+		}
+	}
+	return nil
+}
+
+// checkConfigListeners returns an error if any of cfgs are restricted to a
+// listener that doesn't exist.
+func (locus *Locus) checkConfigListeners(cfgs []*Config) error {
+	names := map[string]bool{}
+	for _, l := range locus.ResolvedListeners() {
+		names[l.Name] = true
+	}
+	for _, c := range cfgs {
+		for _, name := range c.Listeners {
+			if !names[name] {
+				return fmt.Errorf("config '%s' is restricted to unknown listener '%s'", c.Name, name)
+			}
+		}
+	}
+	return nil
+}
+
+// listenerKey is the context key for the name of the listener a request was
+// received on.
+type listenerKey struct{}
+
+// listenerName returns the name of the listener req was received on, or an
+// empty string if it didn't come from one of locus's listeners.
+func listenerName(req *http.Request) string {
+	name, _ := req.Context().Value(listenerKey{}).(string)
+	return name
+}
+
+// newServer returns a server for l, which records l's name on each request.
+func (locus *Locus) newServer(l Listener) *http.Server {
+	s := &http.Server{
+		Addr:           l.Addr,
+		Handler:        locus,
+		ReadTimeout:    locus.ReadTimeout,
+		WriteTimeout:   locus.WriteTimeout,
+		IdleTimeout:    l.IdleTimeout,
+		MaxHeaderBytes: 1 << 20,
+		ErrorLog:       locus.ErrorLog,
+		BaseContext: func(net.Listener) context.Context {
+			return context.WithValue(context.Background(), listenerKey{}, l.Name)
+		},
+	}
+	if l.ReadTimeout != 0 {
+		s.ReadTimeout = l.ReadTimeout
+	}
+	if l.WriteTimeout != 0 {
+		s.WriteTimeout = l.WriteTimeout
+	}
+	switch l.protocol() {
+	case ListenerHTTPS:
+		s.TLSConfig = locus.tlsConfig()
+	case ListenerH2C:
+		s.Protocols = new(http.Protocols)
+		s.Protocols.SetHTTP1(true)
+		s.Protocols.SetUnencryptedHTTP2(true)
+	}
+	return s
+}
+
+// serve listens on l's address and serves connections with s until it is shut
+// down.
+func (locus *Locus) serve(l Listener, s *http.Server) error {
+	network := "tcp"
+	if l.protocol() == ListenerUnix {
+		network = "unix"
+		// A socket left by a previous process would stop us binding.
+		if fi, err := os.Stat(l.Addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(l.Addr)
+		}
+	}
+	ln, err := net.Listen(network, l.Addr)
+	if err != nil {
+		return err
+	}
+	if l.protocol() == ListenerHTTPS {
+		locus.elogf("Starting Locus listener %s for %v", l, locus.CertificateNames())
+		return s.ServeTLS(ln, "", "")
+	}
+	locus.elogf("Starting Locus listener %s", l)
+	return s.Serve(ln)
+}
@@ -0,0 +1,198 @@
+package locus
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dpup/locus/upstream"
+)
+
+func TestListeners(t *testing.T) {
+	dir, err := ioutil.TempDir("", "locus")
+	checkError(t, err, "creating temp dir")
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "locus.sock")
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer backend.Close()
+
+	public := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	internal := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	locus := New()
+	locus.Listeners = []Listener{
+		{Name: "public", Addr: public},
+		{Name: "internal", Addr: internal, Protocol: ListenerH2C},
+		{Name: "local", Addr: sock, Protocol: ListenerUnix},
+	}
+	tools := locus.NewConfig()
+	tools.Listeners = []string{"internal", "local"}
+	tools.BindLocation("/tools")
+	tools.Upstream(upstream.Single(backend.URL + "/internal"))
+	site := locus.NewConfig()
+	site.BindLocation("/")
+	site.Upstream(upstream.Single(backend.URL + "/public"))
+	defer locus.Shutdown(context.Background())
+
+	go locus.ListenAndServe()
+	waitForListener(t, public)
+	waitForListener(t, internal)
+
+	h2c := &http.Transport{Protocols: new(http.Protocols)}
+	h2c.Protocols.SetUnencryptedHTTP2(true)
+	unix := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+		},
+	}
+
+	var tests = []struct {
+		transport http.RoundTripper
+		addr      string
+		proto     string
+		expected  string
+	}{
+		{http.DefaultTransport, public, "HTTP/1.1", "/public/tools"},
+		{h2c, internal, "HTTP/2.0", "/internal"},
+		{unix, "locus.sock", "HTTP/1.1", "/internal"},
+	}
+	for _, tt := range tests {
+		res, err := (&http.Client{Transport: tt.transport}).Get("http://" + tt.addr + "/tools")
+		checkError(t, err, "requesting "+tt.addr)
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if string(body) != tt.expected || res.Proto != tt.proto {
+			t.Errorf("%s: expected %s over %s, was %q over %s", tt.addr, tt.expected, tt.proto, body, res.Proto)
+		}
+	}
+}
+
+func TestListenerTimeouts(t *testing.T) {
+	locus := New()
+	s := locus.newServer(Listener{Name: "slow", Addr: ":0", ReadTimeout: time.Minute, IdleTimeout: time.Hour})
+	if s.ReadTimeout != time.Minute || s.WriteTimeout != locus.WriteTimeout || s.IdleTimeout != time.Hour {
+		t.Errorf("Unexpected timeouts, read %s write %s idle %s", s.ReadTimeout, s.WriteTimeout, s.IdleTimeout)
+	}
+}
+
+func TestResolvedListeners(t *testing.T) {
+	locus := New()
+	locus.Port = 80
+	locus.TLSPort = 443
+	locus.ListenAddrs = []string{"127.0.0.1", "[::1]"}
+
+	expected := []Listener{
+		{Name: "http", Addr: "127.0.0.1:80", Protocol: ListenerHTTP},
+		{Name: "https", Addr: "127.0.0.1:443", Protocol: ListenerHTTPS},
+		{Name: "http", Addr: "[::1]:80", Protocol: ListenerHTTP},
+		{Name: "https", Addr: "[::1]:443", Protocol: ListenerHTTPS},
+	}
+	if actual := locus.ResolvedListeners(); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Unexpected listeners, expected %v was %v", expected, actual)
+	}
+
+	locus.Listeners = []Listener{{Name: "public", Addr: ":8080"}}
+	if actual := locus.ResolvedListeners(); !reflect.DeepEqual(actual, locus.Listeners) {
+		t.Errorf("Expected explicit listeners to be used, was %v", actual)
+	}
+}
+
+func TestListenerErrors(t *testing.T) {
+	var tests = []struct {
+		listeners []Listener
+		expected  string
+	}{
+		{[]Listener{{Addr: ":80"}}, "missing name for listener on ':80'"},
+		{[]Listener{{Name: "a", Addr: ":80"}, {Name: "a", Addr: ":81"}}, "duplicate listener 'a'"},
+		{[]Listener{{Name: "a"}}, "missing address for listener 'a'"},
+		{[]Listener{{Name: "a", Addr: ":80", Protocol: "spdy"}}, "invalid protocol 'spdy' for listener 'a', should be one of (http, https, h2c, unix)"},
+		{[]Listener{{Name: "a", Addr: ":443", Protocol: ListenerHTTPS}}, "listener 'a' uses https, but no certificates or acme configured"},
+	}
+	for _, tt := range tests {
+		locus := New()
+		locus.Listeners = tt.listeners
+		if err := locus.ListenAndServe(); err == nil || err.Error() != tt.expected {
+			t.Errorf("Expected error %q, was %v", tt.expected, err)
+		}
+	}
+
+	locus := New()
+	cfg := locus.NewConfig()
+	cfg.Name = "tools"
+	cfg.Listeners = []string{"internal"}
+	expected := "config 'tools' is restricted to unknown listener 'internal'"
+	if err := locus.ListenAndServe(); err == nil || err.Error() != expected {
+		t.Errorf("Expected error %q, was %v", expected, err)
+	}
+}
+
+func TestListenersYAML(t *testing.T) {
+	yml := `
+globals:
+  listeners:
+    - name: public
+      address: ":8080"
+    - name: internal
+      address: 10.0.0.5:8081
+      protocol: h2c
+      read_timeout: 5m
+sites:
+  - name: tools
+    upstream: http://tools.test.com
+    listeners: [internal]
+  - name: site
+    upstream: http://site.test.com
+`
+	locus, err := FromConfig([]byte(yml))
+	checkError(t, err, "loading config")
+
+	expected := []Listener{
+		{Name: "public", Addr: ":8080"},
+		{Name: "internal", Addr: "10.0.0.5:8081", Protocol: ListenerH2C, ReadTimeout: 5 * time.Minute},
+	}
+	if !reflect.DeepEqual(locus.Listeners, expected) {
+		t.Errorf("Unexpected listeners, expected %v was %v", expected, locus.Listeners)
+	}
+	if l := locus.Configs[0].Listeners; !reflect.DeepEqual(l, []string{"internal"}) {
+		t.Errorf("Expected 'tools' to be restricted to 'internal', was %v", l)
+	}
+
+	// Sites restricted to listeners are only matched on those listeners, and
+	// don't make other sites unreachable.
+	req := mustReq("http://test.com/")
+	onInternal := req.WithContext(context.WithValue(req.Context(), listenerKey{}, "internal"))
+	if c, _ := locus.findConfig(onInternal); c == nil || c.Name != "tools" {
+		t.Errorf("Expected 'tools' on internal listener, was %v", c)
+	}
+	if c, _ := locus.findConfig(req); c == nil || c.Name != "site" {
+		t.Errorf("Expected 'site' elsewhere, was %v", c)
+	}
+	if w := unreachableConfigs(locus.Configs, false); len(w) != 0 {
+		t.Errorf("Unexpected warnings %v", w)
+	}
+
+	err = locus.ReloadConfig([]byte("sites:\n  - name: x\n    upstream: http://x.com\n    listeners: [admin]\n"))
+	expectedErr := "config 'x' is restricted to unknown listener 'admin'"
+	if err == nil || err.Error() != expectedErr {
+		t.Errorf("Expected error %q, was %v", expectedErr, err)
+	}
+	if len(locus.CurrentConfigs()) != 2 {
+		t.Errorf("Expected configs to be kept after failed reload")
+	}
+
+	_, err = FromConfig([]byte("globals:\n  listeners:\n    - {name: a, address: ':80', protocol: quic}\nsites: []\n"))
+	expectedErr = "invalid protocol 'quic' for listener 'a', should be one of (http, https, h2c, unix)"
+	if err == nil || err.Error() != expectedErr {
+		t.Errorf("Expected error %q, was %v", expectedErr, err)
+	}
+}
@@ -2,14 +2,22 @@
 package locus
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"sync"
 	"time"
 
 	"github.com/dpup/locus/tmpl"
+	"github.com/dpup/locus/upstream"
+	"golang.org/x/crypto/acme/autocert"
 
 	metrics "github.com/rcrowley/go-metrics"
 	"github.com/rcrowley/go-metrics/exp"
@@ -38,6 +46,19 @@ type Locus struct {
 	// Port specifies the port for incoming connections.
 	Port uint16
 
+	// TLSPort specifies the port for incoming TLS connections. If zero, no TLS
+	// listener is started. Certificates are chosen by SNI, see AddCertificate.
+	TLSPort uint16
+
+	// ListenAddrs restricts Port and TLSPort to specific addresses, such as
+	// "127.0.0.1" or "::1". If empty, all interfaces are listened on, for both
+	// IPv4 and IPv6 where the OS supports dual-stack sockets.
+	ListenAddrs []string
+
+	// Listeners specifies each address to accept connections on, and how. If
+	// set, Port, TLSPort and ListenAddrs are ignored.
+	Listeners []Listener
+
 	// ReadTimeout is the maximum duration before timing out read of the request.
 	ReadTimeout time.Duration
 
@@ -45,58 +66,183 @@ type Locus struct {
 	// response.
 	WriteTimeout time.Duration
 
-	// Configs is a list of sites that locus will forward for.
+	// DrainTimeout is how long in flight requests are given to complete when
+	// shutting down. Used by callers of Shutdown.
+	DrainTimeout time.Duration
+
+	// UpgradeIdleTimeout closes upgraded connections, such as WebSockets, once
+	// neither side has sent anything for this long. Zero means never.
+	UpgradeIdleTimeout time.Duration
+
+	// CompiledRouting routes each request to the most specific matching config,
+	// using a compiled route table, instead of the first matching config in the
+	// order they were added. See router for how specificity is decided. Configs
+	// shouldn't be modified once added.
+	CompiledRouting bool
+
+	// Configs is a list of sites that locus will forward for. Once serving, use
+	// AddConfig or Reload to modify, and CurrentConfigs to read.
 	Configs []*Config
 
 	Requests    metrics.Meter
 	Errors      metrics.Meter
+	Retries     metrics.Meter
 	Connections metrics.Counter
 	Latency     metrics.Histogram
 
-	proxy *reverseProxy
+	proxy       *reverseProxy
+	certs       *certStore
+	acme        *autocert.Manager
+	acmeHandler http.Handler
+	admin       *adminSettings
+	clientAuth  tls.ClientAuthType
+	clientCAs   *x509.CertPool
+	configFile  string
+	configMu    sync.RWMutex
+	router      *router
+	servers     []*http.Server
+	shutdown    bool
+	serverMu    sync.Mutex
 }
 
 // New returns an instance of a Locus server with the following defaults set:
 // Port = 5555
 // ReadTimeout = 30s
 // WriteTimeout = 30s
+// DrainTimeout = 30s
+// UpgradeIdleTimeout = 5m
 func New() *Locus {
 	locus := &Locus{
-		Configs:      []*Config{},
-		Port:         5555,
-		ReadTimeout:  time.Second * 30,
-		WriteTimeout: time.Second * 30,
+		Configs:            []*Config{},
+		Port:               5555,
+		ReadTimeout:        time.Second * 30,
+		WriteTimeout:       time.Second * 30,
+		DrainTimeout:       time.Second * 30,
+		UpgradeIdleTimeout: time.Minute * 5,
 
 		proxy:       &reverseProxy{},
+		certs:       &certStore{},
 		Requests:    metrics.NewMeter(),
 		Errors:      metrics.NewMeter(),
+		Retries:     metrics.NewMeter(),
 		Connections: metrics.NewCounter(),
 		Latency:     metrics.NewHistogram(metrics.NewExpDecaySample(1028, 0.015)),
 	}
+	locus.proxy.ErrorLog = locus.elogf
 	return locus
 }
 
+// TrustProxies sets the IPs or CIDR ranges of proxies in front of locus, such
+// as load balancers that terminate TLS. The X-Forwarded-Proto header they send
+// is passed to upstreams. From other clients it is replaced with the protocol
+// of their connection to locus.
+func (locus *Locus) TrustProxies(ips ...string) error {
+	trusted := []*net.IPNet{}
+	for _, s := range ips {
+		ipNet, ok := parseIPNet(s)
+		if !ok {
+			return fmt.Errorf("invalid trusted proxy '%s', should be an IP or CIDR range", s)
+		}
+		trusted = append(trusted, ipNet)
+	}
+	locus.proxy.TrustedProxies = trusted
+	return nil
+}
+
 // FromConfig creates a new locus server from YAML config.
 // See SampleYAMLConfig.
-func FromConfig(data []byte) (*Locus, error) {
+func FromConfig(data []byte) (_ *Locus, err error) {
 	cfgs, globals, err := loadConfigFromYAML(data)
 	if err != nil {
 		return nil, err
 	}
+	defer func() {
+		if err != nil {
+			stopConfigs(cfgs)
+		}
+	}()
 
 	locus := New()
 
 	if globals.Port != 0 {
 		locus.Port = globals.Port
 	}
+	locus.ListenAddrs = globals.Listen
+	for _, l := range globals.Listeners {
+		locus.Listeners = append(locus.Listeners, Listener{
+			Name:         l.Name,
+			Addr:         l.Address,
+			Protocol:     l.Protocol,
+			ReadTimeout:  l.ReadTimeout,
+			WriteTimeout: l.WriteTimeout,
+			IdleTimeout:  l.IdleTimeout,
+		})
+	}
 	if globals.ReadTimeout != 0 {
 		locus.ReadTimeout = globals.ReadTimeout
 	}
 	if globals.WriteTimeout != 0 {
 		locus.WriteTimeout = globals.WriteTimeout
 	}
+	if globals.DrainTimeout != 0 {
+		locus.DrainTimeout = globals.DrainTimeout
+	}
+	if globals.UpgradeIdleTimeout != 0 {
+		locus.UpgradeIdleTimeout = globals.UpgradeIdleTimeout
+	}
+	if err := locus.TrustProxies(globals.TrustedProxies...); err != nil {
+		return nil, err
+	}
+
+	if globals.TLS.Port != 0 {
+		locus.TLSPort = globals.TLS.Port
+	}
+	for _, c := range globals.TLS.Certificates {
+		if err := locus.AddCertificate(c.CertFile, c.KeyFile); err != nil {
+			return nil, err
+		}
+	}
+	if a := globals.TLS.ACME; a != nil {
+		err := locus.EnableACME(ACMEConfig{
+			CacheDir:     a.CacheDir,
+			Email:        a.Email,
+			DirectoryURL: a.DirectoryURL,
+			CAFile:       a.CAFile,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if ca := globals.TLS.ClientAuth; ca != nil {
+		err := locus.EnableClientAuth(ClientAuthConfig{
+			Mode:   ca.Mode,
+			CAFile: ca.CAFile,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := locus.validateListeners(); err != nil {
+		return nil, err
+	}
+	if err := locus.checkConfigListeners(cfgs); err != nil {
+		return nil, err
+	}
+	if a := globals.Admin; a != nil {
+		err := locus.EnableAdmin(AdminConfig{
+			Addr:     a.Address,
+			Username: a.BasicAuth.Username,
+			Password: a.BasicAuth.Password,
+			AllowIPs: a.AllowIPs,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	locus.VerboseLogging = globals.VerboseLogging
+	locus.CompiledRouting = globals.CompiledRouting
 
 	if globals.AccessLog != "" {
 		locus.AccessLog, err = newLogger(globals.AccessLog)
@@ -115,22 +261,73 @@ func FromConfig(data []byte) (*Locus, error) {
 	for _, cfg := range cfgs {
 		locus.AddConfig(cfg)
 	}
+	locus.warnUnreachable(cfgs)
 
 	return locus, nil
 }
 
-// FromConfigFile creates a new locus server from a YAML config file.
+// FromConfigFile creates a new locus server from a YAML config file. The file
+// will be re-read by calls to Reload.
 func FromConfigFile(filename string) (*Locus, error) {
 	data, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
-	return FromConfig(data)
+	locus, err := FromConfig(data)
+	if err != nil {
+		return nil, err
+	}
+	locus.configFile = filename
+	return locus, nil
+}
+
+// Reload re-reads the config file locus was created from, replacing the
+// current configs. If the file is invalid an error is returned and the current
+// configs are left in place. Changes to globals require a restart.
+func (locus *Locus) Reload() error {
+	if locus.configFile == "" {
+		return errors.New("locus wasn't created from a config file")
+	}
+	data, err := ioutil.ReadFile(locus.configFile)
+	if err != nil {
+		return err
+	}
+	return locus.ReloadConfig(data)
+}
+
+// ReloadConfig replaces the current configs with sites from YAML config. In
+// flight requests complete using the configs they were matched against. If the
+// YAML is invalid an error is returned and the current configs are kept.
+func (locus *Locus) ReloadConfig(data []byte) error {
+	cfgs, _, err := loadConfigFromYAML(data)
+	if err != nil {
+		return err
+	}
+	if err := locus.checkConfigListeners(cfgs); err != nil {
+		stopConfigs(cfgs)
+		return err
+	}
+	locus.configMu.Lock()
+	old := locus.Configs
+	locus.Configs = cfgs
+	locus.router = nil
+	locus.configMu.Unlock()
+	stopConfigs(old)
+	locus.elogf("Reloaded %d config(s)", len(cfgs))
+	locus.warnUnreachable(cfgs)
+	return nil
+}
+
+// CurrentConfigs returns the configs currently being used to route requests.
+func (locus *Locus) CurrentConfigs() []*Config {
+	locus.configMu.RLock()
+	defer locus.configMu.RUnlock()
+	return locus.Configs
 }
 
 // NewConfig creates an empty config, registers it, then returns it.
 func (locus *Locus) NewConfig() *Config {
-	cfg := &Config{Name: fmt.Sprintf("cfg%d", len(locus.Configs))}
+	cfg := &Config{Name: fmt.Sprintf("cfg%d", len(locus.CurrentConfigs()))}
 	locus.AddConfig(cfg)
 	return cfg
 }
@@ -139,24 +336,94 @@ func (locus *Locus) NewConfig() *Config {
 // order they were added, the first matching config being used to route the
 // request.
 func (locus *Locus) AddConfig(cfg *Config) {
+	locus.configMu.Lock()
+	defer locus.configMu.Unlock()
 	locus.Configs = append(locus.Configs, cfg)
+	locus.router = nil
 }
 
-// ListenAndServe listens on locus.Port for incoming connections.
+// ListenAndServe starts each of locus.Listeners. If there are none it listens
+// on locus.Port for incoming connections, and if locus.TLSPort is set, on
+// locus.TLSPort for incoming TLS connections, on each of locus.ListenAddrs or
+// all interfaces if there are none. The admin listener is also started, if
+// enabled. It blocks until one of the listeners fails, or Shutdown is called in
+// which case http.ErrServerClosed is returned.
 func (locus *Locus) ListenAndServe() error {
-	s := http.Server{
-		Addr:           fmt.Sprintf(":%d", locus.Port),
-		Handler:        locus,
-		ReadTimeout:    locus.ReadTimeout,
-		WriteTimeout:   locus.WriteTimeout,
-		MaxHeaderBytes: 1 << 20,
-		ErrorLog:       locus.ErrorLog,
-	}
-	locus.elogf("Starting Locus on port %d", locus.Port)
-	return s.ListenAndServe()
+	if len(locus.Listeners) == 0 && locus.TLSPort != 0 && locus.certs.empty() && locus.acme == nil {
+		return errors.New("tls port specified, but no certificates or acme configured")
+	}
+	if err := locus.validateListeners(); err != nil {
+		return err
+	}
+	if err := locus.checkConfigListeners(locus.CurrentConfigs()); err != nil {
+		return err
+	}
+
+	listeners := locus.ResolvedListeners()
+	servers := make([]*http.Server, len(listeners))
+	for i, l := range listeners {
+		servers[i] = locus.newServer(l)
+	}
+	if locus.admin != nil {
+		l := Listener{Name: "admin", Addr: locus.admin.Addr, Protocol: ListenerHTTP}
+		s := locus.newServer(l)
+		s.Handler = locus.AdminHandler()
+		listeners = append(listeners, l)
+		servers = append(servers, s)
+	}
+
+	locus.serverMu.Lock()
+	if locus.shutdown {
+		locus.serverMu.Unlock()
+		return http.ErrServerClosed
+	}
+	locus.servers = append(locus.servers, servers...)
+	locus.serverMu.Unlock()
+
+	errs := make(chan error, len(servers))
+	for i, l := range listeners {
+		go func(l Listener, s *http.Server) {
+			errs <- locus.serve(l, s)
+		}(l, servers[i])
+	}
+	return <-errs
+}
+
+// Shutdown gracefully stops the listeners. New connections are refused, idle
+// and upgraded connections are closed, and in flight requests are given until
+// ctx is done to complete.
+func (locus *Locus) Shutdown(ctx context.Context) error {
+	locus.serverMu.Lock()
+	locus.shutdown = true
+	servers := locus.servers
+	locus.serverMu.Unlock()
+
+	locus.elogf("Shutting down, draining %d active connection(s)", locus.Connections.Count())
+
+	// Upgraded connections, such as WebSockets, are hijacked from the servers so
+	// won't be drained by them.
+	if n := locus.proxy.closeUpgraded(); n > 0 {
+		locus.elogf("Closed %d upgraded connection(s)", n)
+	}
+
+	var firstErr error
+	for _, s := range servers {
+		if err := s.Shutdown(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	stopConfigs(locus.CurrentConfigs())
+	return firstErr
 }
 
 func (locus *Locus) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	// ACME challenges must be answered for the real host, regardless of what
+	// configs are bound.
+	if locus.isACMEChallenge(req) {
+		locus.acmeHandler.ServeHTTP(rw, req)
+		return
+	}
+
 	locus.maybeApplyHostOverride(req)
 
 	locus.Requests.Mark(1)
@@ -169,12 +436,27 @@ func (locus *Locus) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 
 	rrw := &recordingResponseWriter{ResponseWriter: rw}
 
-	c := locus.findConfig(req)
+	c, params := locus.findConfig(req)
+	if params != nil {
+		req = withPathParams(req, params)
+	}
 	if c != nil {
+		if ok, reason := c.ClientCert.allows(req); !ok {
+			locus.elogf("rejecting request for %s: %s", c.Name, reason)
+			locus.renderError(rrw, http.StatusForbidden)
+			locus.logDefaultReq(rrw, req)
+			return
+		}
+
 		// Found matching config so get a request for proxying.
-		proxyreq, err := c.Direct(req)
+		proxyreq, target, err := c.direct(req)
 
-		if err != nil {
+		if err == errNoUpstream {
+			locus.elogf("error transforming request: %v", err)
+			locus.renderError(rrw, http.StatusServiceUnavailable)
+			locus.logDefaultReq(rrw, req)
+			return
+		} else if err != nil {
 			locus.elogf("error transforming request: %v", err)
 			locus.renderError(rrw, http.StatusInternalServerError)
 			locus.logDefaultReq(rrw, req)
@@ -188,7 +470,11 @@ func (locus *Locus) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 			rrw.WriteHeader(c.Redirect)
 
 		} else {
-			if err := locus.proxy.Proxy(rrw, proxyreq); err != nil { // TODO: Render local error page.
+			proxyreq, err = locus.forward(rrw, req, c, proxyreq, target)
+			if err == errNoUpstream {
+				locus.elogf("error proxying request: %v", err)
+				locus.renderError(rrw, http.StatusServiceUnavailable)
+			} else if err != nil { // TODO: Render local error page.
 				locus.elogf("error proxying request: %v", err)
 				locus.renderError(rrw, http.StatusBadGateway)
 			}
@@ -199,13 +485,8 @@ func (locus *Locus) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 			c.Name, rrw.Status(), req.Method, req.Host, req.URL, proxyreq.URL, remoteAddr(req),
 			req.Header.Get("User-Agent"), string(d))
 
-	} else if req.URL.Path == "/debug/configs" {
-		tmpl.ConfigsTemplate.Execute(rw, locus)
-		locus.logDefaultReq(rrw, req)
-
-	} else if req.URL.Path == "/debug/vars" {
-		// In Go1.8 add expvars handler directly. See https://github.com/golang/go/issues/15030
-		http.DefaultServeMux.ServeHTTP(rw, req)
+		// Admin endpoints, such as /debug/configs, are only served by the admin
+		// listener, see EnableAdmin.
 
 		// For legacy healthchecking, render 200 on root path.
 	} else if req.URL.Path == "/" {
@@ -222,13 +503,45 @@ func (locus *Locus) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 func (locus *Locus) RegisterMetrics(m metrics.Registry) {
 	m.Register("requests", locus.Requests)
 	m.Register("errors", locus.Errors)
+	m.Register("retries", locus.Retries)
 	m.Register("conns", locus.Connections)
 	m.Register("latency", locus.Latency)
+	m.Register("breaker_trips", metrics.NewFunctionalGauge(locus.BreakerTrips))
+	m.Register("breakers_open", metrics.NewFunctionalGauge(locus.BreakersOpen))
 
 	exp.Exp(m)
 	go metrics.Log(m, 60*time.Second, locus.ErrorLog)
 }
 
+// BreakerTrips returns the number of times circuit breakers in the current
+// configs have opened.
+func (locus *Locus) BreakerTrips() int64 {
+	var n int64
+	locus.walkBreakers(func(b *upstream.Breaker) { n += b.Trips() })
+	return n
+}
+
+// BreakersOpen returns the number of upstreams in the current configs whose
+// circuit breaker is open.
+func (locus *Locus) BreakersOpen() int64 {
+	var n int64
+	locus.walkBreakers(func(b *upstream.Breaker) { n += int64(b.Open()) })
+	return n
+}
+
+func (locus *Locus) walkBreakers(fn func(*upstream.Breaker)) {
+	for _, c := range locus.CurrentConfigs() {
+		if c.UpstreamProvider == nil {
+			continue
+		}
+		upstream.Walk(c.UpstreamProvider, func(s upstream.Source) {
+			if b, ok := s.(*upstream.Breaker); ok {
+				fn(b)
+			}
+		})
+	}
+}
+
 // RegisterMetricsWithDefaultRegistry registers metrics with the default registry.
 func (locus *Locus) RegisterMetricsWithDefaultRegistry() {
 	locus.RegisterMetrics(metrics.DefaultRegistry)
@@ -246,13 +559,66 @@ func (locus *Locus) maybeApplyHostOverride(req *http.Request) {
 	}
 }
 
-func (locus *Locus) findConfig(req *http.Request) *Config {
-	for _, c := range locus.Configs {
-		if ok, _ := c.Match(req); ok {
-			return c
+// serveReload reloads configs on POST. Since it changes what locus serves, it
+// is refused unless the admin endpoints require basic auth or are restricted to
+// certain IPs.
+func (locus *Locus) serveReload(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		rw.Header().Set("Allow", "POST")
+		locus.renderError(rw, http.StatusMethodNotAllowed)
+		return
+	}
+	if !locus.admin.restricted() {
+		locus.elogf("refusing reload from %s: admin has no basic auth or allowed IPs", req.RemoteAddr)
+		locus.renderError(rw, http.StatusForbidden)
+		return
+	}
+	if err := locus.Reload(); err != nil {
+		locus.elogf("error reloading config: %v", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(rw, "error reloading config: %v\n", err)
+		return
+	}
+	fmt.Fprintf(rw, "reloaded %d config(s)\n", len(locus.CurrentConfigs()))
+}
+
+// findConfig returns the config matching req, and any parameters captured from
+// the path.
+func (locus *Locus) findConfig(req *http.Request) (*Config, map[string]string) {
+	if locus.CompiledRouting {
+		return locus.currentRouter().find(req)
+	}
+	for _, c := range locus.CurrentConfigs() {
+		if ok, _, params := c.match(req); ok {
+			return c, params
 		}
 	}
-	return nil
+	return nil, nil
+}
+
+// currentRouter returns the route table for the current configs, compiling it
+// on first use after configs change.
+func (locus *Locus) currentRouter() *router {
+	locus.configMu.RLock()
+	r := locus.router
+	locus.configMu.RUnlock()
+	if r != nil {
+		return r
+	}
+
+	locus.configMu.Lock()
+	defer locus.configMu.Unlock()
+	if locus.router == nil {
+		locus.router = newRouter(locus.Configs)
+	}
+	return locus.router
+}
+
+// warnUnreachable logs configs that can never be matched.
+func (locus *Locus) warnUnreachable(cfgs []*Config) {
+	for _, w := range unreachableConfigs(cfgs, locus.CompiledRouting) {
+		locus.elogf("warning: %s", w)
+	}
 }
 
 func (locus *Locus) renderError(rw http.ResponseWriter, status int) {
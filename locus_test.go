@@ -1,10 +1,22 @@
 package locus
 
 import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/http/httputil"
 	"net/url"
+	"os"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/dpup/locus/upstream"
 )
 
 func mustParseURL(rawurl string) *url.URL {
@@ -37,3 +49,581 @@ func checkError(t *testing.T, err error, str string) {
 		t.Fatalf("unexpected error: %s: %s", str, err)
 	}
 }
+
+// testSitesYAML is a minimal config, SampleYAMLConfig references files that
+// don't exist in the test environment.
+const testSitesYAML = `
+sites:
+  - name: about_us
+    bind: //us.mysite.com/about
+    upstream: http://about-1.mysite.com
+  - name: search
+    bind: //www.mysite.com/search
+    upstream_set:
+      - http://search-1.mysite.com
+      - http://search-2.mysite.com
+`
+
+func TestReloadConfig(t *testing.T) {
+	locus, err := FromConfig([]byte(testSitesYAML))
+	checkError(t, err, "loading sample config")
+	original := locus.CurrentConfigs()
+
+	err = locus.ReloadConfig([]byte(`
+sites:
+  - name: new_site
+    bind: //new.mysite.com
+    upstream: http://new-1.mysite.com
+`))
+	checkError(t, err, "reloading config")
+
+	cfgs := locus.CurrentConfigs()
+	if len(cfgs) != 1 || cfgs[0].Name != "new_site" {
+		t.Fatalf("Expected configs to be replaced, was %v", cfgs)
+	}
+	if len(original) != 2 {
+		t.Errorf("Expected original snapshot to be untouched, was %v", original)
+	}
+
+	if c, _ := locus.findConfig(mustReq("http://new.mysite.com/")); c == nil || c.Name != "new_site" {
+		t.Errorf("Expected request to match reloaded config, was %v", c)
+	}
+}
+
+func TestReloadInvalidConfigKeepsCurrent(t *testing.T) {
+	locus, err := FromConfig([]byte(testSitesYAML))
+	checkError(t, err, "loading sample config")
+
+	err = locus.ReloadConfig([]byte(`
+sites:
+  - name: broken
+    bind: //broken.mysite.com
+`))
+	if err == nil {
+		t.Fatal("Expected error reloading config without an upstream")
+	}
+	if len(locus.CurrentConfigs()) != 2 {
+		t.Errorf("Expected current configs to be kept, was %v", locus.CurrentConfigs())
+	}
+}
+
+// stoppedSource is a Source that counts how often it has been stopped.
+type stoppedSource struct {
+	upstream.Source
+	stops *int
+}
+
+func (s stoppedSource) Stop() { *s.stops++ }
+
+func TestFailedLoadsStopConfigs(t *testing.T) {
+	stops := 0
+	upstream.Register("^stopped://", func(loc string, _ map[string]string) (upstream.Source, error) {
+		return stoppedSource{upstream.FixedSet("http://" + loc[len("stopped://"):]), &stops}, nil
+	})
+
+	var tests = []struct {
+		load func(data []byte) error
+		yml  string
+	}{
+		// A later site fails to load.
+		{func(data []byte) error { _, _, err := loadConfigFromYAML(data); return err },
+			"sites:\n  - name: a\n    upstream: stopped://a.com\n  - name: b\n    upstream: http://b.com\n    balance: fastest\n"},
+		// Sites load, but aren't valid for the current listeners.
+		{New().ReloadConfig,
+			"sites:\n  - name: a\n    upstream: stopped://a.com\n    listeners: [internal]\n"},
+		// Sites load, but the globals are invalid.
+		{func(data []byte) error { _, err := FromConfig(data); return err },
+			"globals:\n  trusted_proxies: [lb]\nsites:\n  - name: a\n    upstream: stopped://a.com\n"},
+	}
+	for i, tt := range tests {
+		stops = 0
+		if err := tt.load([]byte(tt.yml)); err == nil {
+			t.Errorf("%d: expected error loading config", i)
+		}
+		if stops != 1 {
+			t.Errorf("%d: expected loaded site to be stopped once, was %d", i, stops)
+		}
+	}
+}
+
+func TestReloadFromFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "locus-conf")
+	checkError(t, err, "creating temp file")
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(testSitesYAML)
+	checkError(t, err, "writing config")
+	f.Close()
+
+	locus, err := FromConfigFile(f.Name())
+	checkError(t, err, "loading config file")
+
+	err = ioutil.WriteFile(f.Name(), []byte("sites:\n  - name: one\n    upstream: http://one.com\n"), 0600)
+	checkError(t, err, "rewriting config")
+
+	// Reloads are triggered by POSTs to /debug/reload, on the admin listener,
+	// and only once it is restricted.
+	admin := locus.AdminHandler()
+	rw := httptest.NewRecorder()
+	admin.ServeHTTP(rw, httptest.NewRequest("POST", "http://localhost/debug/reload", nil))
+	if rw.Code != http.StatusForbidden {
+		t.Errorf("Expected reload to be refused on unrestricted admin, was %d", rw.Code)
+	}
+	checkError(t, locus.EnableAdmin(AdminConfig{Addr: "127.0.0.1:0", AllowIPs: []string{"192.0.2.1"}}), "enabling admin")
+
+	rw = httptest.NewRecorder()
+	admin.ServeHTTP(rw, httptest.NewRequest("GET", "http://localhost/debug/reload", nil))
+	if rw.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected GET to be refused, was %d", rw.Code)
+	}
+	if len(locus.CurrentConfigs()) != 2 {
+		t.Fatalf("Expected GET not to reload, was %v", locus.CurrentConfigs())
+	}
+
+	rw = httptest.NewRecorder()
+	admin.ServeHTTP(rw, httptest.NewRequest("POST", "http://localhost/debug/reload", nil))
+	if rw.Code != http.StatusOK {
+		t.Errorf("Expected reload to succeed, was %d: %s", rw.Code, rw.Body)
+	}
+	if cfgs := locus.CurrentConfigs(); len(cfgs) != 1 || cfgs[0].Name != "one" {
+		t.Errorf("Expected configs to be reloaded from file, was %v", cfgs)
+	}
+}
+
+func TestReloadWithoutFile(t *testing.T) {
+	if err := New().Reload(); err == nil {
+		t.Error("Expected error reloading locus not created from a file")
+	}
+}
+
+// freePort returns a port that is available to listen on.
+func freePort(t *testing.T) uint16 {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	checkError(t, err, "finding free port")
+	defer l.Close()
+	return uint16(l.Addr().(*net.TCPAddr).Port)
+}
+
+// waitForListener blocks until addr accepts connections.
+func waitForListener(t *testing.T, addr string) {
+	for i := 0; i < 100; i++ {
+		if c, err := net.Dial("tcp", addr); err == nil {
+			c.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", addr)
+}
+
+func TestShutdownDrainsInFlightRequests(t *testing.T) {
+	received := make(chan bool)
+	release := make(chan bool)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- true
+		<-release
+		w.Write([]byte("done"))
+	}))
+	defer backend.Close()
+
+	locus := New()
+	locus.Port = freePort(t)
+	cfg := locus.NewConfig()
+	cfg.Upstream(upstream.Single(backend.URL))
+
+	serveErr := make(chan error)
+	go func() { serveErr <- locus.ListenAndServe() }()
+	addr := fmt.Sprintf("127.0.0.1:%d", locus.Port)
+	waitForListener(t, addr)
+
+	type result struct {
+		body string
+		err  error
+	}
+	results := make(chan result)
+	go func() {
+		res, err := http.Get("http://" + addr + "/slow")
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer res.Body.Close()
+		b, err := ioutil.ReadAll(res.Body)
+		results <- result{string(b), err}
+	}()
+	<-received
+
+	shutdownErr := make(chan error)
+	go func() { shutdownErr <- locus.Shutdown(context.Background()) }()
+
+	if err := <-serveErr; err != http.ErrServerClosed {
+		t.Errorf("Expected ListenAndServe to return ErrServerClosed, was %v", err)
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Error("Expected new connections to be refused while draining")
+	}
+
+	close(release)
+	if r := <-results; r.err != nil || r.body != "done" {
+		t.Errorf("Expected in flight request to complete, was %q %v", r.body, r.err)
+	}
+	if err := <-shutdownErr; err != nil {
+		t.Errorf("Unexpected error shutting down: %v", err)
+	}
+}
+
+func TestListenAddrs(t *testing.T) {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 loopback not available")
+	}
+	l.Close()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host))
+	}))
+	defer backend.Close()
+
+	locus := New()
+	locus.Port = freePort(t)
+	locus.ListenAddrs = []string{"127.0.0.1", "[::1]"}
+	cfg := locus.NewConfig()
+	cfg.BindHost(fmt.Sprintf("[::1]:%d", locus.Port))
+	cfg.Upstream(upstream.Single(backend.URL))
+	defer locus.Shutdown(context.Background())
+
+	go locus.ListenAndServe()
+	v4 := fmt.Sprintf("127.0.0.1:%d", locus.Port)
+	v6 := fmt.Sprintf("[::1]:%d", locus.Port)
+	waitForListener(t, v4)
+	waitForListener(t, v6)
+
+	res, err := http.Get("http://" + v6 + "/app")
+	checkError(t, err, "requesting over IPv6")
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || string(body) != v6 {
+		t.Errorf("Expected IPv6 host to be proxied, was %d %q", res.StatusCode, body)
+	}
+
+	res, err = http.Get("http://" + v4 + "/app")
+	checkError(t, err, "requesting over IPv4")
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected IPv4 host not to match, was %d", res.StatusCode)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	release := make(chan bool)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	locus := New()
+	locus.Port = freePort(t)
+	cfg := locus.NewConfig()
+	cfg.Upstream(upstream.Single(backend.URL))
+
+	go locus.ListenAndServe()
+	addr := fmt.Sprintf("127.0.0.1:%d", locus.Port)
+	waitForListener(t, addr)
+	go http.Get("http://" + addr + "/stuck")
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := locus.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected drain to time out, was %v", err)
+	}
+}
+
+func TestShutdownBeforeListen(t *testing.T) {
+	locus := New()
+	checkError(t, locus.Shutdown(context.Background()), "shutting down")
+	if err := locus.ListenAndServe(); err != http.ErrServerClosed {
+		t.Errorf("Expected ErrServerClosed after shutdown, was %v", err)
+	}
+}
+
+func TestProxyResultsAreReported(t *testing.T) {
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+	working := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer working.Close()
+
+	locus := New()
+	cfg := locus.NewConfig()
+	cfg.Upstream(upstream.RoundRobin(upstream.EjectOutliers(
+		upstream.FixedSet(broken.URL, working.URL),
+		upstream.OutlierDetection{ConsecutiveFailures: 1},
+	)))
+
+	statuses := []int{}
+	for i := 0; i < 4; i++ {
+		rw := httptest.NewRecorder()
+		locus.ServeHTTP(rw, httptest.NewRequest("GET", "http://test.com/", nil))
+		statuses = append(statuses, rw.Code)
+	}
+
+	expected := []int{http.StatusServiceUnavailable, http.StatusOK, http.StatusOK, http.StatusOK}
+	if !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("Expected broken upstream to be ejected after first failure, statuses were %v", statuses)
+	}
+}
+
+func TestCanceledRequestsDontEjectUpstreams(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer slow.Close()
+
+	locus := New()
+	cfg := locus.NewConfig()
+	od := upstream.EjectOutliers(upstream.FixedSet(slow.URL, "http://other.test.com"),
+		upstream.OutlierDetection{ConsecutiveFailures: 1})
+	cfg.Upstream(upstream.First(od))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	locus.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://test.com/", nil).WithContext(ctx))
+
+	if urls, _ := od.All(); len(urls) != 2 {
+		t.Errorf("Expected upstream not to be ejected after client hung up, was %v", urls)
+	}
+}
+
+func TestOpenBreakersFailFast(t *testing.T) {
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	locus := New()
+	cfg := locus.NewConfig()
+	cfg.Upstream(upstream.First(upstream.CircuitBreaker(
+		upstream.FixedSet(broken.URL),
+		upstream.BreakerSettings{ErrorCount: 2},
+	)))
+
+	statuses := []int{}
+	for i := 0; i < 3; i++ {
+		rw := httptest.NewRecorder()
+		locus.ServeHTTP(rw, httptest.NewRequest("GET", "http://test.com/", nil))
+		statuses = append(statuses, rw.Code)
+	}
+
+	expected := []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusServiceUnavailable}
+	if !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("Expected requests to fail fast once the breaker opened, statuses were %v", statuses)
+	}
+	if locus.BreakerTrips() != 1 || locus.BreakersOpen() != 1 {
+		t.Errorf("Expected 1 trip and 1 open breaker, was %d and %d", locus.BreakerTrips(), locus.BreakersOpen())
+	}
+}
+
+func TestBreakersInSplitGroupsAreCounted(t *testing.T) {
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	locus := New()
+	cfg := locus.NewConfig()
+	cfg.Upstream(upstream.Split(nil, upstream.SplitGroup{
+		Name:    "canary",
+		Percent: 100,
+		Provider: upstream.First(upstream.CircuitBreaker(
+			upstream.FixedSet(broken.URL),
+			upstream.BreakerSettings{ErrorCount: 2},
+		)),
+	}))
+
+	for i := 0; i < 2; i++ {
+		locus.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://test.com/", nil))
+	}
+	if locus.BreakerTrips() != 1 || locus.BreakersOpen() != 1 {
+		t.Errorf("Expected 1 trip and 1 open breaker, was %d and %d", locus.BreakerTrips(), locus.BreakersOpen())
+	}
+}
+
+func TestDebugConfigsPage(t *testing.T) {
+	locus, err := FromConfig([]byte(testSitesYAML))
+	checkError(t, err, "loading config")
+
+	rw := httptest.NewRecorder()
+	locus.AdminHandler().ServeHTTP(rw, httptest.NewRequest("GET", "http://localhost/debug/configs", nil))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected 200, was %d", rw.Code)
+	}
+	for _, s := range []string{"circuit breakers:", "Site:"} {
+		if !strings.Contains(rw.Body.String(), s) {
+			t.Errorf("Expected debug page to contain %q", s)
+		}
+	}
+}
+
+// upgradeBackend switches to an echo protocol when asked to upgrade to proto.
+func upgradeBackend(t *testing.T, proto string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" || !strings.EqualFold(r.Header.Get("Connection"), "upgrade") {
+			t.Errorf("Expected upgrade headers to reach upstream, were %v", r.Header)
+		}
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("Hijack failed: %v", err)
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: " + proto + "\r\n\r\n")
+		brw.Flush()
+		for {
+			line, err := brw.ReadString('\n')
+			if err != nil {
+				return
+			}
+			brw.WriteString("echo: " + line)
+			brw.Flush()
+		}
+	}))
+}
+
+// dialUpgrade sends an upgrade request to addr, returning the connection and the
+// response.
+func dialUpgrade(t *testing.T, addr string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", addr)
+	checkError(t, err, "dialing locus")
+	fmt.Fprintf(conn, "GET /live HTTP/1.1\r\nHost: test.com\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	checkError(t, err, "reading upgrade response")
+	return conn, br, res
+}
+
+func TestUpgradeProxying(t *testing.T) {
+	backend := upgradeBackend(t, "echo")
+	defer backend.Close()
+
+	locus := New()
+	cfg := locus.NewConfig()
+	cfg.Upstream(upstream.Single(backend.URL))
+	server := httptest.NewServer(locus)
+	defer server.Close()
+
+	conn, br, res := dialUpgrade(t, server.Listener.Addr().String())
+	defer conn.Close()
+	if res.StatusCode != http.StatusSwitchingProtocols || res.Header.Get("Upgrade") != "echo" {
+		t.Fatalf("Expected 101 switching to echo, was %d %v", res.StatusCode, res.Header)
+	}
+
+	for _, msg := range []string{"hello\n", "world\n"} {
+		fmt.Fprint(conn, msg)
+		line, err := br.ReadString('\n')
+		checkError(t, err, "reading echo")
+		if line != "echo: "+msg {
+			t.Errorf("Expected %q, was %q", "echo: "+msg, line)
+		}
+	}
+}
+
+func TestUpgradeIdleTimeout(t *testing.T) {
+	backend := upgradeBackend(t, "echo")
+	defer backend.Close()
+
+	locus := New()
+	locus.UpgradeIdleTimeout = 50 * time.Millisecond
+	cfg := locus.NewConfig()
+	cfg.Upstream(upstream.Single(backend.URL))
+	server := httptest.NewServer(locus)
+	defer server.Close()
+
+	conn, br, _ := dialUpgrade(t, server.Listener.Addr().String())
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := br.ReadString('\n'); err == nil || strings.Contains(err.Error(), "timeout") {
+		t.Errorf("Expected idle connection to be closed by locus, was %v", err)
+	}
+}
+
+func TestShutdownClosesUpgradedConnections(t *testing.T) {
+	backend := upgradeBackend(t, "echo")
+	defer backend.Close()
+
+	locus := New()
+	locus.UpgradeIdleTimeout = 0
+	cfg := locus.NewConfig()
+	cfg.Upstream(upstream.Single(backend.URL))
+	server := httptest.NewServer(locus)
+	defer server.Close()
+
+	conn, br, res := dialUpgrade(t, server.Listener.Addr().String())
+	defer conn.Close()
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected 101, was %d", res.StatusCode)
+	}
+	checkError(t, locus.Shutdown(context.Background()), "shutting down")
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := br.ReadString('\n'); err == nil || strings.Contains(err.Error(), "timeout") {
+		t.Errorf("Expected upgraded connection to be closed on shutdown, was %v", err)
+	}
+}
+
+func TestUpgradeProtocolMismatch(t *testing.T) {
+	backend := upgradeBackend(t, "other")
+	defer backend.Close()
+
+	locus := New()
+	cfg := locus.NewConfig()
+	cfg.Upstream(upstream.Single(backend.URL))
+	server := httptest.NewServer(locus)
+	defer server.Close()
+
+	conn, _, res := dialUpgrade(t, server.Listener.Addr().String())
+	defer conn.Close()
+	if res.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected 502 when upstream switches to the wrong protocol, was %d", res.StatusCode)
+	}
+}
+
+func TestPathTemplateProxying(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer backend.Close()
+
+	locus := New()
+	cfg := locus.NewConfig()
+	checkError(t, cfg.BindPathTemplate("/users/{id}/avatar"), "binding template")
+	cfg.Upstream(upstream.Single(backend.URL + "/avatars/{id}.png"))
+
+	rw := httptest.NewRecorder()
+	locus.ServeHTTP(rw, httptest.NewRequest("GET", "http://test.com/users/123/avatar", nil))
+	if rw.Code != http.StatusOK || rw.Body.String() != "/avatars/123.png" {
+		t.Errorf("Expected rewritten path, was %d %q", rw.Code, rw.Body.String())
+	}
+
+	rw = httptest.NewRecorder()
+	locus.ServeHTTP(rw, httptest.NewRequest("GET", "http://test.com/users/123/profile", nil))
+	if rw.Code != http.StatusNotFound {
+		t.Errorf("Expected unmatched path to 404, was %d", rw.Code)
+	}
+}
+
+func TestTrustProxiesErrors(t *testing.T) {
+	locus := New()
+	expected := "invalid trusted proxy 'lb.internal', should be an IP or CIDR range"
+	if err := locus.TrustProxies("10.0.0.0/8", "lb.internal"); err == nil || err.Error() != expected {
+		t.Errorf("Expected error %q, was %v", expected, err)
+	}
+	checkError(t, locus.TrustProxies("10.0.0.0/8", "::1"), "trusting proxies")
+	if len(locus.proxy.TrustedProxies) != 2 {
+		t.Errorf("Expected 2 trusted proxies, was %v", locus.proxy.TrustedProxies)
+	}
+}
@@ -1,19 +1,117 @@
 package locus
 
 import (
+	"fmt"
+	"net"
 	"net/http"
 	"net/url"
+	"regexp"
 	"strings"
 )
 
 // Matcher is used to match incoming requests
 type Matcher struct {
-	host     string
-	port     string
-	wild     bool
+	hosts    []hostPattern
 	path     string
+	pathMode pathMode
+	pathRe   *regexp.Regexp
 	hasQuery bool
 	query    url.Values
+	methods  []string
+	headers  []valueRule
+	cookies  []valueRule
+}
+
+// hostPattern is a host and optional port that a Matcher binds to. Hosts
+// starting with "." match any subdomain, hosts containing "*" are globs where
+// "*" matches characters within a single label.
+type hostPattern struct {
+	host string
+	port string
+	wild bool
+	glob *regexp.Regexp
+}
+
+func parseHostPattern(hostPort string) hostPattern {
+	p := hostPattern{}
+	p.host, p.port = splitHost(hostPort)
+	if strings.Contains(p.host, "*") {
+		labels := strings.Split(p.host, ".")
+		for i, l := range labels {
+			if l == "*" {
+				labels[i] = `[^.]+`
+			} else {
+				labels[i] = strings.Replace(regexp.QuoteMeta(l), `\*`, `[^.]*`, -1)
+			}
+		}
+		p.glob = regexp.MustCompile("^" + strings.Join(labels, `\.`) + "$")
+	} else if p.host != "" && p.host[:1] == "." {
+		p.wild = true
+	}
+	return p
+}
+
+func (p hostPattern) String() string {
+	if p.port != "" {
+		return net.JoinHostPort(p.host, p.port)
+	} else if strings.Contains(p.host, ":") {
+		return "[" + p.host + "]"
+	}
+	return p.host
+}
+
+// pathMode specifies how a Matcher's path is compared to the request path.
+type pathMode int
+
+const (
+	// pathStringPrefix is the default, a plain string prefix, so "/api" also
+	// matches "/apiary".
+	pathStringPrefix pathMode = iota
+	pathSegmentPrefix
+	pathExact
+	pathRegexp
+	pathTemplate
+)
+
+var pathModeNames = map[pathMode]string{
+	pathSegmentPrefix: "prefix",
+	pathExact:         "exact",
+	pathRegexp:        "regex",
+	pathTemplate:      "template",
+}
+
+// templateParam matches parameters in path templates, such as {id} or {path*}.
+var templateParam = regexp.MustCompile(`\{(\w+)(\*?)\}`)
+
+// valueRule matches the values of a named header or cookie. A rule with
+// neither a value nor a regexp only requires the header or cookie be present.
+type valueRule struct {
+	name  string
+	value string
+	re    *regexp.Regexp
+}
+
+// match returns true if any of the values satisfy the rule.
+func (r valueRule) match(values []string) bool {
+	for _, v := range values {
+		if r.re != nil {
+			if r.re.MatchString(v) {
+				return true
+			}
+		} else if r.value == "" || v == r.value {
+			return true
+		}
+	}
+	return false
+}
+
+func (r valueRule) String() string {
+	if r.re != nil {
+		return r.name + "~" + r.re.String()
+	} else if r.value == "" {
+		return r.name
+	}
+	return r.name + "=" + r.value
 }
 
 // NewMatcher constructs a matcher from a hostPort and requestURI.
@@ -26,22 +124,35 @@ func NewMatcher(hostPort string, requestURI string) *Matcher {
 
 // BindHost sets which host and port to match on, if either host or port are
 // blank then they will match any value.
-// Example inputs include: "www.test.com", "test.com:5000", ":80".
+// Example inputs include: "www.test.com", "test.com:5000", ":80", "[::1]:5000".
 func (um *Matcher) BindHost(hostPort string) (string, string) {
-	um.host, um.port = splitHost(hostPort)
-
-	// If host starts with "." it's a wildcard match.
-	if um.host != "" && um.host[:1] == "." {
-		um.wild = true
+	p := parseHostPattern(hostPort)
+	if p.host == "" && p.port == "" {
+		um.hosts = nil
 	} else {
-		um.wild = false
+		um.hosts = []hostPattern{p}
+	}
+	return p.host, p.port
+}
+
+// BindHosts sets several hosts, each with an optional port, replacing any
+// bound previously. Requests matching any one of them are matched. As well as
+// exact hosts and ".mysite.com" style wildcards, hosts may be globs such as
+// "*.eu.mysite.com" or "api-*.mysite.com", where "*" matches within a single
+// label.
+func (um *Matcher) BindHosts(hostPorts ...string) {
+	um.hosts = nil
+	for _, hp := range hostPorts {
+		if hp != "" {
+			um.hosts = append(um.hosts, parseHostPattern(hp))
+		}
 	}
-	return um.host, um.port
 }
 
 // BindLocation sets the path and query (request URI) portion that should be
 // matched. Path will prefix match, all query params will be matched.
 func (um *Matcher) BindLocation(requestURI string) (string, url.Values) {
+	um.pathMode, um.pathRe = pathStringPrefix, nil
 	if requestURI == "" {
 		um.path = ""
 		um.query = nil
@@ -70,62 +181,242 @@ func (um *Matcher) BindLocation(requestURI string) (string, url.Values) {
 	return um.path, um.query
 }
 
-func (um Matcher) String() string {
-	str := ""
-	if um.host != "" {
-		str += um.host
+// BindPathExact matches requests whose path is exactly path. Any query
+// previously bound is kept.
+func (um *Matcher) BindPathExact(path string) {
+	um.path, um.pathMode, um.pathRe = path, pathExact, nil
+}
+
+// BindPathPrefix matches requests whose path starts with the given segments.
+// Unlike BindLocation, "/api" matches "/api" and "/api/users" but not
+// "/apiary".
+func (um *Matcher) BindPathPrefix(prefix string) {
+	um.path, um.pathMode, um.pathRe = prefix, pathSegmentPrefix, nil
+}
+
+// BindPathRegexp matches requests whose path matches pattern, which must match
+// the whole path. Named groups, such as (?P<id>[0-9]+), are captured and can be
+// used in upstream paths, see PathParams.
+func (um *Matcher) BindPathRegexp(pattern string) error {
+	re, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid path regexp '%s': %s", pattern, err)
+	}
+	um.path, um.pathMode, um.pathRe = pattern, pathRegexp, re
+	return nil
+}
+
+// BindPathTemplate matches requests whose path fits a template such as
+// "/users/{id}/avatar". A parameter {name} matches a single path segment,
+// {name*} matches the rest of the path. Parameters are captured and can be used
+// in upstream paths, see PathParams.
+func (um *Matcher) BindPathTemplate(template string) error {
+	expr := "^"
+	names := map[string]bool{}
+	last := 0
+	for _, m := range templateParam.FindAllStringSubmatchIndex(template, -1) {
+		literal := template[last:m[0]]
+		if strings.ContainsAny(literal, "{}") {
+			break
+		}
+		name := template[m[2]:m[3]]
+		if names[name] {
+			return fmt.Errorf("invalid path template '%s', duplicate parameter '%s'", template, name)
+		}
+		names[name] = true
+		expr += regexp.QuoteMeta(literal)
+		if m[5] > m[4] {
+			expr += "(?P<" + name + ">.*)"
+		} else {
+			expr += "(?P<" + name + ">[^/]+)"
+		}
+		last = m[1]
+	}
+	if strings.ContainsAny(template[last:], "{}") {
+		return fmt.Errorf("invalid path template '%s', parameters should look like {name} or {name*}", template)
+	}
+	expr += regexp.QuoteMeta(template[last:]) + "$"
+
+	um.path, um.pathMode, um.pathRe = template, pathTemplate, regexp.MustCompile(expr)
+	return nil
+}
+
+// BindMethod restricts matching to requests using one of the given methods.
+func (um *Matcher) BindMethod(methods ...string) {
+	for _, m := range methods {
+		um.methods = append(um.methods, strings.ToUpper(m))
+	}
+}
+
+// BindHeader requires a request header to have the given value, if the header
+// is repeated any of its values may match. An empty value only requires that
+// the header is present.
+func (um *Matcher) BindHeader(key, value string) {
+	um.headers = append(um.headers, valueRule{name: http.CanonicalHeaderKey(key), value: value})
+}
+
+// BindHeaderRegexp requires a value of a request header to match pattern. The
+// pattern is unanchored, use ^ and $ to match the whole value.
+func (um *Matcher) BindHeaderRegexp(key, pattern string) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid regexp for header '%s': %s", key, err)
+	}
+	um.headers = append(um.headers, valueRule{name: http.CanonicalHeaderKey(key), re: re})
+	return nil
+}
+
+// BindCookie requires a request cookie to have the given value. An empty value
+// only requires that the cookie is present.
+func (um *Matcher) BindCookie(name, value string) {
+	um.cookies = append(um.cookies, valueRule{name: name, value: value})
+}
+
+// BindCookieRegexp requires the value of a request cookie to match pattern.
+// The pattern is unanchored, use ^ and $ to match the whole value.
+func (um *Matcher) BindCookieRegexp(name, pattern string) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid regexp for cookie '%s': %s", name, err)
 	}
-	if um.port != "" {
-		str += ":" + um.port
+	um.cookies = append(um.cookies, valueRule{name: name, re: re})
+	return nil
+}
+
+func (um Matcher) String() string {
+	hosts := make([]string, len(um.hosts))
+	for i, p := range um.hosts {
+		hosts[i] = p.String()
 	}
+	str := strings.Join(hosts, ",")
 	if um.path != "" {
 		str += um.path
 	}
 	if um.hasQuery {
 		str += um.query.Encode()
 	}
+	if name, ok := pathModeNames[um.pathMode]; ok {
+		str += " (" + name + ")"
+	}
+	if len(um.methods) > 0 {
+		str += " method " + strings.Join(um.methods, "|")
+	}
+	for _, h := range um.headers {
+		str += " header " + h.String()
+	}
+	for _, c := range um.cookies {
+		str += " cookie " + c.String()
+	}
 	return str
 }
 
 // Match returns true if an inbound request satisfies all the requirements of
 // the matcher.
 func (um *Matcher) Match(req *http.Request) (bool, string) {
+	ok, reason, _ := um.match(req)
+	return ok, reason
+}
+
+// match is Match but also returns the parameters captured from the path.
+func (um *Matcher) match(req *http.Request) (bool, string, map[string]string) {
 	// Per RFC 2616 most request URLs will only include path+query. For purpose of
 	// matching we rely on the host header.
 	host, port := splitHost(req.Host)
 
 	// TODO(dan): should this fallback on req.URI.Host?
 
-	if um.host != "" && !um.matchHost(host) {
-		return false, "host mismatch"
-	}
-	if um.port != "" && !um.matchPort(port, req.URL.Scheme) {
-		return false, "port mismatch"
+	if len(um.hosts) > 0 {
+		if ok, reason := um.matchHosts(host, port, req.URL.Scheme); !ok {
+			return false, reason, nil
+		}
 	}
-	if um.path != "" && !strings.HasPrefix(req.URL.Path, um.path) {
-		return false, "path prefix mismatch"
+	var params map[string]string
+	if um.path != "" {
+		var ok bool
+		if ok, params = um.matchPath(req.URL.Path); !ok {
+			if um.pathMode == pathStringPrefix {
+				return false, "path prefix mismatch", nil
+			}
+			return false, "path mismatch", nil
+		}
 	}
 	if um.hasQuery && !um.matchQuery(req.URL) {
-		return false, "query mismatch"
+		return false, "query mismatch", nil
 	}
-	return true, "match"
+	if len(um.methods) > 0 && !um.matchMethod(req.Method) {
+		return false, "method mismatch", nil
+	}
+	for _, h := range um.headers {
+		if !h.match(req.Header[h.name]) {
+			return false, "header mismatch", nil
+		}
+	}
+	if len(um.cookies) > 0 && !um.matchCookies(req) {
+		return false, "cookie mismatch", nil
+	}
+	return true, "match", params
 }
 
-func (um *Matcher) matchHost(host string) bool {
-	if um.wild {
-		return strings.HasSuffix(host, um.host)
+// matchPath returns true if path satisfies the matcher, along with any named
+// parameters captured by a regexp or template.
+func (um *Matcher) matchPath(path string) (bool, map[string]string) {
+	switch um.pathMode {
+	case pathExact:
+		return path == um.path, nil
+	case pathSegmentPrefix:
+		return hasPathPrefix(path, um.path), nil
+	case pathRegexp, pathTemplate:
+		m := um.pathRe.FindStringSubmatch(path)
+		if m == nil {
+			return false, nil
+		}
+		params := map[string]string{}
+		for i, name := range um.pathRe.SubexpNames() {
+			if name != "" {
+				params[name] = m[i]
+			}
+		}
+		return true, params
 	}
-	return host == um.host
+	return strings.HasPrefix(path, um.path), nil
 }
 
-func (um *Matcher) matchPort(port string, scheme string) bool {
-	if um.port == port {
-		// Direct match.
+// matchHosts returns true if any of the bound hosts match, otherwise a reason
+// for the mismatch.
+func (um *Matcher) matchHosts(host, port, scheme string) (bool, string) {
+	reason := "host mismatch"
+	for _, p := range um.hosts {
+		if !p.matchHost(host) {
+			continue
+		}
+		if p.matchPort(port, scheme) {
+			return true, ""
+		}
+		reason = "port mismatch"
+	}
+	return false, reason
+}
+
+func (p hostPattern) matchHost(host string) bool {
+	switch {
+	case p.host == "":
 		return true
-	} else if um.port == "80" && port == "" && scheme == "http" {
+	case p.glob != nil:
+		return p.glob.MatchString(host)
+	case p.wild:
+		return strings.HasSuffix(host, p.host)
+	}
+	return host == p.host
+}
+
+func (p hostPattern) matchPort(port string, scheme string) bool {
+	if p.port == "" || p.port == port {
+		// Any port, or direct match.
+		return true
+	} else if p.port == "80" && port == "" && scheme == "http" {
 		// For fully formed req URLs, allow http to imply port 80.
 		return true
-	} else if um.port == "443" && port == "" && scheme == "https" {
+	} else if p.port == "443" && port == "" && scheme == "https" {
 		// For fully formed req URLs, allow https to imply port 443.
 		return true
 	}
@@ -142,11 +433,45 @@ func (um *Matcher) matchQuery(u *url.URL) bool {
 	return true
 }
 
+func (um *Matcher) matchMethod(method string) bool {
+	for _, m := range um.methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+func (um *Matcher) matchCookies(req *http.Request) bool {
+	values := map[string][]string{}
+	for _, c := range req.Cookies() {
+		values[c.Name] = append(values[c.Name], c.Value)
+	}
+	for _, c := range um.cookies {
+		if !c.match(values[c.name]) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasPathPrefix returns true if path starts with the segments in prefix.
+func hasPathPrefix(path, prefix string) bool {
+	if strings.HasSuffix(prefix, "/") {
+		return strings.HasPrefix(path, prefix)
+	}
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// splitHost splits a host and optional port. IPv6 literals may be bracketed,
+// as in "[::1]:5555" or "[::1]", or bare, as in "::1", in which case there is
+// no port. The brackets are removed from the returned host.
 func splitHost(hostPort string) (host, port string) {
-	parts := strings.Split(hostPort, ":")
-	host = parts[0]
-	if len(parts) == 2 {
-		port = parts[1]
+	if h, p, err := net.SplitHostPort(hostPort); err == nil {
+		return h, p
+	}
+	if strings.HasPrefix(hostPort, "[") && strings.HasSuffix(hostPort, "]") {
+		return hostPort[1 : len(hostPort)-1], ""
 	}
-	return
+	return hostPort, ""
 }
@@ -1,6 +1,8 @@
 package locus
 
 import (
+	"net/http"
+	"reflect"
 	"testing"
 )
 
@@ -75,6 +77,15 @@ func TestUrlMatcher(t *testing.T) {
 		{"", "?lang=en&country=us", "http://test.com/?lang=en", false},
 		{"", "?lang=en&country=us", "http://test.com/?country=us", false},
 
+		// IPv6 literals, with and without a port.
+		{"[::1]:5555", "", "http://[::1]:5555/foo", true},
+		{"[::1]:5555", "", "http://[::1]:5000/foo", false},
+		{"[::1]", "", "http://[::1]:5555/foo", true},
+		{"::1", "", "http://[::1]/foo", true},
+		{"[2001:db8::1]", "", "http://[::1]/foo", false},
+		{":5555", "", "http://[2001:db8::1]:5555/foo", true},
+		{"[::1]:80", "", "http://[::1]/foo", true},
+
 		// Incoming URLs without '//' are hostless, test.com is actually the path.
 		{"test.com", "", "test.com", false},
 	}
@@ -107,3 +118,183 @@ func TestHostless(t *testing.T) {
 		t.Errorf("Didn't expected a match")
 	}
 }
+
+func TestSplitHost(t *testing.T) {
+	var tests = []struct {
+		hostPort string
+		host     string
+		port     string
+	}{
+		{"test.com", "test.com", ""},
+		{"test.com:5000", "test.com", "5000"},
+		{":80", "", "80"},
+		{"", "", ""},
+		{"[::1]:5555", "::1", "5555"},
+		{"[::1]", "::1", ""},
+		{"::1", "::1", ""},
+		{"2001:db8::1", "2001:db8::1", ""},
+		{"[fe80::1%en0]:443", "fe80::1%en0", "443"},
+	}
+	for _, tt := range tests {
+		if host, port := splitHost(tt.hostPort); host != tt.host || port != tt.port {
+			t.Errorf("splitHost(%q) => (%q, %q), want (%q, %q)", tt.hostPort, host, port, tt.host, tt.port)
+		}
+	}
+
+	if s := NewMatcher("[::1]:5555", "/foo").String(); s != "[::1]:5555/foo" {
+		t.Errorf("Unexpected String(), was %q", s)
+	}
+	if s := NewMatcher("::1", "").String(); s != "[::1]" {
+		t.Errorf("Unexpected String(), was %q", s)
+	}
+}
+
+func TestHostPatterns(t *testing.T) {
+	um := &Matcher{}
+	um.BindHosts("test.com", "www.test.com:8080", "api-*.test.com", "*.eu.test.com")
+
+	var tests = []struct {
+		requrl   string
+		expected string
+	}{
+		{"http://test.com/", "match"},
+		{"http://www.test.com:8080/", "match"},
+		{"http://www.test.com/", "port mismatch"},
+		{"http://api-v1.test.com/", "match"},
+		{"http://api-.test.com/", "match"},
+		{"http://api.test.com/", "host mismatch"},
+		{"http://api-v1.staging.test.com/", "host mismatch"},
+		{"http://de.eu.test.com/", "match"},
+		{"http://eu.test.com/", "host mismatch"},
+		{"http://fr.de.eu.test.com/", "host mismatch"},
+		{"http://other.com/", "host mismatch"},
+	}
+	for _, tt := range tests {
+		if _, reason := um.Match(mustReq(tt.requrl)); reason != tt.expected {
+			t.Errorf("matching '%s' against '%s' => %s, want %s", tt.requrl, um, reason, tt.expected)
+		}
+	}
+
+	expected := "test.com,www.test.com:8080,api-*.test.com,*.eu.test.com"
+	if um.String() != expected {
+		t.Errorf("Unexpected String(), was %q", um.String())
+	}
+
+	// Binding a single host replaces the aliases.
+	um.BindHost("other.com")
+	if ok, _ := um.Match(mustReq("http://test.com/")); ok {
+		t.Errorf("Expected aliases to be replaced")
+	}
+}
+
+func TestRequestMatcher(t *testing.T) {
+	um := NewMatcher("api.test.com", "/v2")
+	um.BindMethod("get", "POST")
+	um.BindHeader("accept", "application/json")
+	um.BindHeader("X-Debug", "")
+	checkError(t, um.BindHeaderRegexp("User-Agent", "^Mozilla/.*Mobile"), "binding regexp")
+	um.BindCookie("beta", "")
+	checkError(t, um.BindCookieRegexp("lang", "^en"), "binding regexp")
+
+	var tests = []struct {
+		method   string
+		header   http.Header
+		expected string
+	}{
+		{"GET", nil, "match"},
+		{"POST", nil, "match"},
+		{"PUT", nil, "method mismatch"},
+		{"GET", http.Header{"Accept": {"text/html"}}, "header mismatch"},
+		{"GET", http.Header{"Accept": {"text/html", "application/json"}}, "match"},
+		{"GET", http.Header{"X-Debug": nil}, "header mismatch"},
+		{"GET", http.Header{"User-Agent": {"Mozilla/5.0 (Windows NT 10.0)"}}, "header mismatch"},
+		{"GET", http.Header{"Cookie": {"beta=; lang=en"}}, "match"},
+		{"GET", http.Header{"Cookie": {"beta=1; lang=fr"}}, "cookie mismatch"},
+		{"GET", http.Header{"Cookie": {"lang=en"}}, "cookie mismatch"},
+	}
+
+	for i, tt := range tests {
+		req := mustReq("http://api.test.com/v2/users")
+		req.Method = tt.method
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("X-Debug", "1")
+		req.Header.Set("User-Agent", "Mozilla/5.0 (iPhone) Mobile/15E148")
+		req.Header.Set("Cookie", "beta=1; lang=en-GB")
+		for k, v := range tt.header {
+			req.Header[k] = v
+		}
+		if _, reason := um.Match(req); reason != tt.expected {
+			t.Errorf("Test %d: expected %s, was %s", i, tt.expected, reason)
+		}
+	}
+
+	expected := "api.test.com/v2 method GET|POST header Accept=application/json header X-Debug header User-Agent~^Mozilla/.*Mobile cookie beta cookie lang~^en"
+	if um.String() != expected {
+		t.Errorf("Unexpected String(), was %q", um.String())
+	}
+}
+
+func TestPathMatching(t *testing.T) {
+	var tests = []struct {
+		bind     func(*Matcher) error
+		path     string
+		expected bool
+		params   map[string]string
+	}{
+		{bindPath((*Matcher).BindPathExact, "/api"), "/api", true, nil},
+		{bindPath((*Matcher).BindPathExact, "/api"), "/api/", false, nil},
+		{bindPath((*Matcher).BindPathExact, "/api"), "/api/users", false, nil},
+
+		{bindPath((*Matcher).BindPathPrefix, "/api"), "/api", true, nil},
+		{bindPath((*Matcher).BindPathPrefix, "/api"), "/api/users", true, nil},
+		{bindPath((*Matcher).BindPathPrefix, "/api"), "/apiary", false, nil},
+		{bindPath((*Matcher).BindPathPrefix, "/api/"), "/api/users", true, nil},
+		{bindPath((*Matcher).BindPathPrefix, "/api/"), "/api", false, nil},
+
+		{bindPattern((*Matcher).BindPathRegexp, `/v[12]/.*`), "/v1/users", true, map[string]string{}},
+		{bindPattern((*Matcher).BindPathRegexp, `/v[12]/.*`), "/api/v1/users", false, nil},
+		{bindPattern((*Matcher).BindPathRegexp, `/users/(?P<id>[0-9]+)`), "/users/123", true, map[string]string{"id": "123"}},
+		{bindPattern((*Matcher).BindPathRegexp, `/users/(?P<id>[0-9]+)`), "/users/bob", false, nil},
+		{bindPattern((*Matcher).BindPathRegexp, `/users/(?P<id>[0-9]+)`), "/users/123/avatar", false, nil},
+
+		{bindPattern((*Matcher).BindPathTemplate, "/users/{id}/avatar"), "/users/123/avatar", true, map[string]string{"id": "123"}},
+		{bindPattern((*Matcher).BindPathTemplate, "/users/{id}/avatar"), "/users/1/2/avatar", false, nil},
+		{bindPattern((*Matcher).BindPathTemplate, "/users/{id}/avatar"), "/users//avatar", false, nil},
+		{bindPattern((*Matcher).BindPathTemplate, "/users/{id}.{format}"), "/users/123.json", true, map[string]string{"id": "123", "format": "json"}},
+		{bindPattern((*Matcher).BindPathTemplate, "/static/{file*}"), "/static/css/site.css", true, map[string]string{"file": "css/site.css"}},
+		{bindPattern((*Matcher).BindPathTemplate, "/static/{file*}"), "/static.css", false, nil},
+	}
+
+	for i, tt := range tests {
+		um := &Matcher{}
+		checkError(t, tt.bind(um), "binding path")
+		ok, reason, params := um.match(mustReq("http://test.com" + tt.path))
+		if ok != tt.expected {
+			t.Errorf("Test %d: matching %s against %s => %v, want %v (%s)", i, tt.path, um, ok, tt.expected, reason)
+		} else if ok && !reflect.DeepEqual(params, tt.params) {
+			t.Errorf("Test %d: matching %s against %s captured %v, want %v", i, tt.path, um, params, tt.params)
+		}
+	}
+}
+
+func TestPathTemplateErrors(t *testing.T) {
+	for _, tmpl := range []string{"/users/{id", "/users/id}", "/users/{}", "/users/{a-b}", "/{id}/{id}"} {
+		um := &Matcher{}
+		if err := um.BindPathTemplate(tmpl); err == nil {
+			t.Errorf("Expected error binding template %q", tmpl)
+		}
+	}
+}
+
+func bindPath(fn func(*Matcher, string), path string) func(*Matcher) error {
+	return func(um *Matcher) error {
+		fn(um, path)
+		return nil
+	}
+}
+
+func bindPattern(fn func(*Matcher, string) error, pattern string) func(*Matcher) error {
+	return func(um *Matcher) error {
+		return fn(um, pattern)
+	}
+}
@@ -1,6 +1,9 @@
 package locus
 
 import (
+	"bufio"
+	"fmt"
+	"net"
 	"net/http"
 )
 
@@ -21,3 +24,18 @@ func (rw *recordingResponseWriter) Status() int {
 	}
 	return rw.status
 }
+
+// Hijack lets protocol upgrades, such as WebSockets, take over the connection.
+// Locus only hijacks connections once an upstream has switched protocols, so
+// the status is recorded as 101.
+func (rw *recordingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T doesn't support hijacking", rw.ResponseWriter)
+	}
+	conn, brw, err := hj.Hijack()
+	if err == nil {
+		rw.status = http.StatusSwitchingProtocols
+	}
+	return conn, brw, err
+}
@@ -0,0 +1,286 @@
+package locus
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/dpup/locus/upstream"
+)
+
+// Conditions that a RetryPolicy can retry on, in addition to 5xx status codes.
+const (
+	// RetryOnConnectError retries when a connection to the upstream couldn't be
+	// established, so the upstream never saw the request.
+	RetryOnConnectError = "connect_error"
+
+	// RetryOnTimeout retries when an attempt exceeds the PerTryTimeout.
+	RetryOnTimeout = "timeout"
+)
+
+// DefaultRetryOn is used when a RetryPolicy doesn't specify any conditions.
+var DefaultRetryOn = []string{RetryOnConnectError, RetryOnTimeout, "502", "503", "504"}
+
+// idempotentMethods are safe to resend, RFC 7231 section 4.2.2.
+var idempotentMethods = map[string]bool{
+	"GET":     true,
+	"HEAD":    true,
+	"OPTIONS": true,
+	"TRACE":   true,
+	"PUT":     true,
+	"DELETE":  true,
+}
+
+// RetryPolicy specifies when a failed request should be resent to a different
+// upstream.
+//
+// Requests using idempotent methods are retried, as long as any body could be
+// buffered. Other methods, such as POST, are only retried if their body was
+// buffered, so BufferBody must be set and the body must fit. They are never
+// retried without a body.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times a request is sent, including
+	// the first. Zero or one disables retries.
+	MaxAttempts int
+
+	// RetryOn lists the conditions that trigger a retry, "connect_error",
+	// "timeout" or a 5xx status code. Defaults to DefaultRetryOn.
+	RetryOn []string
+
+	// PerTryTimeout limits how long each attempt waits for response headers from
+	// the upstream. Zero means no limit.
+	PerTryTimeout time.Duration
+
+	// BufferBody is the size, in bytes, of the largest request body that will be
+	// held in memory so that it can be resent. Zero means requests with a body
+	// are never retried.
+	BufferBody int64
+}
+
+// Validate returns an error if any of the policy's conditions are unknown.
+func (rp RetryPolicy) Validate() error {
+	if rp.MaxAttempts < 0 {
+		return fmt.Errorf("invalid max attempts %d, should not be negative", rp.MaxAttempts)
+	}
+	for _, cond := range rp.RetryOn {
+		if cond == RetryOnConnectError || cond == RetryOnTimeout {
+			continue
+		}
+		if code, err := strconv.Atoi(cond); err != nil || code < 500 || code > 599 {
+			return fmt.Errorf("invalid retry condition '%s', should be one of (%s, %s) or a 5xx status code",
+				cond, RetryOnConnectError, RetryOnTimeout)
+		}
+	}
+	return nil
+}
+
+// retriesOn returns true if the policy retries on cond.
+func (rp RetryPolicy) retriesOn(cond string) bool {
+	conds := rp.RetryOn
+	if len(conds) == 0 {
+		conds = DefaultRetryOn
+	}
+	for _, c := range conds {
+		if c == cond {
+			return true
+		}
+	}
+	return false
+}
+
+// bufferBody reads the request body into memory, if it is small enough, and
+// returns whether the request may be retried. If the body is too large req.Body
+// is replaced so that the bytes already read are still sent upstream.
+func (rp RetryPolicy) bufferBody(req *http.Request) ([]byte, bool, error) {
+	if req.Body == nil || req.Body == http.NoBody || req.ContentLength == 0 {
+		return nil, idempotentMethods[req.Method], nil
+	}
+	if rp.BufferBody <= 0 || req.ContentLength > rp.BufferBody {
+		return nil, false, nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, rp.BufferBody+1))
+	if err != nil {
+		return nil, false, fmt.Errorf("error reading request body: %v", err)
+	}
+	if int64(len(body)) > rp.BufferBody {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		return nil, false, nil
+	}
+	return body, true, nil
+}
+
+// isConnectError returns true if err occurred while dialing the upstream.
+func isConnectError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// forward proxies req to target, retrying on alternate upstreams according to
+// the config's RetryPolicy. Returns the last request sent upstream.
+func (locus *Locus) forward(rw http.ResponseWriter, req *http.Request, c *Config,
+	proxyreq *http.Request, target *url.URL) (*http.Request, error) {
+
+	policy := c.Retry
+	var body []byte
+	retryable := false
+	if policy.MaxAttempts > 1 {
+		var err error
+		if body, retryable, err = policy.bufferBody(req); err != nil {
+			return proxyreq, err
+		}
+		proxyreq.Body = req.Body
+	}
+
+	tried := map[string]bool{}
+	for attempt := 1; ; attempt++ {
+		// Upstreams can refuse requests, such as a half-open circuit breaker whose
+		// probes were all taken by concurrent requests, so another is picked.
+		for !upstream.Reserve(c.UpstreamProvider, target) {
+			tried[target.String()] = true
+			next := alternate(c.UpstreamProvider, req, tried)
+			if next == nil {
+				return proxyreq, errNoUpstream
+			}
+			target, proxyreq = next, c.directTo(req, next)
+		}
+		tried[target.String()] = true
+		if body != nil {
+			proxyreq.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		upstream.Start(c.UpstreamProvider, target)
+		res, cancel, err := locus.try(proxyreq, c.Transport, policy.PerTryTimeout)
+		result := upstream.Result{Err: err, Canceled: clientCanceled(req, err)}
+		if res != nil {
+			result.StatusCode = res.StatusCode
+		}
+
+		if retryable && attempt < policy.MaxAttempts && policy.shouldRetry(res, err) {
+			if next := alternate(c.UpstreamProvider, req, tried); next != nil {
+				upstream.Report(c.UpstreamProvider, target, result)
+				if res != nil {
+					res.Body.Close()
+				}
+				cancel()
+				locus.Retries.Mark(1)
+				locus.elogf("retrying %s %s on %s after attempt %d to %s failed: %s",
+					req.Method, req.URL, next, attempt, target, describeFailure(res, err))
+				target, proxyreq = next, c.directTo(req, next)
+				continue
+			}
+		}
+
+		if err == nil {
+			upstream.ModifyResponse(c.UpstreamProvider, req, target, rw.Header())
+			if res.StatusCode == http.StatusSwitchingProtocols {
+				err = locus.proxy.upgrade(rw, res, locus.UpgradeIdleTimeout)
+				result.Err = err
+			} else {
+				locus.proxy.writeResponse(rw, res)
+			}
+		}
+		cancel()
+		upstream.Report(c.UpstreamProvider, target, result)
+		return proxyreq, err
+	}
+}
+
+// try makes a single attempt at proxyreq. The returned cancel func must be
+// called once the response has been consumed.
+func (locus *Locus) try(proxyreq *http.Request, transport http.RoundTripper, timeout time.Duration) (*http.Response, context.CancelFunc, error) {
+	ctx, cancel := context.WithCancel(proxyreq.Context())
+	proxyreq = proxyreq.WithContext(ctx)
+
+	var timer *time.Timer
+	var timedOut int32
+	if timeout > 0 {
+		timer = time.AfterFunc(timeout, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			cancel()
+		})
+	}
+
+	res, err := locus.proxy.roundTrip(proxyreq, transport)
+	if timer != nil && !timer.Stop() && atomic.LoadInt32(&timedOut) == 1 {
+		// The timeout may have fired just after headers were received, in which
+		// case the body has already been cancelled.
+		if res != nil {
+			res.Body.Close()
+			res = nil
+		}
+		err = errTimeout{timeout}
+	}
+	return res, cancel, err
+}
+
+// clientCanceled returns true if err was caused by the client going away, rather
+// than by the upstream.
+func clientCanceled(req *http.Request, err error) bool {
+	return err != nil && (req.Context().Err() != nil || errors.Is(err, context.Canceled))
+}
+
+// errTimeout is returned when an attempt exceeds the per-try timeout.
+type errTimeout struct {
+	timeout time.Duration
+}
+
+func (e errTimeout) Error() string {
+	return fmt.Sprintf("proxy error: no response from upstream within %s", e.timeout)
+}
+
+// shouldRetry returns true if the outcome of an attempt matches one of the
+// policy's conditions.
+func (rp RetryPolicy) shouldRetry(res *http.Response, err error) bool {
+	if _, ok := err.(errTimeout); ok {
+		return rp.retriesOn(RetryOnTimeout)
+	} else if err != nil {
+		return isConnectError(err) && rp.retriesOn(RetryOnConnectError)
+	}
+	return res.StatusCode >= 500 && rp.retriesOn(strconv.Itoa(res.StatusCode))
+}
+
+// alternate returns an upstream that hasn't been tried, preferring the
+// provider's choice. Providers that always return the same upstream for a
+// request, such as ip_hash, fall back to the first untried upstream. Returns nil
+// if every upstream has been tried.
+func alternate(p upstream.Provider, req *http.Request, tried map[string]bool) *url.URL {
+	for i := 0; i < 3; i++ {
+		u, err := p.Get(req)
+		if err != nil || u == nil {
+			return nil
+		}
+		if !tried[u.String()] {
+			return u
+		}
+	}
+	urls, err := p.All()
+	if err != nil {
+		return nil
+	}
+	for _, u := range urls {
+		if !tried[u.String()] {
+			return u
+		}
+	}
+	return nil
+}
+
+func describeFailure(res *http.Response, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("status %d", res.StatusCode)
+}
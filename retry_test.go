@@ -0,0 +1,183 @@
+package locus
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dpup/locus/upstream"
+)
+
+// newRetryLocus returns a Locus with a single config that always tries the
+// first upstream before falling back to the others.
+func newRetryLocus(policy RetryPolicy, urls ...string) *Locus {
+	locus := New()
+	cfg := locus.NewConfig()
+	cfg.Upstream(upstream.First(upstream.FixedSet(urls...)))
+	cfg.Retry = policy
+	return locus
+}
+
+func statusServer(status int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(r.Host))
+	}))
+}
+
+func TestRetryOnAlternateUpstream(t *testing.T) {
+	broken := statusServer(http.StatusServiceUnavailable)
+	defer broken.Close()
+	working := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("working"))
+	}))
+	defer working.Close()
+
+	// The first upstream refuses connections.
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	locus := newRetryLocus(RetryPolicy{MaxAttempts: 3}, closed.URL, broken.URL, working.URL)
+	rw := httptest.NewRecorder()
+	locus.ServeHTTP(rw, httptest.NewRequest("GET", "http://test.com/", nil))
+
+	if rw.Code != http.StatusOK || rw.Body.String() != "working" {
+		t.Errorf("Expected response from working upstream, was %d %q", rw.Code, rw.Body.String())
+	}
+	if c := locus.Retries.Count(); c != 2 {
+		t.Errorf("Expected 2 retries, was %d", c)
+	}
+}
+
+func TestRetryGivesUpAfterMaxAttempts(t *testing.T) {
+	broken1 := statusServer(http.StatusBadGateway)
+	defer broken1.Close()
+	broken2 := statusServer(http.StatusServiceUnavailable)
+	defer broken2.Close()
+	working := statusServer(http.StatusOK)
+	defer working.Close()
+
+	locus := newRetryLocus(RetryPolicy{MaxAttempts: 2}, broken1.URL, broken2.URL, working.URL)
+	rw := httptest.NewRecorder()
+	locus.ServeHTTP(rw, httptest.NewRequest("GET", "http://test.com/", nil))
+
+	// The last response is passed through to the client.
+	if rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 from second upstream, was %d", rw.Code)
+	}
+}
+
+func TestRetryConditions(t *testing.T) {
+	broken := statusServer(http.StatusInternalServerError)
+	defer broken.Close()
+	working := statusServer(http.StatusOK)
+	defer working.Close()
+
+	var tests = []struct {
+		retryOn  []string
+		expected int
+	}{
+		{nil, http.StatusInternalServerError},
+		{[]string{"500"}, http.StatusOK},
+		{[]string{RetryOnConnectError, "503"}, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		locus := newRetryLocus(RetryPolicy{MaxAttempts: 2, RetryOn: tt.retryOn}, broken.URL, working.URL)
+		rw := httptest.NewRecorder()
+		locus.ServeHTTP(rw, httptest.NewRequest("GET", "http://test.com/", nil))
+		if rw.Code != tt.expected {
+			t.Errorf("Retry on %v => %d, want %d", tt.retryOn, rw.Code, tt.expected)
+		}
+	}
+}
+
+func TestRetryRequestBodies(t *testing.T) {
+	broken := statusServer(http.StatusServiceUnavailable)
+	defer broken.Close()
+	received := ""
+	working := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		received = string(b)
+	}))
+	defer working.Close()
+
+	var tests = []struct {
+		method     string
+		body       string
+		bufferBody int64
+		expected   int
+	}{
+		// POSTs aren't idempotent, so are only retried if their body is buffered.
+		{"POST", "", 0, http.StatusServiceUnavailable},
+		{"POST", "", 10, http.StatusServiceUnavailable},
+		{"POST", "hello", 0, http.StatusServiceUnavailable},
+		{"POST", "hello", 10, http.StatusOK},
+		{"POST", "hello, too long", 10, http.StatusServiceUnavailable},
+		// Idempotent requests with bodies still need the body to be buffered.
+		{"PUT", "hello", 0, http.StatusServiceUnavailable},
+		{"PUT", "hello", 10, http.StatusOK},
+		{"DELETE", "", 0, http.StatusOK},
+	}
+	for _, tt := range tests {
+		received = ""
+		locus := newRetryLocus(RetryPolicy{MaxAttempts: 2, BufferBody: tt.bufferBody}, broken.URL, working.URL)
+		rw := httptest.NewRecorder()
+		locus.ServeHTTP(rw, httptest.NewRequest(tt.method, "http://test.com/", strings.NewReader(tt.body)))
+		if rw.Code != tt.expected {
+			t.Errorf("%s %q with buffer %d => %d, want %d", tt.method, tt.body, tt.bufferBody, rw.Code, tt.expected)
+		}
+		if rw.Code == http.StatusOK && received != tt.body {
+			t.Errorf("%s %q with buffer %d, upstream received %q", tt.method, tt.body, tt.bufferBody, received)
+		}
+	}
+}
+
+func TestRetryPerTryTimeout(t *testing.T) {
+	unblock := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-unblock:
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	defer close(unblock)
+	working := statusServer(http.StatusOK)
+	defer working.Close()
+
+	locus := newRetryLocus(RetryPolicy{MaxAttempts: 2, PerTryTimeout: 50 * time.Millisecond}, slow.URL, working.URL)
+	rw := httptest.NewRecorder()
+	locus.ServeHTTP(rw, httptest.NewRequest("GET", "http://test.com/", nil))
+	if rw.Code != http.StatusOK {
+		t.Errorf("Expected slow upstream to time out and be retried, was %d", rw.Code)
+	}
+
+	// Without retries the timeout still applies.
+	locus = newRetryLocus(RetryPolicy{PerTryTimeout: 50 * time.Millisecond}, slow.URL, working.URL)
+	rw = httptest.NewRecorder()
+	locus.ServeHTTP(rw, httptest.NewRequest("GET", "http://test.com/", nil))
+	if rw.Code != http.StatusBadGateway {
+		t.Errorf("Expected timeout to result in a 502, was %d", rw.Code)
+	}
+}
+
+func TestRetryPolicyValidate(t *testing.T) {
+	var tests = []struct {
+		policy RetryPolicy
+		valid  bool
+	}{
+		{RetryPolicy{}, true},
+		{RetryPolicy{MaxAttempts: 3, RetryOn: []string{"connect_error", "timeout", "500", "599"}}, true},
+		{RetryPolicy{MaxAttempts: -1}, false},
+		{RetryPolicy{RetryOn: []string{"404"}}, false},
+		{RetryPolicy{RetryOn: []string{"reset"}}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.policy.Validate(); (err == nil) != tt.valid {
+			t.Errorf("Validate(%+v) => %v, want valid=%v", tt.policy, err, tt.valid)
+		}
+	}
+}
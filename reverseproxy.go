@@ -7,6 +7,7 @@
 package locus
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -39,6 +40,20 @@ type reverseProxy struct {
 	// get byte slices for use by io.CopyBuffer when
 	// copying HTTP response bodies.
 	BufferPool BufferPool
+
+	// TrustedProxies are the networks of proxies in front of locus, whose
+	// X-Forwarded-Proto header is passed on rather than replaced.
+	TrustedProxies []*net.IPNet
+
+	// ErrorLog is called with errors that can't be returned to the caller. If
+	// nil, the log package's standard logger is used.
+	ErrorLog func(format string, args ...interface{})
+
+	// upgraded holds hijacked connections, which http.Server.Shutdown doesn't
+	// know about, so they can be closed by closeUpgraded.
+	upgraded  map[net.Conn]struct{}
+	closed    bool
+	upgradeMu sync.Mutex
 }
 
 // A BufferPool is an interface for getting and returning temporary
@@ -62,6 +77,24 @@ var hopHeaders = []string{
 	"Upgrade",
 }
 
+// trusts returns true if remoteAddr is one of the TrustedProxies.
+func (p *reverseProxy) trusts(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range p.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 type requestCanceler interface {
 	CancelRequest(*http.Request)
 }
@@ -99,7 +132,10 @@ func (p *reverseProxy) Proxy(rw http.ResponseWriter, proxyreq *http.Request) err
 		transport = http.DefaultTransport
 	}
 
-	if closeNotifier, ok := rw.(http.CloseNotifier); ok {
+	// Cancelation is tied to the first read of the body, so requests without
+	// one are left alone. Wrapping a nil Body would leave the transport calling
+	// Close on a nil Closer.
+	if closeNotifier, ok := rw.(http.CloseNotifier); ok && proxyreq.Body != nil {
 		if requestCanceler, ok := transport.(requestCanceler); ok {
 			reqDone := make(chan struct{})
 			defer close(reqDone)
@@ -127,6 +163,28 @@ func (p *reverseProxy) Proxy(rw http.ResponseWriter, proxyreq *http.Request) err
 		}
 	}
 
+	res, err := p.roundTrip(proxyreq, transport)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode == http.StatusSwitchingProtocols {
+		return p.upgrade(rw, res, 0)
+	}
+	p.writeResponse(rw, res)
+	return nil
+}
+
+// roundTrip sends proxyreq to the upstream, returning the response without
+// writing anything to the client. This lets callers decide whether to use the
+// response or retry. If transport is nil, the proxy's Transport is used.
+func (p *reverseProxy) roundTrip(proxyreq *http.Request, transport http.RoundTripper) (*http.Response, error) {
+	if transport == nil {
+		transport = p.Transport
+	}
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
 	proxyreq.Proto = "HTTP/1.1"
 	proxyreq.ProtoMajor = 1
 	proxyreq.ProtoMinor = 1
@@ -135,11 +193,17 @@ func (p *reverseProxy) Proxy(rw http.ResponseWriter, proxyreq *http.Request) err
 	// Remove hop-by-hop headers to the backend.  Especially
 	// important is "Connection" because we want a persistent
 	// connection, regardless of what the client sent to us.
+	// Protocol upgrades, such as WebSockets, are the exception.
+	reqUpType := upgradeType(proxyreq.Header)
 	for _, h := range hopHeaders {
 		if proxyreq.Header.Get(h) != "" {
 			proxyreq.Header.Del(h)
 		}
 	}
+	if reqUpType != "" {
+		proxyreq.Header.Set("Connection", "Upgrade")
+		proxyreq.Header.Set("Upgrade", reqUpType)
+	}
 
 	if clientIP, _, err := net.SplitHostPort(proxyreq.RemoteAddr); err == nil {
 		// If we aren't the first proxy retain prior
@@ -151,15 +215,34 @@ func (p *reverseProxy) Proxy(rw http.ResponseWriter, proxyreq *http.Request) err
 		proxyreq.Header.Set("X-Forwarded-For", clientIP)
 	}
 
+	// Let upstreams know whether the client connected over TLS, since that
+	// information is lost when Locus terminates it. A value sent by a trusted
+	// proxy, such as a load balancer terminating TLS in front of Locus, is kept.
+	// Any other is replaced, otherwise clients could claim https over plain HTTP.
+	if proxyreq.TLS != nil {
+		proxyreq.Header.Set("X-Forwarded-Proto", "https")
+	} else if proxyreq.Header.Get("X-Forwarded-Proto") == "" || !p.trusts(proxyreq.RemoteAddr) {
+		proxyreq.Header.Set("X-Forwarded-Proto", "http")
+	}
+
 	res, err := transport.RoundTrip(proxyreq)
 	if err != nil {
-		return fmt.Errorf("proxy error: %v", err)
+		return nil, fmt.Errorf("proxy error: %w", err)
 	}
 
-	for _, h := range hopHeaders {
-		res.Header.Del(h)
+	// A 101 response needs its Connection and Upgrade headers to reach the
+	// client.
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		for _, h := range hopHeaders {
+			res.Header.Del(h)
+		}
 	}
+	return res, nil
+}
 
+// writeResponse copies the upstream's response to the client, and closes its
+// body.
+func (p *reverseProxy) writeResponse(rw http.ResponseWriter, res *http.Response) {
 	copyHeader(rw.Header(), res.Header)
 
 	// The "Trailer" header isn't included in the Transport's response,
@@ -184,7 +267,6 @@ func (p *reverseProxy) Proxy(rw http.ResponseWriter, proxyreq *http.Request) err
 	p.copyResponse(rw, res.Body)
 	res.Body.Close() // close now, instead of defer, to populate res.Trailer
 	copyHeader(rw.Header(), res.Trailer)
-	return nil
 }
 
 func (p *reverseProxy) copyResponse(dst io.Writer, src io.Reader) {
@@ -249,3 +331,146 @@ func (m *maxLatencyWriter) flushLoop() {
 }
 
 func (m *maxLatencyWriter) stop() { m.done <- true }
+
+// upgradeType returns the protocol a request or response is asking to switch
+// to, or an empty string if it isn't.
+func upgradeType(h http.Header) string {
+	for _, v := range h["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return h.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// upgrade completes a 101 Switching Protocols response, such as a WebSocket
+// handshake, by hijacking the client's connection and copying bytes in both
+// directions until either side closes. If idleTimeout is non-zero, the
+// connections are closed once neither side has sent anything for that long.
+// Errors are only returned if nothing has been written to the client.
+func (p *reverseProxy) upgrade(rw http.ResponseWriter, res *http.Response, idleTimeout time.Duration) error {
+	reqUpType := upgradeType(res.Request.Header)
+	resUpType := upgradeType(res.Header)
+	if !strings.EqualFold(reqUpType, resUpType) {
+		res.Body.Close()
+		return fmt.Errorf("upstream tried to switch protocol %q when %q was requested", resUpType, reqUpType)
+	}
+
+	backConn, ok := res.Body.(io.ReadWriteCloser)
+	if !ok {
+		res.Body.Close()
+		return errors.New("101 switching protocols response with non-writable body")
+	}
+	defer backConn.Close()
+
+	hj, ok := rw.(http.Hijacker)
+	if !ok {
+		return fmt.Errorf("can't switch protocols using non-Hijacker ResponseWriter type %T", rw)
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return fmt.Errorf("hijack failed on protocol switch: %v", err)
+	}
+	defer conn.Close()
+
+	// The server's read and write timeouts still apply to the hijacked
+	// connection, but don't make sense for long lived connections.
+	conn.SetDeadline(time.Time{})
+
+	if !p.trackUpgraded(conn) {
+		return nil
+	}
+	defer p.untrackUpgraded(conn)
+
+	copyHeader(rw.Header(), res.Header)
+	res.Header = rw.Header()
+	res.Body = nil
+	if err := res.Write(brw); err != nil {
+		p.logf("error writing 101 response: %v", err)
+		return nil
+	}
+	if err := brw.Flush(); err != nil {
+		p.logf("error flushing 101 response: %v", err)
+		return nil
+	}
+
+	var idle *time.Timer
+	if idleTimeout > 0 {
+		idle = time.AfterFunc(idleTimeout, func() {
+			conn.Close()
+			backConn.Close()
+		})
+		defer idle.Stop()
+	}
+
+	errc := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(backConn, &activityReader{brw, idle, idleTimeout})
+		errc <- err
+	}()
+	go func() {
+		_, err := io.Copy(conn, &activityReader{backConn, idle, idleTimeout})
+		errc <- err
+	}()
+	<-errc
+	return nil
+}
+
+// trackUpgraded records conn so closeUpgraded can close it. Returns false if
+// closeUpgraded has already been called, in which case conn shouldn't be used.
+func (p *reverseProxy) trackUpgraded(conn net.Conn) bool {
+	p.upgradeMu.Lock()
+	defer p.upgradeMu.Unlock()
+	if p.closed {
+		return false
+	}
+	if p.upgraded == nil {
+		p.upgraded = map[net.Conn]struct{}{}
+	}
+	p.upgraded[conn] = struct{}{}
+	return true
+}
+
+func (p *reverseProxy) untrackUpgraded(conn net.Conn) {
+	p.upgradeMu.Lock()
+	defer p.upgradeMu.Unlock()
+	delete(p.upgraded, conn)
+}
+
+// closeUpgraded closes upgraded connections, and any upgraded later, returning
+// how many were open.
+func (p *reverseProxy) closeUpgraded() int {
+	p.upgradeMu.Lock()
+	defer p.upgradeMu.Unlock()
+	p.closed = true
+	n := len(p.upgraded)
+	for conn := range p.upgraded {
+		conn.Close()
+	}
+	return n
+}
+
+func (p *reverseProxy) logf(format string, args ...interface{}) {
+	if p.ErrorLog != nil {
+		p.ErrorLog(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// activityReader resets a timer whenever data is read.
+type activityReader struct {
+	r       io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (a *activityReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	if n > 0 && a.timer != nil {
+		a.timer.Reset(a.timeout)
+	}
+	return n, err
+}
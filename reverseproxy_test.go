@@ -174,6 +174,66 @@ func TestXForwardedFor(t *testing.T) {
 	}
 }
 
+func TestXForwardedProto(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Forwarded-Proto")))
+	}))
+	defer backend.Close()
+	backendURL, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyHandler := func(trusted ...string) http.Handler {
+		rp := &reverseProxy{}
+		for _, s := range trusted {
+			ipNet, _ := parseIPNet(s)
+			rp.TrustedProxies = append(rp.TrustedProxies, ipNet)
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rp.Proxy(w, transform(backendURL, r))
+		})
+	}
+
+	frontend := httptest.NewServer(proxyHandler())
+	defer frontend.Close()
+	tlsFrontend := httptest.NewTLSServer(proxyHandler())
+	defer tlsFrontend.Close()
+	behindProxy := httptest.NewServer(proxyHandler("127.0.0.0/8"))
+	defer behindProxy.Close()
+	behindOtherProxy := httptest.NewServer(proxyHandler("10.0.0.1"))
+	defer behindOtherProxy.Close()
+
+	// Clients can't claim a different protocol than they connected with, unless
+	// they are a trusted proxy.
+	var tests = []struct {
+		client   *http.Client
+		url      string
+		sent     string
+		expected string
+	}{
+		{frontend.Client(), frontend.URL, "https", "http"},
+		{tlsFrontend.Client(), tlsFrontend.URL, "http", "https"},
+		{behindProxy.Client(), behindProxy.URL, "https", "https"},
+		{behindProxy.Client(), behindProxy.URL, "", "http"},
+		{behindOtherProxy.Client(), behindOtherProxy.URL, "https", "http"},
+	}
+	for _, tt := range tests {
+		getReq, _ := http.NewRequest("GET", tt.url, nil)
+		if tt.sent != "" {
+			getReq.Header.Set("X-Forwarded-Proto", tt.sent)
+		}
+		res, err := tt.client.Do(getReq)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		bodyBytes, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if g := string(bodyBytes); g != tt.expected {
+			t.Errorf("%s: got X-Forwarded-Proto %q; expected %q", tt.url, g, tt.expected)
+		}
+	}
+}
+
 var proxyQueryTests = []struct {
 	baseSuffix string // suffix to add to backend URL
 	reqSuffix  string // suffix to add to frontend's request URL
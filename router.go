@@ -0,0 +1,365 @@
+package locus
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// router is a compiled route table, used when Locus.CompiledRouting is set.
+// Configs are indexed by host, then by the literal prefix of their path, so
+// only configs that could match a request are checked, most specific first:
+//
+//   - Exact hosts, then wildcard and glob hosts with the most literal
+//     characters, then configs that match any host.
+//   - Within a host, longer paths before shorter ones.
+//   - For the same path, exact paths, then regexps and templates, then prefixes.
+//   - Finally, configs with more rules, such as a port, query, method, header
+//     or cookie, before configs with fewer. Ties go to the config added first.
+//
+// Configs bound to several hosts are indexed under each of them.
+type router struct {
+	exact    map[string]*pathTrie
+	patterns []patternRoute
+	any      *pathTrie
+}
+
+// patternRoute holds the configs bound to a wildcard or glob host.
+type patternRoute struct {
+	host hostPattern
+	trie *pathTrie
+}
+
+// pathTrie indexes configs by the bytes of their path key. Each node holds the
+// routes whose key ends there, sorted most specific first.
+type pathTrie struct {
+	children map[byte]*pathTrie
+	routes   []route
+}
+
+type route struct {
+	cfg  *Config
+	rank routeRank
+}
+
+func newRouter(cfgs []*Config) *router {
+	r := &router{exact: map[string]*pathTrie{}, any: &pathTrie{}}
+	patterns := map[string]*pathTrie{}
+	for _, c := range cfgs {
+		inserted := map[*pathTrie]bool{}
+		for _, p := range c.hostPatterns() {
+			var t *pathTrie
+			switch {
+			case p.host == "":
+				t = r.any
+			case p.wild || p.glob != nil:
+				if t = patterns[p.host]; t == nil {
+					t = &pathTrie{}
+					patterns[p.host] = t
+					r.patterns = append(r.patterns, patternRoute{p, t})
+				}
+			default:
+				if t = r.exact[p.host]; t == nil {
+					t = &pathTrie{}
+					r.exact[p.host] = t
+				}
+			}
+			// Aliases that only differ by port share a trie, the config checks
+			// the port itself.
+			if !inserted[t] {
+				inserted[t] = true
+				t.insert(c.pathKey(), route{c, c.rank(p)})
+			}
+		}
+	}
+	sort.SliceStable(r.patterns, func(i, j int) bool {
+		return hostRank(r.patterns[i].host) > hostRank(r.patterns[j].host)
+	})
+	return r
+}
+
+// find returns the most specific config matching req, and any parameters
+// captured from the path.
+func (r *router) find(req *http.Request) (*Config, map[string]string) {
+	host, _ := splitHost(req.Host)
+	if t, ok := r.exact[host]; ok {
+		if c, params := t.find(req); c != nil {
+			return c, params
+		}
+	}
+	for _, p := range r.patterns {
+		if p.host.matchHost(host) {
+			if c, params := p.trie.find(req); c != nil {
+				return c, params
+			}
+		}
+	}
+	return r.any.find(req)
+}
+
+func (t *pathTrie) insert(key string, rt route) {
+	n := t
+	for i := 0; i < len(key); i++ {
+		if n.children == nil {
+			n.children = map[byte]*pathTrie{}
+		}
+		child, ok := n.children[key[i]]
+		if !ok {
+			child = &pathTrie{}
+			n.children[key[i]] = child
+		}
+		n = child
+	}
+	n.routes = append(n.routes, rt)
+	sort.SliceStable(n.routes, func(i, j int) bool {
+		return n.routes[i].rank.moreSpecific(n.routes[j].rank)
+	})
+}
+
+// find walks the request path, then checks configs from the deepest node back
+// to the root.
+func (t *pathTrie) find(req *http.Request) (*Config, map[string]string) {
+	path := req.URL.Path
+	nodes := []*pathTrie{t}
+	n := t
+	for i := 0; i < len(path) && n.children != nil; i++ {
+		if n = n.children[path[i]]; n == nil {
+			break
+		}
+		nodes = append(nodes, n)
+	}
+	for i := len(nodes) - 1; i >= 0; i-- {
+		for _, rt := range nodes[i].routes {
+			if ok, _, params := rt.cfg.match(req); ok {
+				return rt.cfg, params
+			}
+		}
+	}
+	return nil, nil
+}
+
+// hostPatterns returns the hosts bound by um, or a pattern matching any host if
+// there are none.
+func (um *Matcher) hostPatterns() []hostPattern {
+	if len(um.hosts) == 0 {
+		return []hostPattern{{}}
+	}
+	return um.hosts
+}
+
+// pathKey returns the literal prefix every path matched by um must start with.
+func (um *Matcher) pathKey() string {
+	if um.pathRe != nil {
+		prefix, _ := um.pathRe.LiteralPrefix()
+		return prefix
+	}
+	return um.path
+}
+
+// routeRank orders configs for the compiled router.
+type routeRank struct {
+	host  int
+	path  int
+	kind  int
+	rules int
+}
+
+// rank returns the rank of um when matched via host pattern p.
+func (um *Matcher) rank(p hostPattern) routeRank {
+	r := routeRank{host: hostRank(p), path: len(um.pathKey())}
+	if um.path != "" {
+		switch um.pathMode {
+		case pathExact:
+			r.kind = 4
+		case pathRegexp, pathTemplate:
+			r.kind = 3
+		case pathSegmentPrefix:
+			r.kind = 2
+		default:
+			r.kind = 1
+		}
+	}
+	if p.port != "" {
+		r.rules++
+	}
+	if um.hasQuery {
+		r.rules++
+	}
+	if len(um.methods) > 0 {
+		r.rules++
+	}
+	r.rules += len(um.headers) + len(um.cookies)
+	return r
+}
+
+// hostRank orders host patterns, exact hosts first, then patterns with more
+// literal characters. Globs are ahead of wildcards with the same suffix, as they
+// only match a single label.
+func hostRank(p hostPattern) int {
+	switch {
+	case p.host == "":
+		return 0
+	case p.glob != nil:
+		return 2*(len(p.host)-strings.Count(p.host, "*")) + 1
+	case p.wild:
+		return 2 * len(p.host)
+	}
+	return int(^uint(0) >> 1)
+}
+
+func (r routeRank) moreSpecific(o routeRank) bool {
+	if r.host != o.host {
+		return r.host > o.host
+	} else if r.path != o.path {
+		return r.path > o.path
+	} else if r.kind != o.kind {
+		return r.kind > o.kind
+	}
+	return r.rules > o.rules
+}
+
+// unreachableConfigs returns a warning for each config that can never be
+// reached, because every request it matches is routed to another config first.
+// The check is conservative, only configs that are certainly shadowed are
+// reported.
+func unreachableConfigs(cfgs []*Config, compiled bool) []string {
+	warnings := []string{}
+	for j, b := range cfgs {
+		var by *Config
+		for _, pb := range b.hostPatterns() {
+			if by = shadowedBy(cfgs, j, pb, compiled); by == nil {
+				break
+			}
+		}
+		if by != nil {
+			warnings = append(warnings, fmt.Sprintf(
+				"config '%s' (%s) can never be reached, its requests are routed to '%s' (%s)",
+				b.Name, b.Matcher, by.Name, by.Matcher))
+		}
+	}
+	return warnings
+}
+
+// shadowedBy returns a config that is routed to ahead of cfgs[j], for every
+// request cfgs[j] matches via host pattern pb, or nil if there isn't one.
+func shadowedBy(cfgs []*Config, j int, pb hostPattern, compiled bool) *Config {
+	b := cfgs[j]
+	for i, a := range cfgs {
+		if i == j || !a.shadowsRules(&b.Matcher) || !a.shadowsListeners(b) {
+			continue
+		}
+		for _, pa := range a.hostPatterns() {
+			first := i < j
+			if compiled {
+				ra, rb := a.rank(pa), b.rank(pb)
+				first = ra.moreSpecific(rb) || (ra == rb && i < j)
+			}
+			if first && pa.shadows(pb) {
+				return a
+			}
+		}
+	}
+	return nil
+}
+
+// shadowsListeners returns true if c serves every listener that o does.
+func (c *Config) shadowsListeners(o *Config) bool {
+	if len(c.Listeners) == 0 {
+		return true
+	} else if len(o.Listeners) == 0 {
+		return false
+	}
+	for _, l := range o.Listeners {
+		if !c.servesListener(l) {
+			return false
+		}
+	}
+	return true
+}
+
+// shadows returns true if p matches every host and port that o matches.
+func (p hostPattern) shadows(o hostPattern) bool {
+	if p.port != "" && p.port != o.port {
+		return false
+	}
+	switch {
+	case p.host == "":
+		return true
+	case p.wild:
+		// Globs only vary before their last "*".
+		tail := o.host[strings.LastIndex(o.host, "*")+1:]
+		return o.host != "" && strings.HasSuffix(tail, p.host)
+	case p.glob != nil:
+		return o.host == p.host || (!o.wild && o.glob == nil && o.host != "" && p.glob.MatchString(o.host))
+	}
+	return !o.wild && o.glob == nil && o.host == p.host
+}
+
+// shadowsRules returns true if, ignoring hosts, um matches every request that o
+// matches.
+func (um *Matcher) shadowsRules(o *Matcher) bool {
+	if um.path != "" && !um.shadowsPath(o) {
+		return false
+	}
+	if um.hasQuery {
+		if !o.hasQuery {
+			return false
+		}
+		for k := range um.query {
+			if o.query.Get(k) != um.query.Get(k) {
+				return false
+			}
+		}
+	}
+	if len(um.methods) > 0 {
+		if len(o.methods) == 0 {
+			return false
+		}
+		for _, m := range o.methods {
+			if !um.matchMethod(m) {
+				return false
+			}
+		}
+	}
+	return containsRules(o.headers, um.headers) && containsRules(o.cookies, um.cookies)
+}
+
+// shadowsPath returns true if every path matched by o is matched by um.
+func (um *Matcher) shadowsPath(o *Matcher) bool {
+	if o.path == "" {
+		return false
+	}
+	switch um.pathMode {
+	case pathExact:
+		return o.pathMode == pathExact && o.path == um.path
+	case pathRegexp, pathTemplate:
+		return o.pathMode == um.pathMode && o.path == um.path
+	case pathSegmentPrefix:
+		if o.pathMode == pathExact || o.pathMode == pathSegmentPrefix {
+			return hasPathPrefix(o.path, um.path)
+		}
+		// Other paths may continue the key's last segment, e.g. "/api" also
+		// matches "/apiary".
+		key := o.pathKey()
+		return hasPathPrefix(key, um.path) && (key != um.path || strings.HasSuffix(um.path, "/"))
+	}
+	return strings.HasPrefix(o.pathKey(), um.path)
+}
+
+// containsRules returns true if every rule in required is also in rules.
+func containsRules(rules, required []valueRule) bool {
+	for _, req := range required {
+		found := false
+		for _, r := range rules {
+			if r.String() == req.String() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
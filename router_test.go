@@ -0,0 +1,239 @@
+package locus
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dpup/locus/upstream"
+)
+
+// newRoutedLocus returns a Locus with a config for each binding, named after
+// it, in the order given.
+func newRoutedLocus(compiled bool, binds ...string) *Locus {
+	locus := New()
+	locus.CompiledRouting = compiled
+	for _, b := range binds {
+		cfg := locus.NewConfig()
+		cfg.Name = b
+		cfg.Bind(b)
+		cfg.Upstream(upstream.Single("http://upstream.com"))
+	}
+	return locus
+}
+
+func TestCompiledRouting(t *testing.T) {
+	locus := newRoutedLocus(true,
+		"//",
+		"//.mysite.com",
+		"//.api.mysite.com",
+		"//www.mysite.com/search",
+		"//www.mysite.com/search/images",
+		"//www.mysite.com/?beta=1",
+		"//www.mysite.com/",
+		"//:8080/",
+	)
+	exact := locus.NewConfig()
+	exact.Name = "exact"
+	exact.BindHost("www.mysite.com")
+	exact.BindPathExact("/search")
+	exact.Upstream(upstream.Single("http://upstream.com"))
+	tmpl := locus.NewConfig()
+	tmpl.Name = "template"
+	tmpl.BindHost("www.mysite.com")
+	checkError(t, tmpl.BindPathTemplate("/search/{query}"), "binding template")
+	tmpl.Upstream(upstream.Single("http://upstream.com"))
+	v2 := locus.NewConfig()
+	v2.Name = "v2"
+	v2.BindHost("v1.api.mysite.com")
+	v2.BindHeader("Accept", "application/vnd.v2")
+	v2.Upstream(upstream.Single("http://upstream.com"))
+	v1 := locus.NewConfig()
+	v1.Name = "v1"
+	v1.BindHost("v1.api.mysite.com")
+	v1.Upstream(upstream.Single("http://upstream.com"))
+
+	var tests = []struct {
+		url      string
+		accept   string
+		expected string
+	}{
+		{"http://www.mysite.com/search", "", "exact"},
+		{"http://www.mysite.com/search/", "", "//www.mysite.com/search"},
+		{"http://www.mysite.com/search/cats", "", "template"},
+		{"http://www.mysite.com/search/images", "", "//www.mysite.com/search/images"},
+		{"http://www.mysite.com/search/images/cats", "", "//www.mysite.com/search/images"},
+		{"http://www.mysite.com/searching", "", "//www.mysite.com/search"},
+		{"http://www.mysite.com/about", "", "//www.mysite.com/"},
+		{"http://www.mysite.com/about?beta=1", "", "//www.mysite.com/?beta=1"},
+		{"http://blog.mysite.com/", "", "//.mysite.com"},
+		{"http://v2.api.mysite.com/", "", "//.api.mysite.com"},
+		{"http://v1.api.mysite.com/", "", "v1"},
+		{"http://v1.api.mysite.com/", "application/vnd.v2", "v2"},
+		{"http://other.com:8080/", "", "//:8080/"},
+		{"http://other.com/", "", "//"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.url, nil)
+		req.Header.Set("Accept", tt.accept)
+		name := "<none>"
+		if c, _ := locus.findConfig(req); c != nil {
+			name = c.Name
+		}
+		if name != tt.expected {
+			t.Errorf("%s (Accept %q) routed to %s, want %s", tt.url, tt.accept, name, tt.expected)
+		}
+	}
+
+	// Without compiled routing the first config matches everything.
+	locus.CompiledRouting = false
+	if c, _ := locus.findConfig(httptest.NewRequest("GET", "http://www.mysite.com/search", nil)); c.Name != "//" {
+		t.Errorf("Expected first match routing, was %s", c.Name)
+	}
+}
+
+func TestCompiledRoutingHostPatterns(t *testing.T) {
+	locus := newRoutedLocus(true, "//.mysite.com", "//www.mysite.com/")
+	add := func(name string, hosts ...string) {
+		cfg := locus.NewConfig()
+		cfg.Name = name
+		cfg.BindHosts(hosts...)
+		cfg.Upstream(upstream.Single("http://upstream.com"))
+	}
+	add("api", "api-*.mysite.com", "api.mysite.com")
+	add("eu", "*.mysite.com")
+	add("aliases", "mysite.com", "www.mysite.eu", "mysite.eu")
+
+	var tests = []struct {
+		url      string
+		expected string
+	}{
+		{"http://api.mysite.com/", "api"},
+		{"http://api-v2.mysite.com/", "api"},
+		{"http://blog.mysite.com/", "eu"},
+		{"http://blog.staging.mysite.com/", "//.mysite.com"},
+		{"http://www.mysite.com/", "//www.mysite.com/"},
+		{"http://mysite.com/", "aliases"},
+		{"http://www.mysite.eu/", "aliases"},
+		{"http://other.eu/", "<none>"},
+	}
+	for _, tt := range tests {
+		name := "<none>"
+		if c, _ := locus.findConfig(httptest.NewRequest("GET", tt.url, nil)); c != nil {
+			name = c.Name
+		}
+		if name != tt.expected {
+			t.Errorf("%s routed to %s, want %s", tt.url, name, tt.expected)
+		}
+	}
+}
+
+func TestCompiledRoutingCaptures(t *testing.T) {
+	locus := newRoutedLocus(true, "//www.mysite.com/")
+	cfg := locus.NewConfig()
+	cfg.BindHost("www.mysite.com")
+	checkError(t, cfg.BindPathRegexp(`/users/(?P<id>[0-9]+)`), "binding regexp")
+	c, params := locus.findConfig(httptest.NewRequest("GET", "http://www.mysite.com/users/42", nil))
+	if c != cfg || params["id"] != "42" {
+		t.Errorf("Expected regexp config with id 42, was %s %v", c.Name, params)
+	}
+}
+
+func TestCompiledRoutingRebuilds(t *testing.T) {
+	locus := newRoutedLocus(true, "//www.mysite.com/")
+	req := httptest.NewRequest("GET", "http://www.mysite.com/blog", nil)
+	if c, _ := locus.findConfig(req); c.Name != "//www.mysite.com/" {
+		t.Errorf("Unexpected config %s", c.Name)
+	}
+
+	blog := locus.NewConfig()
+	blog.Name = "blog"
+	blog.Bind("//www.mysite.com/blog")
+	if c, _ := locus.findConfig(req); c.Name != "blog" {
+		t.Errorf("Expected newly added config to be routed to, was %s", c.Name)
+	}
+
+	checkError(t, locus.ReloadConfig([]byte(testSitesYAML)), "reloading")
+	if c, _ := locus.findConfig(req); c != nil {
+		t.Errorf("Expected no config after reload, was %s", c.Name)
+	}
+}
+
+func TestUnreachableConfigs(t *testing.T) {
+	var tests = []struct {
+		binds    []string
+		compiled bool
+		expected int
+	}{
+		{[]string{"//.mysite.com", "//www.mysite.com/search"}, false, 1},
+		{[]string{"//.mysite.com", "//www.mysite.com/search"}, true, 0},
+		{[]string{"//www.mysite.com/search", "//.mysite.com"}, false, 0},
+		{[]string{"//www.mysite.com/", "//www.mysite.com/search"}, false, 1},
+		{[]string{"//www.mysite.com/", "//www.mysite.com/?beta=1"}, false, 1},
+		{[]string{"//www.mysite.com/?beta=1", "//www.mysite.com/"}, false, 0},
+		{[]string{"//www.mysite.com:80/", "//www.mysite.com/"}, false, 0},
+		{[]string{"//www.mysite.com/search", "//www.mysite.com/search"}, false, 1},
+		{[]string{"//www.mysite.com/search", "//www.mysite.com/search"}, true, 1},
+		{[]string{"//www.mysite.com/", "//api.mysite.com/"}, false, 0},
+		{[]string{"//", "//www.mysite.com/", "//api.mysite.com/"}, false, 2},
+	}
+	for _, tt := range tests {
+		locus := newRoutedLocus(tt.compiled, tt.binds...)
+		warnings := unreachableConfigs(locus.Configs, tt.compiled)
+		if len(warnings) != tt.expected {
+			t.Errorf("%v (compiled %v) => %d warnings, want %d: %v", tt.binds, tt.compiled, len(warnings), tt.expected, warnings)
+		}
+	}
+
+	// Configs with several hosts are only unreachable if every host is.
+	locus := New()
+	for i, hosts := range [][]string{
+		{".mysite.com"},
+		{"www.mysite.com", "www.mysite.eu"},
+		{"api-*.mysite.com", "*.mysite.com"},
+	} {
+		cfg := locus.NewConfig()
+		cfg.Name = fmt.Sprintf("cfg%d", i)
+		cfg.BindHosts(hosts...)
+	}
+	expected := "config 'cfg2' (api-*.mysite.com,*.mysite.com) can never be reached, its requests are routed to 'cfg0' (.mysite.com)"
+	if w := unreachableConfigs(locus.Configs, false); len(w) != 1 || w[0] != expected {
+		t.Errorf("Unexpected warnings %v", w)
+	}
+
+	locus = newRoutedLocus(false, "//", "//www.mysite.com/")
+	expected = "config '//www.mysite.com/' (www.mysite.com/) can never be reached, its requests are routed to '//' (/)"
+	if w := unreachableConfigs(locus.Configs, false); len(w) != 1 || w[0] != expected {
+		t.Errorf("Unexpected warning %v", w)
+	}
+}
+
+func TestUnreachablePaths(t *testing.T) {
+	var tests = []struct {
+		a, b     func(*Matcher) error
+		expected bool
+	}{
+		{bindPath((*Matcher).BindPathPrefix, "/api"), bindPath((*Matcher).BindPathExact, "/api"), true},
+		{bindPath((*Matcher).BindPathPrefix, "/api"), bindPath((*Matcher).BindPathPrefix, "/api/v1"), true},
+		{bindPath((*Matcher).BindPathPrefix, "/api"), bindPath((*Matcher).BindPathPrefix, "/apiary"), false},
+		{bindPath(legacyPrefix, "/api"), bindPath((*Matcher).BindPathPrefix, "/apiary"), true},
+		{bindPath((*Matcher).BindPathPrefix, "/api"), bindPath(legacyPrefix, "/api"), false},
+		{bindPath((*Matcher).BindPathPrefix, "/api"), bindPath(legacyPrefix, "/api/"), true},
+		{bindPath((*Matcher).BindPathPrefix, "/users"), bindPattern((*Matcher).BindPathTemplate, "/users/{id}"), true},
+		{bindPath((*Matcher).BindPathPrefix, "/users"), bindPattern((*Matcher).BindPathTemplate, "/users{id}"), false},
+		{bindPath((*Matcher).BindPathExact, "/users"), bindPath((*Matcher).BindPathPrefix, "/users"), false},
+		{bindPattern((*Matcher).BindPathTemplate, "/users/{id}"), bindPath((*Matcher).BindPathExact, "/users/1"), false},
+	}
+	for i, tt := range tests {
+		a, b := &Matcher{}, &Matcher{}
+		checkError(t, tt.a(a), "binding a")
+		checkError(t, tt.b(b), "binding b")
+		if actual := a.shadowsRules(b); actual != tt.expected {
+			t.Errorf("Test %d: %s shadows %s => %v, want %v", i, a, b, actual, tt.expected)
+		}
+	}
+}
+
+func legacyPrefix(um *Matcher, path string) {
+	um.BindLocation(path)
+}
@@ -0,0 +1,149 @@
+package locus
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/acme"
+)
+
+// certStore holds the certificates used to terminate TLS, indexed by the DNS
+// names they are valid for.
+type certStore struct {
+	certs  []*tls.Certificate
+	byName map[string]*tls.Certificate
+	mu     sync.RWMutex
+}
+
+// add registers a certificate under each of the names in its leaf, later
+// certificates take precedence over earlier ones for the same name.
+func (cs *certStore) add(cert *tls.Certificate) error {
+	if cert.Leaf == nil {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("unable to parse certificate: %s", err)
+		}
+		cert.Leaf = leaf
+	}
+
+	names := cert.Leaf.DNSNames
+	if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+		names = []string{cert.Leaf.Subject.CommonName}
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.byName == nil {
+		cs.byName = map[string]*tls.Certificate{}
+	}
+	cs.certs = append(cs.certs, cert)
+	for _, name := range names {
+		cs.byName[strings.ToLower(name)] = cert
+	}
+	return nil
+}
+
+// names returns the sorted list of names that certificates are held for.
+func (cs *certStore) names() []string {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	names := make([]string, 0, len(cs.byName))
+	for name := range cs.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// empty returns true if no certificates have been added.
+func (cs *certStore) empty() bool {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return len(cs.certs) == 0
+}
+
+// lookup returns the certificate for an exact name, falling back to a wildcard
+// certificate for the parent domain. Returns nil if there is no match.
+func (cs *certStore) lookup(name string) *tls.Certificate {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if name == "" {
+		return nil
+	}
+
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	if cert, ok := cs.byName[name]; ok {
+		return cert
+	}
+	if i := strings.Index(name, "."); i != -1 {
+		if cert, ok := cs.byName["*"+name[i:]]; ok {
+			return cert
+		}
+	}
+	return nil
+}
+
+// getCertificate satisfies tls.Config.GetCertificate, choosing a certificate
+// based on the SNI sent by the client. Clients that don't send SNI, or ask for
+// an unknown name, are given the first certificate that was added.
+func (cs *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert := cs.lookup(hello.ServerName); cert != nil {
+		return cert, nil
+	}
+
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	if len(cs.certs) == 0 {
+		return nil, errors.New("no TLS certificates configured")
+	}
+	return cs.certs[0], nil
+}
+
+// AddCertificate loads a PEM encoded certificate and private key from disk.
+// The certificate will be served to TLS clients whose SNI matches one of the
+// names in the certificate.
+func (locus *Locus) AddCertificate(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("unable to load certificate %s: %s", certFile, err)
+	}
+	return locus.certs.add(&cert)
+}
+
+// CertificateNames returns the DNS names that TLS certificates are held for.
+func (locus *Locus) CertificateNames() []string {
+	return locus.certs.names()
+}
+
+func (locus *Locus) tlsConfig() *tls.Config {
+	cfg := &tls.Config{
+		GetCertificate: locus.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if locus.acme != nil {
+		cfg.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+	}
+	if locus.clientCAs != nil {
+		cfg.ClientAuth = locus.clientAuth
+		cfg.ClientCAs = locus.clientCAs
+
+		// ACME servers don't have client certificates, so TLS-ALPN-01 challenges
+		// must be answered without requiring one.
+		if locus.acme != nil {
+			challengeCfg := cfg.Clone()
+			challengeCfg.ClientAuth = tls.NoClientCert
+			cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+				if isALPNChallenge(hello) {
+					return challengeCfg, nil
+				}
+				return nil, nil
+			}
+		}
+	}
+	return cfg
+}
@@ -0,0 +1,95 @@
+package locus
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert generates a self-signed certificate for the given names and
+// writes the cert and key to dir, returning their paths.
+func writeTestCert(t *testing.T, dir, name string, dnsNames ...string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	checkError(t, err, "generating key")
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	checkError(t, err, "creating certificate")
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	checkError(t, err, "marshaling key")
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	checkError(t, err, "writing cert")
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	checkError(t, err, "writing key")
+	return certFile, keyFile
+}
+
+func TestCertificateSelection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "locus")
+	checkError(t, err, "creating temp dir")
+	defer os.RemoveAll(dir)
+
+	locus := New()
+	checkError(t, locus.AddCertificate(writeTestCert(t, dir, "first", "first.com", "www.first.com")), "adding first")
+	checkError(t, locus.AddCertificate(writeTestCert(t, dir, "second", "second.com")), "adding second")
+	checkError(t, locus.AddCertificate(writeTestCert(t, dir, "wild", "*.wild.com")), "adding wild")
+
+	var tests = []struct {
+		serverName string
+		expected   string
+	}{
+		{"first.com", "first.com"},
+		{"www.first.com", "first.com"},
+		{"WWW.First.com.", "first.com"},
+		{"second.com", "second.com"},
+		{"foo.wild.com", "*.wild.com"},
+		{"wild.com", "first.com"},
+		{"foo.bar.wild.com", "first.com"},
+		{"unknown.com", "first.com"},
+		{"", "first.com"},
+	}
+
+	for _, tt := range tests {
+		cert, err := locus.certs.getCertificate(&tls.ClientHelloInfo{ServerName: tt.serverName})
+		checkError(t, err, "getting certificate")
+		if cert.Leaf.Subject.CommonName != tt.expected {
+			t.Errorf("SNI %q => %s, want %s", tt.serverName, cert.Leaf.Subject.CommonName, tt.expected)
+		}
+	}
+}
+
+func TestAddCertificateMissingFile(t *testing.T) {
+	locus := New()
+	if err := locus.AddCertificate("/does/not/exist.crt", "/does/not/exist.key"); err == nil {
+		t.Error("Expected error loading missing certificate")
+	}
+}
+
+func TestNoCertificates(t *testing.T) {
+	locus := New()
+	locus.TLSPort = 5443
+	if err := locus.ListenAndServe(); err == nil {
+		t.Error("Expected error starting TLS without certificates")
+	}
+}
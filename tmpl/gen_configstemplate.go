@@ -59,10 +59,57 @@ width: 7rem;
 <tr>
 <td colspan="2">Globals</td>
 </tr>
+{{if .Listeners}}
+<tr>
+<td>listeners:</td>
+<td>{{range .Listeners}}{{.}}<br>{{end}}</td>
+</tr>
+{{else}}
 <tr>
 <td>local port:</td>
 <td>{{.Port}}</td>
 </tr>
+{{if .ListenAddrs}}
+<tr>
+<td>listen addresses:</td>
+<td>{{range .ListenAddrs}}{{.}}<br>{{end}}</td>
+</tr>
+{{end}}
+{{end}}
+{{if or .TLSPort .Listeners}}
+{{if and .TLSPort (not .Listeners)}}
+<tr>
+<td>tls port:</td>
+<td>{{.TLSPort}}</td>
+</tr>
+{{end}}
+<tr>
+<td>certificates:</td>
+<td>{{range .CertificateNames}}{{.}}<br>{{end}}</td>
+</tr>
+{{if .ClientAuthMode}}
+<tr>
+<td>client certificates:</td>
+<td>{{.ClientAuthMode}}</td>
+</tr>
+{{end}}
+{{if .ACMEHosts}}
+<tr>
+<td>acme hosts:</td>
+<td>{{range .ACMEHosts}}{{.}}<br>{{end}}</td>
+</tr>
+{{end}}
+{{end}}
+{{if .AdminAddr}}
+<tr>
+<td>admin address:</td>
+<td>{{.AdminAddr}}</td>
+</tr>
+{{end}}
+<tr>
+<td>routing:</td>
+<td>{{if .CompiledRouting}}most specific{{else}}first match{{end}}</td>
+</tr>
 <tr>
 <td>read timeout:</td>
 <td>{{.ReadTimeout}}</td>
@@ -72,6 +119,14 @@ width: 7rem;
 <td>{{.WriteTimeout}}</td>
 </tr>
 <tr>
+<td>drain timeout:</td>
+<td>{{.DrainTimeout}}</td>
+</tr>
+<tr>
+<td>upgrade idle timeout:</td>
+<td>{{.UpgradeIdleTimeout}}</td>
+</tr>
+<tr>
 <td>verbose logging:</td>
 <td>{{.VerboseLogging}}</td>
 </tr>
@@ -102,6 +157,13 @@ width: 7rem;
 </td>
 </tr>
 <tr>
+<td>circuit breakers:</td>
+<td>
+<span>open:</span> {{.BreakersOpen}}<br>
+<span>trips:</span> {{.BreakerTrips}}
+</td>
+</tr>
+<tr>
 <td>latency:</td>
 <td>
 <span>min:</span> {{.Latency.Min}}<br>
@@ -109,7 +171,7 @@ width: 7rem;
 <span>avg:</span> {{.Latency.Mean | printf "%.0f"}}
 </td>
 </tr>
-{{range .Configs}}
+{{range .CurrentConfigs}}
 <tr>
 <td colspan="2">
 {{if .Redirect}}
@@ -124,6 +186,18 @@ Site:
 <td>binding:</td>
 <td>{{.Matcher}}</td>
 </tr>
+{{if .Listeners}}
+<tr>
+<td>listeners:</td>
+<td>{{range .Listeners}}{{.}}<br>{{end}}</td>
+</tr>
+{{end}}
+{{if .ClientCert.Enabled}}
+<tr>
+<td>client certificate:</td>
+<td>{{.ClientCert}}</td>
+</tr>
+{{end}}
 {{range $i, $v := .UpstreamProvider.All}}
 <tr>
 <td>upstream #{{$i}}:</td>
@@ -0,0 +1,175 @@
+package locus
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Defaults used for zero values in TransportSettings, matching
+// http.DefaultTransport.
+const (
+	DefaultDialTimeout         = 30 * time.Second
+	DefaultKeepAlive           = 30 * time.Second
+	DefaultTLSHandshakeTimeout = 10 * time.Second
+	DefaultIdleConnTimeout     = 90 * time.Second
+	DefaultMaxIdleConns        = 100
+)
+
+// TransportSettings controls how connections to a config's upstreams are made
+// and pooled. Zero values are replaced with defaults.
+type TransportSettings struct {
+	// DialTimeout limits how long establishing a TCP connection may take.
+	DialTimeout time.Duration
+
+	// KeepAlive is the interval between TCP keep-alive probes. Negative disables
+	// them.
+	KeepAlive time.Duration
+
+	// TLSHandshakeTimeout limits how long a TLS handshake with an upstream may
+	// take.
+	TLSHandshakeTimeout time.Duration
+
+	// ResponseHeaderTimeout limits how long to wait for an upstream's response
+	// headers, once the request has been sent. Zero means no limit.
+	ResponseHeaderTimeout time.Duration
+
+	// IdleConnTimeout is how long an idle connection stays in the pool.
+	IdleConnTimeout time.Duration
+
+	// MaxIdleConns limits idle connections across all upstreams.
+	MaxIdleConns int
+
+	// MaxIdleConnsPerHost limits idle connections to each upstream, defaults to
+	// http.DefaultMaxIdleConnsPerHost.
+	MaxIdleConnsPerHost int
+
+	// MaxConnsPerHost limits the total connections to each upstream. Zero means
+	// no limit.
+	MaxConnsPerHost int
+
+	// DisableKeepAlives stops connections being reused between requests.
+	DisableKeepAlives bool
+
+	// DisableCompression stops the transport asking upstreams for gzip, so
+	// responses are passed through exactly as the client requested them.
+	DisableCompression bool
+
+	// TLSClientConfig is used for connections to HTTPS upstreams, if nil Go's
+	// defaults are used. See UpstreamTLS.
+	TLSClientConfig *tls.Config
+}
+
+// NewTransport returns a dedicated http.Transport using the settings, for use
+// as a Config's Transport.
+func NewTransport(ts TransportSettings) *http.Transport {
+	if ts.DialTimeout == 0 {
+		ts.DialTimeout = DefaultDialTimeout
+	}
+	if ts.KeepAlive == 0 {
+		ts.KeepAlive = DefaultKeepAlive
+	}
+	if ts.TLSHandshakeTimeout == 0 {
+		ts.TLSHandshakeTimeout = DefaultTLSHandshakeTimeout
+	}
+	if ts.IdleConnTimeout == 0 {
+		ts.IdleConnTimeout = DefaultIdleConnTimeout
+	}
+	if ts.MaxIdleConns == 0 {
+		ts.MaxIdleConns = DefaultMaxIdleConns
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   ts.DialTimeout,
+		KeepAlive: ts.KeepAlive,
+	}
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   ts.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: ts.ResponseHeaderTimeout,
+		IdleConnTimeout:       ts.IdleConnTimeout,
+		MaxIdleConns:          ts.MaxIdleConns,
+		MaxIdleConnsPerHost:   ts.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       ts.MaxConnsPerHost,
+		DisableKeepAlives:     ts.DisableKeepAlives,
+		DisableCompression:    ts.DisableCompression,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       ts.TLSClientConfig,
+	}
+}
+
+// tlsVersions maps the names accepted by ParseTLSVersion to versions.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion converts a version such as "1.2" to its crypto/tls constant.
+func ParseTLSVersion(v string) (uint16, error) {
+	if version, ok := tlsVersions[v]; ok {
+		return version, nil
+	}
+	return 0, fmt.Errorf("invalid TLS version '%s', should be one of (1.0, 1.1, 1.2, 1.3)", v)
+}
+
+// UpstreamTLS specifies how connections to HTTPS upstreams are secured, for
+// upstreams signed by a private CA or requiring client certificates.
+type UpstreamTLS struct {
+	// CAFile is a PEM bundle of CAs trusted to sign upstream certificates, in
+	// place of the system roots.
+	CAFile string
+
+	// CertFile and KeyFile are a PEM encoded client certificate and key,
+	// presented to upstreams that request one.
+	CertFile string
+	KeyFile  string
+
+	// ServerName overrides the name upstream certificates are verified against,
+	// useful when upstreams are addressed by IP.
+	ServerName string
+
+	// MinVersion is the minimum TLS version, such as tls.VersionTLS12. Zero uses
+	// Go's default.
+	MinVersion uint16
+}
+
+// ClientConfig loads the files referenced by ut, returning a config suitable
+// for TransportSettings.TLSClientConfig.
+func (ut UpstreamTLS) ClientConfig() (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName: ut.ServerName,
+		MinVersion: ut.MinVersion,
+	}
+
+	if ut.CAFile != "" {
+		pem, err := ioutil.ReadFile(ut.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA file: %s", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", ut.CAFile)
+		}
+	}
+
+	if ut.CertFile != "" || ut.KeyFile != "" {
+		if ut.CertFile == "" || ut.KeyFile == "" {
+			return nil, errors.New("client certificates require both a cert file and a key file")
+		}
+		cert, err := tls.LoadX509KeyPair(ut.CertFile, ut.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate %s: %s", ut.CertFile, err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,148 @@
+package locus
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dpup/locus/upstream"
+)
+
+func TestNewTransportDefaults(t *testing.T) {
+	tr := NewTransport(TransportSettings{MaxIdleConnsPerHost: 10})
+	if tr.TLSHandshakeTimeout != DefaultTLSHandshakeTimeout || tr.IdleConnTimeout != DefaultIdleConnTimeout ||
+		tr.MaxIdleConns != DefaultMaxIdleConns {
+		t.Errorf("Expected defaults for zero values, was %+v", tr)
+	}
+	if tr.MaxIdleConnsPerHost != 10 {
+		t.Errorf("Expected 10 idle conns per host, was %d", tr.MaxIdleConnsPerHost)
+	}
+}
+
+func TestConfigTransport(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Write([]byte(r.Header.Get("Accept-Encoding")))
+	}))
+	defer backend.Close()
+
+	locus := New()
+	cfg := locus.NewConfig()
+	cfg.Upstream(upstream.Single(backend.URL))
+	cfg.Transport = NewTransport(TransportSettings{
+		ResponseHeaderTimeout: 50 * time.Millisecond,
+		DisableCompression:    true,
+	})
+
+	// Compression isn't requested on the client's behalf.
+	rw := httptest.NewRecorder()
+	locus.ServeHTTP(rw, httptest.NewRequest("GET", "http://test.com/", nil))
+	if rw.Code != http.StatusOK || rw.Body.String() != "" {
+		t.Errorf("Expected no Accept-Encoding to be sent upstream, was %d %q", rw.Code, rw.Body.String())
+	}
+
+	rw = httptest.NewRecorder()
+	locus.ServeHTTP(rw, httptest.NewRequest("GET", "http://test.com/slow", nil))
+	if rw.Code != http.StatusBadGateway {
+		t.Errorf("Expected response header timeout to result in a 502, was %d", rw.Code)
+	}
+}
+
+func TestUpstreamMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "locus")
+	checkError(t, err, "creating temp dir")
+	defer os.RemoveAll(dir)
+
+	serverCert, serverKey := writeTestCert(t, dir, "server", "backend.internal")
+	clientCert, clientKey := writeTestCert(t, dir, "client", "locus.internal")
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	cert, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	checkError(t, err, "loading server cert")
+	clientPEM, err := ioutil.ReadFile(clientCert)
+	checkError(t, err, "reading client cert")
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(clientPEM)
+	backend.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	backend.StartTLS()
+	defer backend.Close()
+
+	var tests = []struct {
+		tls      UpstreamTLS
+		expected int
+	}{
+		{UpstreamTLS{CAFile: serverCert, CertFile: clientCert, KeyFile: clientKey, ServerName: "backend.internal"}, http.StatusOK},
+		// Without a client certificate the handshake fails.
+		{UpstreamTLS{CAFile: serverCert, ServerName: "backend.internal"}, http.StatusBadGateway},
+		// The backend is addressed by IP, so the name must be overridden.
+		{UpstreamTLS{CAFile: serverCert, CertFile: clientCert, KeyFile: clientKey}, http.StatusBadGateway},
+		// Without the CA the backend's certificate isn't trusted.
+		{UpstreamTLS{CertFile: clientCert, KeyFile: clientKey, ServerName: "backend.internal"}, http.StatusBadGateway},
+	}
+	for i, tt := range tests {
+		tlsConfig, err := tt.tls.ClientConfig()
+		checkError(t, err, "loading upstream TLS config")
+
+		locus := New()
+		cfg := locus.NewConfig()
+		cfg.Upstream(upstream.Single(backend.URL))
+		cfg.Transport = NewTransport(TransportSettings{TLSClientConfig: tlsConfig})
+
+		rw := httptest.NewRecorder()
+		locus.ServeHTTP(rw, httptest.NewRequest("GET", "http://test.com/", nil))
+		if rw.Code != tt.expected {
+			t.Errorf("Test %d: expected %d, was %d", i, tt.expected, rw.Code)
+		}
+		if rw.Code == http.StatusOK && rw.Body.String() != "locus.internal" {
+			t.Errorf("Test %d: expected backend to see client certificate, was %q", i, rw.Body.String())
+		}
+	}
+}
+
+func TestUpstreamTLSValidation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "locus")
+	checkError(t, err, "creating temp dir")
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCert(t, dir, "client", "locus.internal")
+	garbage := filepath.Join(dir, "garbage.pem")
+	checkError(t, ioutil.WriteFile(garbage, []byte("not a cert"), 0600), "writing garbage")
+
+	var tests = []struct {
+		tls      UpstreamTLS
+		expected string
+	}{
+		{UpstreamTLS{CAFile: filepath.Join(dir, "missing.pem")}, "unable to read CA file: open " + filepath.Join(dir, "missing.pem") + ": no such file or directory"},
+		{UpstreamTLS{CAFile: garbage}, "no certificates found in CA file " + garbage},
+		{UpstreamTLS{CertFile: certFile}, "client certificates require both a cert file and a key file"},
+		{UpstreamTLS{CertFile: certFile, KeyFile: garbage}, "unable to load client certificate " + certFile + ": tls: failed to find any PEM data in key input"},
+	}
+	for _, tt := range tests {
+		if _, err := tt.tls.ClientConfig(); err == nil || err.Error() != tt.expected {
+			t.Errorf("Expected error %q, was %v", tt.expected, err)
+		}
+	}
+	if _, err := (UpstreamTLS{CertFile: certFile, KeyFile: keyFile}).ClientConfig(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	_, _, err = loadConfigFromYAML([]byte("sites:\n  - name: test\n    upstream: https://a.com\n    transport:\n      tls:\n        min_version: \"1.5\""))
+	expected := "error loading config: invalid TLS version '1.5', should be one of (1.0, 1.1, 1.2, 1.3)"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected error %q, was %v", expected, err)
+	}
+}
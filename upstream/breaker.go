@@ -0,0 +1,345 @@
+package upstream
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults used for zero values in BreakerSettings.
+const (
+	DefaultBreakerWindow           = 10 * time.Second
+	DefaultBreakerMinRequests      = 20
+	DefaultBreakerErrorRate        = 0.5
+	DefaultBreakerOpenTimeout      = 30 * time.Second
+	DefaultBreakerHalfOpenRequests = 1
+)
+
+// breakerBuckets is the number of buckets the window is divided into. Counts
+// expire a bucket at a time.
+const breakerBuckets = 10
+
+// BreakerSettings specifies when a circuit breaker should trip. Zero values are
+// replaced with defaults. If neither ErrorRate nor ErrorCount is set, the
+// breaker trips at an error rate of DefaultBreakerErrorRate.
+type BreakerSettings struct {
+	// Window is the period over which failed requests, connection errors or 5xx
+	// responses, are counted.
+	Window time.Duration
+
+	// ErrorRate, between 0 and 1, trips the breaker when that fraction of
+	// requests within the window fail. Only applies once the window contains
+	// MinRequests requests.
+	ErrorRate float64
+
+	// MinRequests is the number of requests needed in the window before
+	// ErrorRate is considered.
+	MinRequests int
+
+	// ErrorCount trips the breaker when that many requests fail within the
+	// window.
+	ErrorCount int
+
+	// OpenTimeout is how long the breaker stays open before letting probe
+	// requests through.
+	OpenTimeout time.Duration
+
+	// HalfOpenRequests is the number of probe requests that must succeed to close
+	// the breaker. Any failing probe reopens it.
+	HalfOpenRequests int
+}
+
+func (b BreakerSettings) withDefaults() BreakerSettings {
+	if b.Window == 0 {
+		b.Window = DefaultBreakerWindow
+	}
+	if b.ErrorRate == 0 && b.ErrorCount == 0 {
+		b.ErrorRate = DefaultBreakerErrorRate
+	}
+	if b.MinRequests == 0 {
+		b.MinRequests = DefaultBreakerMinRequests
+	}
+	if b.OpenTimeout == 0 {
+		b.OpenTimeout = DefaultBreakerOpenTimeout
+	}
+	if b.HalfOpenRequests == 0 {
+		b.HalfOpenRequests = DefaultBreakerHalfOpenRequests
+	}
+	return b
+}
+
+// Breaker states.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// CircuitBreaker returns a Source that wraps each upstream in a circuit
+// breaker. While an upstream's breaker is open it is left out of All(), so
+// traffic is routed to the others, or fails fast if every breaker is open.
+// After OpenTimeout the breaker half-opens, and lets HalfOpenRequests probes
+// through to decide whether to close again. Probes are reserved via Reserve
+// when an upstream is picked, and results are fed back via Report.
+// Example use:
+//
+//	cfg.Upstream(RoundRobin(CircuitBreaker(FixedSet(
+//	  "http://back-1.test.com",
+//	  "http://back-2.test.com",
+//	), BreakerSettings{ErrorRate: 0.25, Window: time.Minute})))
+func CircuitBreaker(source Source, settings BreakerSettings) *Breaker {
+	return &Breaker{
+		Source:   source,
+		settings: settings.withDefaults(),
+		state:    map[string]*breakerState{},
+		now:      time.Now,
+	}
+}
+
+// Breaker is a Source that stops sending requests to upstreams that are
+// failing.
+type Breaker struct {
+	Source
+
+	settings BreakerSettings
+	state    map[string]*breakerState
+	trips    int64
+	now      func() time.Time
+	mu       sync.Mutex
+}
+
+type breakerState struct {
+	state    string
+	trips    int
+	openedAt time.Time
+	probes   int
+	passed   int
+	window   [breakerBuckets]breakerBucket
+}
+
+type breakerBucket struct {
+	epoch    int64
+	requests int
+	failures int
+}
+
+// All returns upstreams from the underlying Source whose breakers are closed,
+// or ready to half-open with probes to spare. It doesn't change any breaker's
+// state, probes are only counted once an upstream is picked, see Reserve.
+func (b *Breaker) All() ([]*url.URL, error) {
+	urls, err := b.Source.All()
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	admitted := make([]*url.URL, 0, len(urls))
+	for _, u := range urls {
+		s, ok := b.state[u.String()]
+		if !ok || b.admits(s) {
+			admitted = append(admitted, u)
+		}
+	}
+	return admitted, nil
+}
+
+// admits must be called with b.mu held.
+func (b *Breaker) admits(s *breakerState) bool {
+	switch s.state {
+	case BreakerOpen:
+		return b.now().Sub(s.openedAt) >= b.settings.OpenTimeout
+	case BreakerHalfOpen:
+		return s.probes < b.settings.HalfOpenRequests
+	}
+	return true
+}
+
+// Reserve returns whether a request may be sent to u. Once OpenTimeout has
+// passed, an open breaker half-opens, and each request reserves one of its
+// HalfOpenRequests probes, which is given back by Report or Release.
+func (b *Breaker) Reserve(u *url.URL) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s, ok := b.state[u.String()]
+	if !ok {
+		return true
+	}
+	if !b.admits(s) {
+		return false
+	}
+	if s.state == BreakerOpen {
+		s.state, s.probes, s.passed = BreakerHalfOpen, 0, 0
+	}
+	if s.state == BreakerHalfOpen {
+		s.probes++
+	}
+	return true
+}
+
+// Release gives back a probe reserved by Reserve that won't be sent.
+func (b *Breaker) Release(u *url.URL) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if s, ok := b.state[u.String()]; ok && s.state == BreakerHalfOpen && s.probes > 0 {
+		s.probes--
+	}
+}
+
+// Report records the result of a request to u, opening or closing its breaker
+// as needed. Canceled requests are ignored, and give back their probe if the
+// breaker is half-open.
+func (b *Breaker) Report(u *url.URL, res Result) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := u.String()
+	s, ok := b.state[key]
+	if !ok {
+		s = &breakerState{state: BreakerClosed}
+		b.state[key] = s
+	}
+
+	switch s.state {
+	case BreakerOpen:
+		// Requests that were in flight when the breaker opened.
+		return
+
+	case BreakerHalfOpen:
+		if s.probes > 0 {
+			s.probes--
+		}
+		if res.Canceled {
+			// The probe is given back, as it says nothing about the upstream.
+			return
+		}
+		if res.Failed() {
+			b.trip(s)
+			return
+		}
+		s.passed++
+		if s.passed >= b.settings.HalfOpenRequests {
+			*s = breakerState{state: BreakerClosed, trips: s.trips}
+		}
+		return
+	}
+
+	if res.Canceled {
+		return
+	}
+	requests, failures := s.record(b.now(), b.bucketWidth(), res.Failed())
+	if !res.Failed() {
+		return
+	}
+	if b.settings.ErrorCount > 0 && failures >= b.settings.ErrorCount {
+		b.trip(s)
+	} else if b.settings.ErrorRate > 0 && requests >= b.settings.MinRequests &&
+		float64(failures)/float64(requests) >= b.settings.ErrorRate {
+		b.trip(s)
+	}
+}
+
+// trip must be called with b.mu held.
+func (b *Breaker) trip(s *breakerState) {
+	*s = breakerState{state: BreakerOpen, trips: s.trips + 1, openedAt: b.now()}
+	b.trips++
+}
+
+func (b *Breaker) bucketWidth() time.Duration {
+	w := b.settings.Window / breakerBuckets
+	if w <= 0 {
+		w = 1
+	}
+	return w
+}
+
+// record adds a result to the window, and returns the number of requests and
+// failures within it.
+func (s *breakerState) record(now time.Time, width time.Duration, failed bool) (int, int) {
+	epoch := now.UnixNano() / int64(width)
+	bucket := &s.window[epoch%breakerBuckets]
+	if bucket.epoch != epoch {
+		*bucket = breakerBucket{epoch: epoch}
+	}
+	bucket.requests++
+	if failed {
+		bucket.failures++
+	}
+
+	requests, failures := 0, 0
+	for _, bk := range s.window {
+		if bk.epoch > epoch-breakerBuckets {
+			requests += bk.requests
+			failures += bk.failures
+		}
+	}
+	return requests, failures
+}
+
+// State returns the state of u's breaker.
+func (b *Breaker) State(u *url.URL) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if s, ok := b.state[u.String()]; ok {
+		if s.state == BreakerOpen && b.now().Sub(s.openedAt) >= b.settings.OpenTimeout {
+			return BreakerHalfOpen
+		}
+		return s.state
+	}
+	return BreakerClosed
+}
+
+// Trips returns the number of times any breaker has opened.
+func (b *Breaker) Trips() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.trips
+}
+
+// Open returns the number of upstreams whose breaker is currently open.
+func (b *Breaker) Open() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := 0
+	for _, s := range b.state {
+		if s.state == BreakerOpen && b.now().Sub(s.openedAt) < b.settings.OpenTimeout {
+			n++
+		}
+	}
+	return n
+}
+
+// DebugInfo adds the state of each breaker to the underlying Source's debug
+// info.
+func (b *Breaker) DebugInfo() map[string]string {
+	m := b.Source.DebugInfo()
+	conds := []string{}
+	if b.settings.ErrorRate > 0 {
+		conds = append(conds, fmt.Sprintf("%.0f%% of at least %d requests", 100*b.settings.ErrorRate, b.settings.MinRequests))
+	}
+	if b.settings.ErrorCount > 0 {
+		conds = append(conds, fmt.Sprintf("%d errors", b.settings.ErrorCount))
+	}
+	m["breaker"] = fmt.Sprintf("opens at %s in %s", strings.Join(conds, " or "), b.settings.Window)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for u, s := range b.state {
+		state := s.state
+		if state == BreakerOpen {
+			if until := s.openedAt.Add(b.settings.OpenTimeout); b.now().Before(until) {
+				state = fmt.Sprintf("open until %s", until.Format(time.Stamp))
+			} else {
+				state = BreakerHalfOpen
+			}
+		}
+		m["breaker "+u] = fmt.Sprintf("%s (%d trips)", state, s.trips)
+	}
+	return m
+}
+
+func (b *Breaker) sources() []Source {
+	return []Source{b.Source}
+}
@@ -0,0 +1,161 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerErrorCount(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	b := CircuitBreaker(FixedSet("http://back-1.test.com", "http://back-2.test.com"), BreakerSettings{
+		ErrorCount:       3,
+		Window:           10 * time.Second,
+		OpenTimeout:      30 * time.Second,
+		HalfOpenRequests: 2,
+	})
+	b.now = clock.now
+	back1 := mustURL("http://back-1.test.com")
+
+	check := func(msg string, expected ...string) {
+		urls, _ := b.All()
+		if actual := urlStrings(urls); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("%s: expected %v, was %v", msg, expected, actual)
+		}
+	}
+
+	// Failures outside of the window are forgotten.
+	b.Report(back1, Result{StatusCode: 503})
+	b.Report(back1, Result{StatusCode: 503})
+	clock.advance(11 * time.Second)
+	b.Report(back1, Result{Err: errors.New("connection refused")})
+	b.Report(back1, Result{StatusCode: 200})
+	check("two failures in window", "http://back-1.test.com", "http://back-2.test.com")
+
+	b.Report(back1, Result{StatusCode: 500})
+	b.Report(back1, Result{StatusCode: 500})
+	check("breaker open", "http://back-2.test.com")
+	if s := b.State(back1); s != BreakerOpen {
+		t.Errorf("Expected open breaker, was %s", s)
+	}
+	if b.Trips() != 1 || b.Open() != 1 {
+		t.Errorf("Expected 1 trip and 1 open breaker, was %d and %d", b.Trips(), b.Open())
+	}
+
+	// Once half-open, probes are let through until enough are in flight.
+	clock.advance(30 * time.Second)
+	check("half-open", "http://back-1.test.com", "http://back-2.test.com")
+	b.Reserve(back1)
+	check("one probe in flight", "http://back-1.test.com", "http://back-2.test.com")
+	b.Reserve(back1)
+	check("probes in flight", "http://back-2.test.com")
+
+	// A failing probe reopens the breaker.
+	b.Report(back1, Result{StatusCode: 200})
+	b.Report(back1, Result{StatusCode: 502})
+	check("reopened", "http://back-2.test.com")
+	if b.Trips() != 2 {
+		t.Errorf("Expected 2 trips, was %d", b.Trips())
+	}
+
+	// Enough successful probes close it.
+	clock.advance(30 * time.Second)
+	check("half-open again", "http://back-1.test.com", "http://back-2.test.com")
+	for i := 0; i < 2; i++ {
+		b.Reserve(back1)
+		b.Report(back1, Result{StatusCode: 200})
+	}
+	if s := b.State(back1); s != BreakerClosed {
+		t.Errorf("Expected closed breaker, was %s", s)
+	}
+	if info := b.DebugInfo()["breaker http://back-1.test.com"]; info != "closed (2 trips)" {
+		t.Errorf("Unexpected debug info, was %q", info)
+	}
+}
+
+func TestCircuitBreakerErrorRate(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	b := CircuitBreaker(FixedSet("http://back-1.test.com"), BreakerSettings{
+		ErrorRate:   0.5,
+		MinRequests: 4,
+	})
+	b.now = clock.now
+	back1 := mustURL("http://back-1.test.com")
+
+	// Not enough requests for the rate to apply.
+	b.Report(back1, Result{StatusCode: 500})
+	b.Report(back1, Result{StatusCode: 500})
+	b.Report(back1, Result{StatusCode: 200})
+	if s := b.State(back1); s != BreakerClosed {
+		t.Errorf("Expected closed breaker below min requests, was %s", s)
+	}
+
+	b.Report(back1, Result{StatusCode: 500})
+	if s := b.State(back1); s != BreakerOpen {
+		t.Errorf("Expected open breaker at 75%% errors, was %s", s)
+	}
+
+	// Every breaker open fails fast, rather than returning broken upstreams.
+	if urls, _ := b.All(); len(urls) != 0 {
+		t.Errorf("Expected no upstreams, was %v", urlStrings(urls))
+	}
+
+	expected := "opens at 50% of at least 4 requests in 10s"
+	if info := b.DebugInfo()["breaker"]; info != expected {
+		t.Errorf("Expected %q, was %q", expected, info)
+	}
+}
+
+func TestCircuitBreakerReservesProbes(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	b := CircuitBreaker(FixedSet("http://back-1.test.com"), BreakerSettings{
+		ErrorCount:       1,
+		OpenTimeout:      30 * time.Second,
+		HalfOpenRequests: 1,
+	})
+	b.now = clock.now
+	back1 := mustURL("http://back-1.test.com")
+	b.Report(back1, Result{StatusCode: 500})
+	clock.advance(30 * time.Second)
+
+	// Picking upstreams doesn't use up probes, only reserving them does, so
+	// concurrent requests can't all be let through.
+	p := Split(nil, SplitGroup{Name: "all", Percent: 100, Provider: RoundRobin(b)})
+	req, _ := http.NewRequest("GET", "http://test.com/", nil)
+	admitted := 0
+	for i := 0; i < 5; i++ {
+		u, err := p.Get(req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if u != nil && Reserve(p, u) {
+			admitted++
+		}
+	}
+	if admitted != 1 {
+		t.Errorf("Expected 1 probe to be admitted, was %d", admitted)
+	}
+	if urls, _ := b.All(); len(urls) != 0 {
+		t.Errorf("Expected no upstreams while probe in flight, was %v", urlStrings(urls))
+	}
+
+	// Unused reservations are given back, as are probes the client abandoned.
+	release(p, back1)
+	if !b.Reserve(back1) {
+		t.Errorf("Expected probe to be reserved after release")
+	}
+	b.Report(back1, Result{Err: context.Canceled, Canceled: true})
+	if s := b.State(back1); s != BreakerHalfOpen || b.Trips() != 1 {
+		t.Errorf("Expected canceled probe not to reopen the breaker, was %s after %d trips", s, b.Trips())
+	}
+	if !b.Reserve(back1) {
+		t.Errorf("Expected probe to be reserved after cancelation")
+	}
+	b.Report(back1, Result{StatusCode: 200})
+	if s := b.State(back1); s != BreakerClosed {
+		t.Errorf("Expected closed breaker, was %s", s)
+	}
+}
@@ -0,0 +1,200 @@
+package upstream
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultReplicas is the number of points each upstream gets on a hash ring.
+const DefaultReplicas = 160
+
+func init() {
+	RegisterBalancer("consistent_hash", func(s Source, settings map[string]string) (Provider, error) {
+		if err := checkSettings("consistent_hash", settings, "key", "replicas"); err != nil {
+			return nil, err
+		}
+		keySpec := "ip"
+		if k, ok := settings["key"]; ok {
+			keySpec = k
+		}
+		key, err := ParseKey(keySpec)
+		if err != nil {
+			return nil, err
+		}
+		replicas := DefaultReplicas
+		if r, ok := settings["replicas"]; ok {
+			ri, err := strconv.Atoi(r)
+			if err != nil || ri <= 0 {
+				return nil, fmt.Errorf("invalid replicas '%s', should be a positive integer", r)
+			}
+			replicas = ri
+		}
+		return ConsistentHash(s, key, replicas), nil
+	})
+}
+
+// KeyFn returns the value a request should be hashed on. An empty string means
+// the request has no key.
+type KeyFn func(req *http.Request) string
+
+// ClientIPKey hashes on the client's IP: the originating client in
+// X-Forwarded-For, or else RemoteAddr without its port, so that a client keeps
+// the same key across connections.
+func ClientIPKey(req *http.Request) string {
+	if xff := req.Header.Get("X-Forwarded-For"); xff != "" {
+		return strings.TrimSpace(strings.SplitN(xff, ",", 2)[0])
+	}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
+// PathKey hashes on the request path.
+func PathKey(req *http.Request) string {
+	return req.URL.Path
+}
+
+// HeaderKey returns a KeyFn that hashes on the value of a request header.
+func HeaderKey(name string) KeyFn {
+	return func(req *http.Request) string {
+		return req.Header.Get(name)
+	}
+}
+
+// CookieKey returns a KeyFn that hashes on the value of a cookie.
+func CookieKey(name string) KeyFn {
+	return func(req *http.Request) string {
+		if c, err := req.Cookie(name); err == nil {
+			return c.Value
+		}
+		return ""
+	}
+}
+
+// ParseKey returns a KeyFn from a string of the form "ip", "path",
+// "header:<name>" or "cookie:<name>".
+func ParseKey(spec string) (KeyFn, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	switch {
+	case spec == "ip":
+		return ClientIPKey, nil
+	case spec == "path":
+		return PathKey, nil
+	case len(parts) == 2 && parts[0] == "header" && parts[1] != "":
+		return HeaderKey(parts[1]), nil
+	case len(parts) == 2 && parts[0] == "cookie" && parts[1] != "":
+		return CookieKey(parts[1]), nil
+	}
+	return nil, fmt.Errorf("invalid key '%s', should be one of (ip, path, header:<name>, cookie:<name>)", spec)
+}
+
+// ConsistentHash returns a Provider that places upstreams on a hash ring, and
+// sends each request to the upstream that owns the hash of its key. When the
+// set of upstreams changes only keys owned by added or removed upstreams move.
+// Requests without a key are sent to a random upstream.
+func ConsistentHash(source Source, key KeyFn, replicas int) Provider {
+	if replicas <= 0 {
+		replicas = DefaultReplicas
+	}
+	return &consistentHashProvider{Source: source, key: key, replicas: replicas}
+}
+
+type consistentHashProvider struct {
+	Source
+	key      KeyFn
+	replicas int
+
+	ring *hashRing
+	mu   sync.Mutex
+}
+
+type hashRing struct {
+	id     string
+	points []uint64
+	owners []*url.URL
+}
+
+func (r *hashRing) Len() int           { return len(r.points) }
+func (r *hashRing) Less(i, j int) bool { return r.points[i] < r.points[j] }
+func (r *hashRing) Swap(i, j int) {
+	r.points[i], r.points[j] = r.points[j], r.points[i]
+	r.owners[i], r.owners[j] = r.owners[j], r.owners[i]
+}
+
+func (r *hashRing) lookup(key string) *url.URL {
+	h := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[i]
+}
+
+// hashKey uses SHA-1 rather than FNV, since FNV spreads similar strings, such
+// as an upstream's replicas, poorly around the ring.
+func hashKey(key string) uint64 {
+	sum := sha1.Sum([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+func (p *consistentHashProvider) Get(req *http.Request) (*url.URL, error) {
+	urls, err := p.All()
+	if err != nil {
+		return nil, err
+	}
+	if len(urls) == 0 {
+		return nil, nil
+	}
+
+	key := p.key(req)
+	if key == "" {
+		return urls[rand.Intn(len(urls))], nil
+	}
+	return p.ringFor(urls).lookup(key), nil
+}
+
+// ringFor returns a ring for urls, reusing the last ring if the set of
+// upstreams hasn't changed.
+func (p *consistentHashProvider) ringFor(urls []*url.URL) *hashRing {
+	strs := make([]string, len(urls))
+	for i, u := range urls {
+		strs[i] = u.String()
+	}
+	sort.Strings(strs)
+	id := strings.Join(strs, " ")
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ring != nil && p.ring.id == id {
+		return p.ring
+	}
+
+	r := &hashRing{
+		id:     id,
+		points: make([]uint64, 0, len(urls)*p.replicas),
+		owners: make([]*url.URL, 0, len(urls)*p.replicas),
+	}
+	for _, u := range urls {
+		for i := 0; i < p.replicas; i++ {
+			r.points = append(r.points, hashKey(u.String()+"#"+strconv.Itoa(i)))
+			r.owners = append(r.owners, u)
+		}
+	}
+	sort.Sort(r)
+	p.ring = r
+	return r
+}
+
+func (p *consistentHashProvider) sources() []Source {
+	return []Source{p.Source}
+}
@@ -0,0 +1,176 @@
+package upstream
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// mutableSet is a Source whose upstreams can be changed by tests.
+type mutableSet struct {
+	fixedSet
+}
+
+func newMutableSet(urls ...string) *mutableSet {
+	return &mutableSet{fixedSet{URLStrs: urls}}
+}
+
+func (m *mutableSet) set(urls ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.URLStrs = urls
+	m.urls = nil
+}
+
+func hashAll(t *testing.T, p Provider, n int) map[string]string {
+	owners := map[string]string{}
+	for i := 0; i < n; i++ {
+		req, _ := http.NewRequest("GET", "http://test.com/", nil)
+		req.Header.Set("X-User", fmt.Sprintf("user-%d", i))
+		u, err := p.Get(req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		owners[req.Header.Get("X-User")] = u.String()
+	}
+	return owners
+}
+
+func TestConsistentHashMinimalMovement(t *testing.T) {
+	set := newMutableSet("http://back-1", "http://back-2", "http://back-3", "http://back-4")
+	provider := ConsistentHash(set, HeaderKey("X-User"), 0)
+
+	const keys = 10000
+	before := hashAll(t, provider, keys)
+
+	counts := map[string]int{}
+	for _, u := range before {
+		counts[u]++
+	}
+	for u, c := range counts {
+		if c < keys/4/2 || c > keys/4*2 {
+			t.Errorf("Uneven distribution, %s owns %d of %d keys", u, c, keys)
+		}
+	}
+
+	// Adding a fifth upstream should move about 1/5 of keys, all to the new one.
+	set.set("http://back-1", "http://back-2", "http://back-3", "http://back-4", "http://back-5")
+	after := hashAll(t, provider, keys)
+	moved := 0
+	for k, u := range after {
+		if before[k] != u {
+			moved++
+			if u != "http://back-5" {
+				t.Fatalf("Key %s moved from %s to %s, expected only moves to back-5", k, before[k], u)
+			}
+		}
+	}
+	if moved > keys*3/10 || moved < keys/10 {
+		t.Errorf("Expected about 1/5 of keys to move, %d of %d did", moved, keys)
+	}
+
+	// Removing an upstream should only move keys it owned.
+	set.set("http://back-1", "http://back-2", "http://back-4", "http://back-5")
+	removed := hashAll(t, provider, keys)
+	for k, u := range removed {
+		if after[k] != u && after[k] != "http://back-3" {
+			t.Fatalf("Key %s moved from %s to %s, but %s wasn't removed", k, after[k], u, after[k])
+		}
+	}
+}
+
+func TestConsistentHashKeys(t *testing.T) {
+	provider := ConsistentHash(FixedSet("http://back-1", "http://back-2", "http://back-3"), CookieKey("session"), 10)
+
+	req, _ := http.NewRequest("GET", "http://test.com/", nil)
+	req.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+	first, _ := provider.Get(req)
+	for i := 0; i < 10; i++ {
+		if u, _ := provider.Get(req); u.String() != first.String() {
+			t.Fatalf("Expected same cookie to hash to %s, was %s", first, u)
+		}
+	}
+
+	// Requests without a key still get an upstream.
+	req, _ = http.NewRequest("GET", "http://test.com/", nil)
+	if u, err := provider.Get(req); u == nil || err != nil {
+		t.Errorf("Expected an upstream for request without a key, was %v %v", u, err)
+	}
+}
+
+func TestClientIPKey(t *testing.T) {
+	provider := ConsistentHash(FixedSet("http://back-1", "http://back-2", "http://back-3"), ClientIPKey, 10)
+
+	// The same client maps to the same upstream across connections, and
+	// whichever proxies its requests pass through.
+	var tests = []struct {
+		remoteAddr string
+		xff        string
+		expected   string
+	}{
+		{"10.0.0.1:51234", "", "10.0.0.1"},
+		{"10.0.0.1:40000", "", "10.0.0.1"},
+		{"[2001:db8::1]:51234", "", "2001:db8::1"},
+		{"10.0.0.1", "", "10.0.0.1"},
+		{"10.0.0.2:1234", "192.0.2.1", "192.0.2.1"},
+		{"10.0.0.3:5678", "192.0.2.1, 10.0.0.2", "192.0.2.1"},
+	}
+	hashed := map[string]string{}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", "http://test.com/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		if tt.xff != "" {
+			req.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		if actual := ClientIPKey(req); actual != tt.expected {
+			t.Errorf("%s %q => %q, want %q", tt.remoteAddr, tt.xff, actual, tt.expected)
+		}
+		u, _ := provider.Get(req)
+		if prev, ok := hashed[tt.expected]; ok && prev != u.String() {
+			t.Errorf("Expected %s to stay on %s, was %s", tt.expected, prev, u)
+		}
+		hashed[tt.expected] = u.String()
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://test.com/some/path", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Tenant", "acme")
+	req.AddCookie(&http.Cookie{Name: "user", Value: "bob"})
+
+	var tests = []struct {
+		spec     string
+		expected string
+	}{
+		{"ip", "10.0.0.1"},
+		{"path", "/some/path"},
+		{"header:X-Tenant", "acme"},
+		{"cookie:user", "bob"},
+	}
+	for _, tt := range tests {
+		key, err := ParseKey(tt.spec)
+		if err != nil {
+			t.Errorf("Unexpected error parsing %s: %s", tt.spec, err)
+			continue
+		}
+		if actual := key(req); actual != tt.expected {
+			t.Errorf("Key %s => %q, want %q", tt.spec, actual, tt.expected)
+		}
+	}
+
+	for _, spec := range []string{"", "header", "header:", "query:foo"} {
+		if _, err := ParseKey(spec); err == nil {
+			t.Errorf("Expected error parsing %q", spec)
+		}
+	}
+}
+
+func TestConsistentHashBalancer(t *testing.T) {
+	if _, err := GetBalancer("consistent_hash", FixedSet("http://back-1"), map[string]string{"key": "cookie:id", "replicas": "50"}); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if _, err := GetBalancer("consistent_hash", FixedSet("http://back-1"), map[string]string{"replicas": "-1"}); err == nil {
+		t.Error("Expected error for negative replicas")
+	}
+}
@@ -144,7 +144,7 @@ func (ds *DNS) maybeRefresh() {
 		}
 		ds.addrs[i] = &url.URL{
 			Scheme: scheme,
-			Host:   fmt.Sprintf("%s:%d", addr, ds.Port),
+			Host:   net.JoinHostPort(addr, strconv.Itoa(int(ds.Port))),
 			Path:   ds.Path,
 		}
 	}
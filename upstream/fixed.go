@@ -18,16 +18,43 @@ func FixedSet(urlStrs ...string) Source {
 	return &fixedSet{URLStrs: urlStrs}
 }
 
+// WeightedURL is an upstream URL along with its relative weight.
+type WeightedURL struct {
+	URL    string
+	Weight int
+}
+
+// WeightedSet returns an upstream source like FixedSet, where each URL has a
+// weight that balancers such as WeightedRoundRobin use to skew traffic towards
+// larger instances. Weights must be positive.
+// Example use:
+//     cfg.Upstream(WeightedRoundRobin(WeightedSet(
+//       WeightedURL{"http://back-1.test.com", 3},
+//       WeightedURL{"http://back-2.test.com", 1},
+//     )))
+func WeightedSet(urls ...WeightedURL) Source {
+	set := &fixedSet{URLStrs: make([]string, len(urls)), weights: map[string]int{}}
+	for i, wu := range urls {
+		set.URLStrs[i] = wu.URL
+		set.weights[wu.URL] = wu.Weight
+	}
+	return set
+}
+
 type fixedSet struct {
 	URLStrs []string
 
-	urls []*url.URL
-	err  error
-	mu   sync.Mutex
+	weights map[string]int
+	byURL   map[string]int
+	urls    []*url.URL
+	err     error
+	mu      sync.Mutex
 }
 
 // DebugInfo returns whether the set is in an error state.
 func (ru *fixedSet) DebugInfo() map[string]string {
+	ru.mu.Lock()
+	defer ru.mu.Unlock()
 	m := map[string]string{}
 	if ru.err != nil {
 		m["error"] = ru.err.Error()
@@ -37,27 +64,44 @@ func (ru *fixedSet) DebugInfo() map[string]string {
 
 // All returns all upsteams.
 func (ru *fixedSet) All() ([]*url.URL, error) {
+	ru.mu.Lock()
+	defer ru.mu.Unlock()
 	if ru.urls == nil && ru.err == nil {
 		ru.parseURLs()
 	}
 	return ru.urls, ru.err
 }
 
-func (ru *fixedSet) parseURLs() {
+// Weight returns the weight of u, upstreams without an explicit weight have a
+// weight of 1.
+func (ru *fixedSet) Weight(u *url.URL) int {
 	ru.mu.Lock()
 	defer ru.mu.Unlock()
-	if ru.urls != nil || ru.err != nil {
-		// Calculation done in a racing thread.
-		return
+	if w, ok := ru.byURL[u.String()]; ok {
+		return w
 	}
+	return 1
+}
+
+// parseURLs must be called with ru.mu held.
+func (ru *fixedSet) parseURLs() {
 	urls := make([]*url.URL, len(ru.URLStrs))
+	byURL := map[string]int{}
 	for i, urlStr := range ru.URLStrs {
 		u, err := url.Parse(string(urlStr))
 		if err != nil {
 			ru.err = fmt.Errorf("unable to parse '%s': %s", urlStr, err)
 			return
 		}
+		if w, ok := ru.weights[urlStr]; ok {
+			if w <= 0 {
+				ru.err = fmt.Errorf("invalid weight %d for '%s', should be positive", w, urlStr)
+				return
+			}
+			byURL[u.String()] = w
+		}
 		urls[i] = u
 	}
 	ru.urls = urls
+	ru.byURL = byURL
 }
@@ -0,0 +1,275 @@
+package upstream
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Defaults used for zero values in a HealthCheck.
+const (
+	DefaultHealthCheckPath     = "/"
+	DefaultHealthCheckStatus   = http.StatusOK
+	DefaultHealthCheckInterval = 10 * time.Second
+	DefaultHealthCheckTimeout  = 2 * time.Second
+	DefaultHealthyThreshold    = 2
+	DefaultUnhealthyThreshold  = 3
+)
+
+// maxHealthErrorLength truncates errors shown on debug pages.
+const maxHealthErrorLength = 100
+
+// HealthCheck specifies how upstreams should be actively probed. Zero values
+// are replaced with defaults.
+type HealthCheck struct {
+	// Path requested from each upstream, replacing any path in the upstream URL.
+	Path string
+
+	// Host optionally overrides the Host header sent with checks, by default the
+	// upstream's host is used.
+	Host string
+
+	// ExpectedStatus is the status code a healthy upstream responds with.
+	ExpectedStatus int
+
+	// Interval between checks.
+	Interval time.Duration
+
+	// Timeout for an individual check.
+	Timeout time.Duration
+
+	// HealthyThreshold is the number of consecutive successful checks needed
+	// before an unhealthy upstream is returned to rotation.
+	HealthyThreshold int
+
+	// UnhealthyThreshold is the number of consecutive failed checks before an
+	// upstream is removed from rotation.
+	UnhealthyThreshold int
+
+	// Transport used to make checks, so they connect to upstreams the same way
+	// proxied requests do. If nil, http.DefaultTransport is used.
+	Transport http.RoundTripper
+}
+
+func (c HealthCheck) withDefaults() HealthCheck {
+	if c.Path == "" {
+		c.Path = DefaultHealthCheckPath
+	}
+	if c.ExpectedStatus == 0 {
+		c.ExpectedStatus = DefaultHealthCheckStatus
+	}
+	if c.Interval == 0 {
+		c.Interval = DefaultHealthCheckInterval
+	}
+	if c.Timeout == 0 {
+		c.Timeout = DefaultHealthCheckTimeout
+	}
+	if c.HealthyThreshold == 0 {
+		c.HealthyThreshold = DefaultHealthyThreshold
+	}
+	if c.UnhealthyThreshold == 0 {
+		c.UnhealthyThreshold = DefaultUnhealthyThreshold
+	}
+	return c
+}
+
+// HealthChecked returns a Source that periodically checks each upstream in
+// source, and only returns healthy upstreams from All(). Upstreams are
+// considered healthy until they have failed enough checks. Checks start on the
+// first call to All() and continue until Stop() is called.
+// Example use:
+//
+//	cfg.Upstream(RoundRobin(HealthChecked(FixedSet(
+//	  "http://back-1.test.com",
+//	  "http://back-2.test.com",
+//	), HealthCheck{Path: "/healthz"})))
+func HealthChecked(source Source, check HealthCheck) *HealthChecker {
+	check = check.withDefaults()
+	return &HealthChecker{
+		Source: source,
+		check:  check,
+		client: &http.Client{Timeout: check.Timeout, Transport: check.Transport},
+		health: map[string]*upstreamHealth{},
+		stop:   make(chan struct{}),
+	}
+}
+
+// HealthChecker is a Source that filters out upstreams that are failing
+// active health checks.
+type HealthChecker struct {
+	Source
+
+	check  HealthCheck
+	client *http.Client
+	health map[string]*upstreamHealth
+	mu     sync.RWMutex
+
+	start    sync.Once
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+type upstreamHealth struct {
+	healthy   bool
+	successes int
+	failures  int
+	lastError string
+	lastCheck time.Time
+}
+
+func (h *upstreamHealth) String() string {
+	if h.healthy {
+		return fmt.Sprintf("healthy, checked at %s", h.lastCheck.Format(time.Stamp))
+	}
+	return fmt.Sprintf("unhealthy (%d failures: %s), checked at %s",
+		h.failures, h.lastError, h.lastCheck.Format(time.Stamp))
+}
+
+// All returns the upstreams from the underlying Source that are healthy.
+func (hc *HealthChecker) All() ([]*url.URL, error) {
+	hc.start.Do(func() { go hc.loop() })
+
+	urls, err := hc.Source.All()
+	if err != nil {
+		return nil, err
+	}
+
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+	healthy := make([]*url.URL, 0, len(urls))
+	for _, u := range urls {
+		if h, ok := hc.health[u.String()]; !ok || h.healthy {
+			healthy = append(healthy, u)
+		}
+	}
+	return healthy, nil
+}
+
+// DebugInfo adds the health of each upstream to the underlying Source's
+// debug info.
+func (hc *HealthChecker) DebugInfo() map[string]string {
+	m := hc.Source.DebugInfo()
+	m["health check"] = fmt.Sprintf("GET %s expecting %d every %s",
+		hc.check.Path, hc.check.ExpectedStatus, hc.check.Interval)
+
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+	for u, h := range hc.health {
+		m["health "+u] = h.String()
+	}
+	return m
+}
+
+// Stop ends the background checks.
+func (hc *HealthChecker) Stop() {
+	hc.stopOnce.Do(func() { close(hc.stop) })
+}
+
+func (hc *HealthChecker) sources() []Source {
+	return []Source{hc.Source}
+}
+
+func (hc *HealthChecker) loop() {
+	t := time.NewTicker(hc.check.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-hc.stop:
+			return
+		default:
+		}
+		hc.checkAll()
+		select {
+		case <-hc.stop:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// checkAll checks every upstream in parallel, and waits for the results.
+func (hc *HealthChecker) checkAll() {
+	urls, err := hc.Source.All()
+	if err != nil {
+		// Errors in the underlying source are surfaced by All().
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, u := range urls {
+		wg.Add(1)
+		go func(u *url.URL) {
+			defer wg.Done()
+			hc.record(u.String(), hc.checkOne(u))
+		}(u)
+	}
+	wg.Wait()
+
+	// Forget upstreams that are no longer in the source.
+	current := map[string]bool{}
+	for _, u := range urls {
+		current[u.String()] = true
+	}
+	hc.mu.Lock()
+	for k := range hc.health {
+		if !current[k] {
+			delete(hc.health, k)
+		}
+	}
+	hc.mu.Unlock()
+}
+
+func (hc *HealthChecker) checkOne(u *url.URL) error {
+	checkURL := &url.URL{Scheme: u.Scheme, Host: u.Host, Path: hc.check.Path}
+	req, err := http.NewRequest("GET", checkURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "locus-healthcheck")
+	if hc.check.Host != "" {
+		req.Host = hc.check.Host
+	}
+
+	res, err := hc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != hc.check.ExpectedStatus {
+		return fmt.Errorf("status %d", res.StatusCode)
+	}
+	return nil
+}
+
+func (hc *HealthChecker) record(key string, err error) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	h, ok := hc.health[key]
+	if !ok {
+		h = &upstreamHealth{healthy: true}
+		hc.health[key] = h
+	}
+	h.lastCheck = time.Now()
+
+	if err == nil {
+		h.successes++
+		h.failures = 0
+		if !h.healthy && h.successes >= hc.check.HealthyThreshold {
+			h.healthy = true
+		}
+		return
+	}
+
+	h.failures++
+	h.successes = 0
+	h.lastError = err.Error()
+	if len(h.lastError) > maxHealthErrorLength {
+		h.lastError = h.lastError[:maxHealthErrorLength] + "..."
+	}
+	if h.healthy && h.failures >= hc.check.UnhealthyThreshold {
+		h.healthy = false
+	}
+}
@@ -0,0 +1,116 @@
+package upstream
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// manualHealthChecked returns a health checker that doesn't check in the
+// background, so tests can control when checks happen via checkAll().
+func manualHealthChecked(source Source, check HealthCheck) *HealthChecker {
+	hc := HealthChecked(source, check)
+	hc.start.Do(func() {})
+	return hc
+}
+
+func TestHealthChecked(t *testing.T) {
+	var status int32 = http.StatusOK
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			t.Errorf("Unexpected health check path %s", r.URL.Path)
+		}
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer flaky.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer healthy.Close()
+
+	hc := manualHealthChecked(FixedSet(flaky.URL+"/some/path", healthy.URL), HealthCheck{
+		Path:               "/healthz",
+		HealthyThreshold:   2,
+		UnhealthyThreshold: 2,
+	})
+
+	// Before any checks have run everything is considered healthy.
+	if urls, _ := hc.All(); len(urls) != 2 {
+		t.Fatalf("Expected 2 upstreams before checks, was %v", urls)
+	}
+
+	atomic.StoreInt32(&status, http.StatusInternalServerError)
+	hc.checkAll()
+	if urls, _ := hc.All(); len(urls) != 2 {
+		t.Errorf("Expected flaky upstream to remain after one failure, was %v", urls)
+	}
+	hc.checkAll()
+	if urls, _ := hc.All(); len(urls) != 1 || urls[0].String() != healthy.URL {
+		t.Errorf("Expected only healthy upstream after two failures, was %v", urls)
+	}
+
+	info := hc.DebugInfo()
+	if h := info["health "+flaky.URL+"/some/path"]; !strings.HasPrefix(h, "unhealthy (2 failures: status 500)") {
+		t.Errorf("Unexpected debug info for flaky upstream, was %q", h)
+	}
+	if h := info["health "+healthy.URL]; !strings.HasPrefix(h, "healthy") {
+		t.Errorf("Unexpected debug info for healthy upstream, was %q", h)
+	}
+
+	atomic.StoreInt32(&status, http.StatusOK)
+	hc.checkAll()
+	if urls, _ := hc.All(); len(urls) != 1 {
+		t.Errorf("Expected flaky upstream to stay out of rotation after one success, was %v", urls)
+	}
+	hc.checkAll()
+	if urls, _ := hc.All(); len(urls) != 2 {
+		t.Errorf("Expected flaky upstream back in rotation after two successes, was %v", urls)
+	}
+}
+
+func TestHealthCheckConnectionRefused(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+
+	hc := manualHealthChecked(FixedSet(down.URL), HealthCheck{UnhealthyThreshold: 1})
+	hc.checkAll()
+
+	if urls, err := hc.All(); err != nil || len(urls) != 0 {
+		t.Errorf("Expected no healthy upstreams, was %v %v", urls, err)
+	}
+}
+
+func TestStopWalksProviders(t *testing.T) {
+	hc := HealthChecked(FixedSet("http://back-1.test.com"), HealthCheck{})
+	provider := RoundRobin(hc)
+	Stop(provider)
+
+	select {
+	case <-hc.stop:
+	default:
+		t.Error("Expected health checker to be stopped via provider")
+	}
+
+	// Stopping twice is safe.
+	Stop(provider)
+}
+
+func TestHealthCheckRunsInBackground(t *testing.T) {
+	checked := make(chan bool, 10)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checked <- true
+	}))
+	defer backend.Close()
+
+	hc := HealthChecked(FixedSet(backend.URL), HealthCheck{Interval: 10 * time.Millisecond})
+	hc.All()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-checked:
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for background check")
+		}
+	}
+	hc.Stop()
+}
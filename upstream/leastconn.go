@@ -0,0 +1,89 @@
+package upstream
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+func init() {
+	RegisterBalancer("least_conn", func(s Source, settings map[string]string) (Provider, error) {
+		return LeastConn(s), checkSettings("least_conn", settings)
+	})
+}
+
+// LeastConn returns a Provider that picks the upstream with the fewest requests
+// in flight. Ties are broken by cycling through the upstreams. In flight
+// requests are tracked via Start and Report, which Locus calls for every
+// proxied request.
+func LeastConn(source Source) Provider {
+	return &leastConnProvider{Source: source, inFlight: map[string]int{}}
+}
+
+type leastConnProvider struct {
+	Source
+
+	inFlight map[string]int
+	next     int
+	mu       sync.Mutex
+}
+
+func (p *leastConnProvider) Get(req *http.Request) (*url.URL, error) {
+	urls, err := p.All()
+	if err != nil {
+		return nil, err
+	}
+	if len(urls) == 0 {
+		return nil, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	offset := p.next % len(urls)
+	p.next++
+
+	var best *url.URL
+	bestCount := -1
+	for i := range urls {
+		u := urls[(offset+i)%len(urls)]
+		if c := p.inFlight[u.String()]; bestCount == -1 || c < bestCount {
+			best, bestCount = u, c
+		}
+	}
+	return best, nil
+}
+
+// Start records that a request is in flight to u.
+func (p *leastConnProvider) Start(u *url.URL) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.inFlight[u.String()]++
+}
+
+// Report records that a request to u has completed.
+func (p *leastConnProvider) Report(u *url.URL, res Result) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := u.String()
+	if p.inFlight[key] <= 1 {
+		delete(p.inFlight, key)
+	} else {
+		p.inFlight[key]--
+	}
+}
+
+// DebugInfo adds in flight request counts to the Source's debug info.
+func (p *leastConnProvider) DebugInfo() map[string]string {
+	m := p.Source.DebugInfo()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for u, c := range p.inFlight {
+		m["in flight "+u] = fmt.Sprintf("%d", c)
+	}
+	return m
+}
+
+func (p *leastConnProvider) sources() []Source {
+	return []Source{p.Source}
+}
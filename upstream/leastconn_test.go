@@ -0,0 +1,47 @@
+package upstream
+
+import (
+	"testing"
+)
+
+func TestLeastConn(t *testing.T) {
+	provider := LeastConn(FixedSet(
+		"back-1.test.com",
+		"back-2.test.com",
+		"back-3.test.com",
+	))
+
+	get := func() string {
+		u, err := provider.Get(nil)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		Start(provider, u)
+		return u.String()
+	}
+
+	// With nothing in flight, upstreams are cycled through.
+	first, second, third := get(), get(), get()
+	if first == second || second == third || first == third {
+		t.Fatalf("Expected each upstream to be used once, got %s, %s, %s", first, second, third)
+	}
+
+	// Complete the requests to two upstreams, they should be preferred.
+	Report(provider, mustURL(first), Result{StatusCode: 200})
+	Report(provider, mustURL(third), Result{StatusCode: 200})
+	Report(provider, mustURL(third), Result{StatusCode: 200}) // Extra reports are harmless.
+	if u1, u2 := get(), get(); u1 == second || u2 == second || u1 == u2 {
+		t.Errorf("Expected idle upstreams to be picked before %s, got %s and %s", second, u1, u2)
+	}
+
+	if c := provider.DebugInfo()["in flight "+second]; c != "1" {
+		t.Errorf("Expected 1 request in flight to %s, was %q", second, c)
+	}
+}
+
+func TestLeastConnEmpty(t *testing.T) {
+	provider := LeastConn(FixedSet())
+	if u, err := provider.Get(nil); u != nil || err != nil {
+		t.Errorf("Expected no upstream, was %v %v", u, err)
+	}
+}
@@ -0,0 +1,171 @@
+package upstream
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Defaults used for zero values in OutlierDetection.
+const (
+	DefaultConsecutiveFailures = 5
+	DefaultBaseEjectionTime    = 30 * time.Second
+	DefaultMaxEjectionTime     = 5 * time.Minute
+)
+
+// OutlierDetection specifies when upstreams should be passively ejected, based
+// on the results of proxied requests. Zero values are replaced with defaults.
+type OutlierDetection struct {
+	// ConsecutiveFailures is the number of failed requests, connection errors or
+	// 5xx responses, in a row before an upstream is ejected.
+	ConsecutiveFailures int
+
+	// BaseEjectionTime is how long an upstream is ejected for the first time.
+	// Each subsequent ejection doubles the time.
+	BaseEjectionTime time.Duration
+
+	// MaxEjectionTime caps how long an upstream can be ejected for.
+	MaxEjectionTime time.Duration
+}
+
+func (o OutlierDetection) withDefaults() OutlierDetection {
+	if o.ConsecutiveFailures == 0 {
+		o.ConsecutiveFailures = DefaultConsecutiveFailures
+	}
+	if o.BaseEjectionTime == 0 {
+		o.BaseEjectionTime = DefaultBaseEjectionTime
+	}
+	if o.MaxEjectionTime == 0 {
+		o.MaxEjectionTime = DefaultMaxEjectionTime
+	}
+	return o
+}
+
+// EjectOutliers returns a Source that temporarily removes upstreams from All()
+// after they fail ConsecutiveFailures requests in a row. Results are fed back
+// via Report. If every upstream is ejected, all are returned, on the basis
+// that a degraded upstream is better than none.
+// Example use:
+//
+//	cfg.Upstream(RoundRobin(EjectOutliers(FixedSet(
+//	  "http://back-1.test.com",
+//	  "http://back-2.test.com",
+//	), OutlierDetection{ConsecutiveFailures: 3})))
+func EjectOutliers(source Source, od OutlierDetection) *OutlierDetector {
+	return &OutlierDetector{
+		Source: source,
+		od:     od.withDefaults(),
+		state:  map[string]*outlierState{},
+		now:    time.Now,
+	}
+}
+
+// OutlierDetector is a Source that filters out upstreams that have recently
+// been failing requests.
+type OutlierDetector struct {
+	Source
+
+	od    OutlierDetection
+	state map[string]*outlierState
+	now   func() time.Time
+	mu    sync.Mutex
+}
+
+type outlierState struct {
+	failures     int
+	ejections    int
+	ejectedFor   time.Duration
+	ejectedUntil time.Time
+}
+
+// All returns upstreams from the underlying Source that aren't ejected.
+func (od *OutlierDetector) All() ([]*url.URL, error) {
+	urls, err := od.Source.All()
+	if err != nil {
+		return nil, err
+	}
+
+	od.mu.Lock()
+	defer od.mu.Unlock()
+	now := od.now()
+	admitted := make([]*url.URL, 0, len(urls))
+	for _, u := range urls {
+		if s, ok := od.state[u.String()]; !ok || !now.Before(s.ejectedUntil) {
+			admitted = append(admitted, u)
+		}
+	}
+	if len(admitted) == 0 {
+		return urls, nil
+	}
+	return admitted, nil
+}
+
+// Report records the result of a request to u, ejecting it if it has failed
+// too many requests in a row. Canceled requests are ignored.
+func (od *OutlierDetector) Report(u *url.URL, res Result) {
+	if res.Canceled {
+		return
+	}
+	od.mu.Lock()
+	defer od.mu.Unlock()
+
+	key := u.String()
+	s, ok := od.state[key]
+	if !ok {
+		if !res.Failed() {
+			return
+		}
+		s = &outlierState{}
+		od.state[key] = s
+	}
+
+	now := od.now()
+	if now.Before(s.ejectedUntil) {
+		// Requests that were in flight when the upstream was ejected.
+		return
+	}
+
+	if !res.Failed() {
+		s.failures = 0
+		// Once an upstream has stayed healthy for as long as it was last ejected,
+		// forget about prior ejections.
+		if !now.Before(s.ejectedUntil.Add(s.ejectedFor)) {
+			delete(od.state, key)
+		}
+		return
+	}
+
+	s.failures++
+	if s.failures >= od.od.ConsecutiveFailures {
+		s.failures = 0
+		s.ejections++
+		s.ejectedFor = od.od.BaseEjectionTime << uint(s.ejections-1)
+		if s.ejectedFor > od.od.MaxEjectionTime || s.ejectedFor <= 0 {
+			s.ejectedFor = od.od.MaxEjectionTime
+		}
+		s.ejectedUntil = now.Add(s.ejectedFor)
+	}
+}
+
+// DebugInfo adds ejection state to the underlying Source's debug info.
+func (od *OutlierDetector) DebugInfo() map[string]string {
+	m := od.Source.DebugInfo()
+
+	od.mu.Lock()
+	defer od.mu.Unlock()
+	now := od.now()
+	for u, s := range od.state {
+		if now.Before(s.ejectedUntil) {
+			m["outlier "+u] = fmt.Sprintf("ejected until %s (ejection #%d)",
+				s.ejectedUntil.Format(time.Stamp), s.ejections)
+		} else {
+			m["outlier "+u] = fmt.Sprintf("%d consecutive failures", s.failures)
+		}
+	}
+	return m
+}
+
+func (od *OutlierDetector) sources() []Source {
+	return []Source{od.Source}
+}
@@ -0,0 +1,123 @@
+package upstream
+
+import (
+	"errors"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func mustURL(s string) *url.URL {
+	u, err := url.Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return u
+}
+
+func urlStrings(urls []*url.URL) []string {
+	strs := make([]string, len(urls))
+	for i, u := range urls {
+		strs[i] = u.String()
+	}
+	return strs
+}
+
+func TestEjectOutliers(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	od := EjectOutliers(FixedSet("http://back-1.test.com", "http://back-2.test.com"), OutlierDetection{
+		ConsecutiveFailures: 2,
+		BaseEjectionTime:    10 * time.Second,
+		MaxEjectionTime:     30 * time.Second,
+	})
+	od.now = clock.now
+
+	back1 := mustURL("http://back-1.test.com")
+	both := []string{"http://back-1.test.com", "http://back-2.test.com"}
+	onlyBack2 := []string{"http://back-2.test.com"}
+
+	check := func(msg string, expected []string) {
+		urls, err := od.All()
+		if err != nil {
+			t.Fatalf("%s: unexpected error %s", msg, err)
+		}
+		if actual := urlStrings(urls); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("%s: expected %v, was %v", msg, expected, actual)
+		}
+	}
+
+	// A success between failures resets the count.
+	od.Report(back1, Result{Err: errors.New("connection refused")})
+	od.Report(back1, Result{StatusCode: 200})
+	od.Report(back1, Result{StatusCode: 502})
+	check("non-consecutive failures", both)
+
+	// 4xx responses aren't failures.
+	od.Report(back1, Result{StatusCode: 404})
+	check("4xx response", both)
+
+	od.Report(back1, Result{StatusCode: 503})
+	od.Report(back1, Result{StatusCode: 503})
+	check("first ejection", onlyBack2)
+
+	clock.advance(9 * time.Second)
+	check("during first ejection", onlyBack2)
+
+	clock.advance(time.Second)
+	check("after first ejection", both)
+
+	// Failing again straight away doubles the ejection time.
+	od.Report(back1, Result{StatusCode: 500})
+	od.Report(back1, Result{StatusCode: 500})
+	clock.advance(19 * time.Second)
+	check("during second ejection", onlyBack2)
+	clock.advance(time.Second)
+	check("after second ejection", both)
+
+	// Ejection time is capped.
+	od.Report(back1, Result{StatusCode: 500})
+	od.Report(back1, Result{StatusCode: 500})
+	clock.advance(30 * time.Second)
+	check("after capped ejection", both)
+
+	// Staying healthy for as long as the last ejection resets the back-off.
+	clock.advance(30 * time.Second)
+	od.Report(back1, Result{StatusCode: 200})
+	od.Report(back1, Result{StatusCode: 500})
+	od.Report(back1, Result{StatusCode: 500})
+	clock.advance(10 * time.Second)
+	check("after reset ejection", both)
+}
+
+func TestEjectOutliersPanicMode(t *testing.T) {
+	od := EjectOutliers(FixedSet("http://back-1.test.com"), OutlierDetection{ConsecutiveFailures: 1})
+	od.Report(mustURL("http://back-1.test.com"), Result{StatusCode: 500})
+
+	if urls, _ := od.All(); len(urls) != 1 {
+		t.Errorf("Expected all upstreams when every upstream is ejected, was %v", urls)
+	}
+	if info := od.DebugInfo()["outlier http://back-1.test.com"]; info == "" {
+		t.Error("Expected ejection in debug info")
+	}
+}
+
+func TestReportWalksProviders(t *testing.T) {
+	od := EjectOutliers(FixedSet("http://back-1.test.com", "http://back-2.test.com"), OutlierDetection{ConsecutiveFailures: 1})
+	provider := RoundRobin(od)
+
+	Report(provider, mustURL("http://back-1.test.com"), Result{StatusCode: 500})
+	for i := 0; i < 3; i++ {
+		if u, _ := provider.Get(nil); u.String() != "http://back-2.test.com" {
+			t.Errorf("Expected ejected upstream to be skipped, was %s", u)
+		}
+	}
+}
@@ -3,6 +3,8 @@ package upstream
 import (
 	"fmt"
 	"regexp"
+	"sort"
+	"strings"
 )
 
 // FactoryFn will take an upstream configuration and return an upsteam Source.
@@ -32,3 +34,58 @@ func Get(location string, settings map[string]string) (Source, error) {
 	}
 	return nil, fmt.Errorf("no upstream factory matches %s", location)
 }
+
+// BalancerFn takes a Source and balancer specific settings, and returns a
+// Provider that picks upstreams from the Source.
+type BalancerFn func(Source, map[string]string) (Provider, error)
+
+var balancers = map[string]BalancerFn{}
+
+// RegisterBalancer adds a named load balancing algorithm to the global
+// registry. Registering an existing name replaces it.
+func RegisterBalancer(name string, fn BalancerFn) {
+	balancers[name] = fn
+}
+
+// Balancers returns the names of all registered balancers, sorted.
+func Balancers() []string {
+	names := make([]string, 0, len(balancers))
+	for name := range balancers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GetBalancer returns a Provider that uses the named balancer to pick from
+// source.
+func GetBalancer(name string, source Source, settings map[string]string) (Provider, error) {
+	fn, ok := balancers[name]
+	if !ok {
+		return nil, fmt.Errorf("invalid balance '%s', should be one of (%s)",
+			name, strings.Join(Balancers(), ", "))
+	}
+	return fn(source, settings)
+}
+
+// checkSettings returns an error if settings contains keys that aren't in
+// allowed, naming the valid choices.
+func checkSettings(name string, settings map[string]string, allowed ...string) error {
+	for k := range settings {
+		found := false
+		for _, a := range allowed {
+			if k == a {
+				found = true
+				break
+			}
+		}
+		if !found {
+			if len(allowed) == 0 {
+				return fmt.Errorf("'%s' doesn't accept settings, was given '%s'", name, k)
+			}
+			return fmt.Errorf("invalid setting '%s' for '%s', should be one of (%s)",
+				k, name, strings.Join(allowed, ", "))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package upstream
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+)
+
+// SplitGroup is a group of upstreams that receives a share of a site's
+// traffic.
+type SplitGroup struct {
+	// Name identifies the group on debug pages.
+	Name string
+
+	// Percent of requests sent to the group. Percentages are relative, so groups
+	// with 5 and 95 get the same split as groups with 1 and 19.
+	Percent float64
+
+	// Provider picks the upstream within the group.
+	Provider Provider
+}
+
+// Split returns a Provider that sends a percentage of requests to each group,
+// such as to canary a new release. The group is chosen at random for each
+// request, unless key is non-nil, in which case requests with the same key
+// always go to the same group. Requests with an empty key are split at random.
+// Example use:
+//
+//	cfg.Upstream(Split(CookieKey("user"),
+//	  SplitGroup{"canary", 5, Single("http://canary.test.com")},
+//	  SplitGroup{"stable", 95, RoundRobin(FixedSet(
+//	    "http://back-1.test.com",
+//	    "http://back-2.test.com",
+//	  ))},
+//	))
+func Split(key KeyFn, groups ...SplitGroup) Provider {
+	p := &splitProvider{key: key, groups: groups}
+	for _, g := range groups {
+		if g.Percent > 0 {
+			p.total += g.Percent
+		}
+	}
+	return p
+}
+
+type splitProvider struct {
+	key    KeyFn
+	groups []SplitGroup
+	total  float64
+}
+
+// All returns the upstreams in every group.
+func (p *splitProvider) All() ([]*url.URL, error) {
+	all := []*url.URL{}
+	for _, g := range p.groups {
+		urls, err := g.Provider.All()
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, urls...)
+	}
+	return all, nil
+}
+
+func (p *splitProvider) Get(req *http.Request) (*url.URL, error) {
+	g := p.pick(req)
+	if g == nil {
+		return nil, nil
+	}
+	return g.Provider.Get(req)
+}
+
+// pick chooses a group by mapping the request onto a point in [0, total).
+func (p *splitProvider) pick(req *http.Request) *SplitGroup {
+	if p.total <= 0 {
+		return nil
+	}
+	var point float64
+	if k := p.keyFor(req); k != "" {
+		point = float64(hashKey(k)%1000000) / 1000000 * p.total
+	} else {
+		point = rand.Float64() * p.total
+	}
+	for i := range p.groups {
+		g := &p.groups[i]
+		if g.Percent <= 0 {
+			continue
+		}
+		if point < g.Percent {
+			return g
+		}
+		point -= g.Percent
+	}
+	// Only reachable through floating point rounding.
+	for i := len(p.groups) - 1; i >= 0; i-- {
+		if p.groups[i].Percent > 0 {
+			return &p.groups[i]
+		}
+	}
+	return nil
+}
+
+func (p *splitProvider) keyFor(req *http.Request) string {
+	if p.key == nil {
+		return ""
+	}
+	return p.key(req)
+}
+
+// DebugInfo returns each group's share of traffic, and the debug info of the
+// group's provider prefixed with the group's name.
+func (p *splitProvider) DebugInfo() map[string]string {
+	m := map[string]string{}
+	for _, g := range p.groups {
+		share := 0.0
+		if p.total > 0 && g.Percent > 0 {
+			share = 100 * g.Percent / p.total
+		}
+		m["split "+g.Name] = fmt.Sprintf("%.1f%%", share)
+		for k, v := range g.Provider.DebugInfo() {
+			m[g.Name+" "+k] = v
+		}
+	}
+	return m
+}
+
+// Reserve, Start, Report and ModifyResponse are only passed to the groups that
+// u belongs to, so one group's outlier detection or stickiness isn't affected
+// by another's upstreams.
+
+func (p *splitProvider) Start(u *url.URL) {
+	for _, g := range p.groupsOf(u) {
+		Start(g.Provider, u)
+	}
+}
+
+func (p *splitProvider) Reserve(u *url.URL) bool {
+	groups := p.groupsOf(u)
+	for i, g := range groups {
+		if !Reserve(g.Provider, u) {
+			for _, r := range groups[:i] {
+				release(r.Provider, u)
+			}
+			return false
+		}
+	}
+	return true
+}
+
+func (p *splitProvider) Release(u *url.URL) {
+	for _, g := range p.groupsOf(u) {
+		release(g.Provider, u)
+	}
+}
+
+func (p *splitProvider) Report(u *url.URL, res Result) {
+	for _, g := range p.groupsOf(u) {
+		Report(g.Provider, u, res)
+	}
+}
+
+func (p *splitProvider) ModifyResponse(req *http.Request, u *url.URL, header http.Header) {
+	for _, g := range p.groupsOf(u) {
+		ModifyResponse(g.Provider, req, u, header)
+	}
+}
+
+// sources returns each group's provider, so that Walk and Stop reach them.
+func (p *splitProvider) sources() []Source {
+	srcs := make([]Source, len(p.groups))
+	for i, g := range p.groups {
+		srcs[i] = g.Provider
+	}
+	return srcs
+}
+
+func (p *splitProvider) dispatches() {}
+
+// groupsOf returns the groups whose upstreams include u. If none do, such as
+// when u has since failed a health check, every group is returned so that
+// in flight requests are still accounted for.
+func (p *splitProvider) groupsOf(u *url.URL) []SplitGroup {
+	key := u.String()
+	groups := []SplitGroup{}
+	for _, g := range p.groups {
+		urls, err := g.Provider.All()
+		if err != nil {
+			continue
+		}
+		for _, gu := range urls {
+			if gu.String() == key {
+				groups = append(groups, g)
+				break
+			}
+		}
+	}
+	if len(groups) == 0 {
+		return p.groups
+	}
+	return groups
+}
@@ -0,0 +1,104 @@
+package upstream
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSplitPercentages(t *testing.T) {
+	provider := Split(nil,
+		SplitGroup{"canary", 10, Single("http://canary")},
+		SplitGroup{"stable", 90, RoundRobin(FixedSet("http://stable-1", "http://stable-2"))},
+	)
+	req, _ := http.NewRequest("GET", "http://test.com/", nil)
+
+	counts := map[string]int{}
+	for i := 0; i < 10000; i++ {
+		u, _ := provider.Get(req)
+		counts[u.Host]++
+	}
+	if c := counts["canary"]; c < 800 || c > 1200 {
+		t.Errorf("Expected ~1000 canary requests, was %d", c)
+	}
+	if c := counts["stable-1"] + counts["stable-2"]; c < 8800 || c > 9200 {
+		t.Errorf("Expected ~9000 stable requests, was %d", c)
+	}
+
+	info := provider.DebugInfo()
+	if s := info["split canary"]; s != "10.0%" {
+		t.Errorf("Unexpected canary share, was %q", s)
+	}
+	if s := info["split stable"]; s != "90.0%" {
+		t.Errorf("Unexpected stable share, was %q", s)
+	}
+
+	urls, _ := provider.All()
+	if actual := strings.Join(urlStrings(urls), " "); actual != "http://canary http://stable-1 http://stable-2" {
+		t.Errorf("Unexpected upstreams, was %s", actual)
+	}
+}
+
+func TestSplitIsStickyByKey(t *testing.T) {
+	provider := Split(HeaderKey("X-User"),
+		SplitGroup{"canary", 50, Single("http://canary")},
+		SplitGroup{"stable", 50, Single("http://stable")},
+	)
+
+	counts := map[string]int{}
+	for i := 0; i < 100; i++ {
+		req, _ := http.NewRequest("GET", "http://test.com/", nil)
+		req.Header.Set("X-User", fmt.Sprintf("user-%d", i))
+		first, _ := provider.Get(req)
+		for j := 0; j < 5; j++ {
+			if u, _ := provider.Get(req); u.String() != first.String() {
+				t.Fatalf("user-%d moved from %s to %s", i, first, u)
+			}
+		}
+		counts[first.Host]++
+	}
+	if counts["canary"] < 25 || counts["stable"] < 25 {
+		t.Errorf("Expected users spread across groups, was %v", counts)
+	}
+}
+
+func TestSplitByClientIPAcrossConnections(t *testing.T) {
+	provider := Split(ClientIPKey,
+		SplitGroup{"canary", 50, Single("http://canary")},
+		SplitGroup{"stable", 50, Single("http://stable")},
+	)
+
+	for i := 0; i < 20; i++ {
+		ip := fmt.Sprintf("10.0.0.%d", i)
+		var first string
+		for port := 40000; port < 40005; port++ {
+			req, _ := http.NewRequest("GET", "http://test.com/", nil)
+			req.RemoteAddr = fmt.Sprintf("%s:%d", ip, port)
+			u, _ := provider.Get(req)
+			if first == "" {
+				first = u.String()
+			} else if u.String() != first {
+				t.Fatalf("%s moved from %s to %s on a new connection", ip, first, u)
+			}
+		}
+	}
+}
+
+func TestSplitReportsToOwningGroup(t *testing.T) {
+	canary := EjectOutliers(FixedSet("http://canary"), OutlierDetection{ConsecutiveFailures: 1})
+	stable := EjectOutliers(FixedSet("http://stable-1", "http://stable-2"), OutlierDetection{ConsecutiveFailures: 1})
+	provider := Split(nil,
+		SplitGroup{"canary", 5, First(canary)},
+		SplitGroup{"stable", 95, First(stable)},
+	)
+
+	Report(provider, mustURL("http://stable-1"), Result{StatusCode: 502})
+
+	if urls, _ := stable.All(); len(urls) != 1 || urls[0].String() != "http://stable-2" {
+		t.Errorf("Expected stable-1 to be ejected, was %s", urlStrings(urls))
+	}
+	if _, ok := canary.DebugInfo()["outlier http://stable-1"]; ok {
+		t.Error("Canary group shouldn't track stable upstreams")
+	}
+}
@@ -0,0 +1,123 @@
+package upstream
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// DefaultStickyCookie is the cookie name used when none is specified.
+const DefaultStickyCookie = "locus_affinity"
+
+// StickySettings configures how clients are pinned to upstreams.
+type StickySettings struct {
+	// Cookie is the name of the affinity cookie, defaults to DefaultStickyCookie.
+	Cookie string
+
+	// Secret keys the upstream IDs stored in cookies, so clients can't work out
+	// upstream addresses or pick arbitrary upstreams. If empty a random secret
+	// is generated, which means existing cookies are invalidated whenever the
+	// Provider is recreated.
+	Secret []byte
+
+	// MaxAge of the cookie, if zero a session cookie is issued.
+	MaxAge time.Duration
+}
+
+// Sticky returns a Provider that pins clients to an upstream using a cookie
+// holding an opaque ID of the upstream. Requests without a valid cookie, or
+// whose upstream is no longer returned by provider, are sent to the upstream
+// provider picks and a new cookie is issued on the response.
+// Example use:
+//
+//	cfg.Upstream(Sticky(RoundRobin(FixedSet(
+//	  "http://back-1.test.com",
+//	  "http://back-2.test.com",
+//	)), StickySettings{Secret: []byte("s3cr3t")}))
+func Sticky(provider Provider, settings StickySettings) Provider {
+	if settings.Cookie == "" {
+		settings.Cookie = DefaultStickyCookie
+	}
+	if len(settings.Secret) == 0 {
+		settings.Secret = make([]byte, 32)
+		if _, err := rand.Read(settings.Secret); err != nil {
+			panic(err)
+		}
+	}
+	return &stickyProvider{Provider: provider, settings: settings}
+}
+
+type stickyProvider struct {
+	Provider
+	settings StickySettings
+}
+
+func (p *stickyProvider) Get(req *http.Request) (*url.URL, error) {
+	if pinned := p.pinned(req); pinned != "" {
+		urls, err := p.All()
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range urls {
+			if hmac.Equal([]byte(pinned), []byte(p.id(u.String()))) {
+				return u, nil
+			}
+		}
+	}
+	return p.Provider.Get(req)
+}
+
+// ModifyResponse issues a cookie pinning the client to u, unless the request
+// already carried one.
+func (p *stickyProvider) ModifyResponse(req *http.Request, u *url.URL, header http.Header) {
+	id := p.id(u.String())
+	if hmac.Equal([]byte(p.pinned(req)), []byte(id)) {
+		return
+	}
+	c := &http.Cookie{
+		Name:     p.settings.Cookie,
+		Value:    id,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   req.TLS != nil,
+	}
+	if p.settings.MaxAge > 0 {
+		c.MaxAge = int(p.settings.MaxAge / time.Second)
+	}
+	header.Add("Set-Cookie", c.String())
+}
+
+// DebugInfo adds the cookie name to the Provider's debug info.
+func (p *stickyProvider) DebugInfo() map[string]string {
+	m := p.Provider.DebugInfo()
+	m["sticky cookie"] = p.settings.Cookie
+	return m
+}
+
+func (p *stickyProvider) sources() []Source {
+	return []Source{p.Provider}
+}
+
+// pinned returns the upstream ID from the request's cookie, or an empty string.
+func (p *stickyProvider) pinned(req *http.Request) string {
+	if req == nil {
+		return ""
+	}
+	c, err := req.Cookie(p.settings.Cookie)
+	if err != nil {
+		return ""
+	}
+	return c.Value
+}
+
+// id returns an opaque ID for upstream u, which can only be produced with the
+// secret.
+func (p *stickyProvider) id(u string) string {
+	m := hmac.New(sha256.New, p.settings.Secret)
+	m.Write([]byte(u))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
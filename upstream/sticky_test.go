@@ -0,0 +1,101 @@
+package upstream
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// issueCookie returns the affinity cookie a provider would set for u.
+func issueCookie(p Provider, req *http.Request, u string) *http.Cookie {
+	h := http.Header{}
+	ModifyResponse(p, req, mustURL(u), h)
+	res := http.Response{Header: h}
+	cookies := res.Cookies()
+	if len(cookies) == 0 {
+		return nil
+	}
+	return cookies[0]
+}
+
+func TestSticky(t *testing.T) {
+	set := newMutableSet("http://back-1", "http://back-2", "http://back-3")
+	provider := Sticky(RoundRobin(set), StickySettings{Secret: []byte("secret"), MaxAge: time.Hour})
+
+	req, _ := http.NewRequest("GET", "http://test.com/", nil)
+	first, _ := provider.Get(req)
+	cookie := issueCookie(provider, req, first.String())
+	if cookie == nil || cookie.Name != DefaultStickyCookie || cookie.MaxAge != 3600 || !cookie.HttpOnly {
+		t.Fatalf("Unexpected affinity cookie %v", cookie)
+	}
+
+	// Subsequent requests with the cookie go to the same upstream, and don't
+	// reissue the cookie.
+	req, _ = http.NewRequest("GET", "http://test.com/", nil)
+	req.AddCookie(cookie)
+	for i := 0; i < 5; i++ {
+		if u, _ := provider.Get(req); u.String() != first.String() {
+			t.Errorf("Expected pinned upstream %s, was %s", first, u)
+		}
+	}
+	if c := issueCookie(provider, req, first.String()); c != nil {
+		t.Errorf("Expected cookie not to be reissued, was %v", c)
+	}
+
+	// Once the upstream is gone, another is picked and a new cookie issued.
+	remaining := []string{}
+	for _, u := range []string{"http://back-1", "http://back-2", "http://back-3"} {
+		if u != first.String() {
+			remaining = append(remaining, u)
+		}
+	}
+	set.set(remaining...)
+	u, _ := provider.Get(req)
+	if u.String() == first.String() {
+		t.Errorf("Expected a new upstream once %s was removed", first)
+	}
+	if c := issueCookie(provider, req, u.String()); c == nil {
+		t.Error("Expected a new cookie to be issued")
+	}
+}
+
+func TestStickyCookieHidesUpstream(t *testing.T) {
+	provider := Sticky(First(FixedSet("http://back-1.internal:8080")), StickySettings{Secret: []byte("secret")})
+	req, _ := http.NewRequest("GET", "http://test.com/", nil)
+	cookie := issueCookie(provider, req, "http://back-1.internal:8080")
+	decoded, _ := base64.RawURLEncoding.DecodeString(cookie.Value)
+	for _, v := range []string{cookie.Value, string(decoded)} {
+		if strings.Contains(v, "back-1") || strings.Contains(v, "8080") {
+			t.Errorf("Expected cookie not to reveal upstream, was %q", cookie.Value)
+		}
+	}
+}
+
+func TestStickyRejectsTamperedCookies(t *testing.T) {
+	provider := Sticky(First(FixedSet("http://back-1", "http://back-2")), StickySettings{Secret: []byte("secret")})
+	other := Sticky(First(FixedSet("http://back-1", "http://back-2")), StickySettings{Secret: []byte("other")})
+
+	req, _ := http.NewRequest("GET", "http://test.com/", nil)
+	valid := issueCookie(provider, req, "http://back-2")
+	forged := issueCookie(other, req, "http://back-2")
+
+	var tests = []struct {
+		value    string
+		expected string
+	}{
+		{valid.Value, "http://back-2"},
+		{forged.Value, "http://back-1"},
+		{valid.Value + "x", "http://back-1"},
+		{"aHR0cDovL2JhY2stMg", "http://back-1"},
+		{"garbage", "http://back-1"},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", "http://test.com/", nil)
+		req.AddCookie(&http.Cookie{Name: DefaultStickyCookie, Value: tt.value})
+		if u, _ := provider.Get(req); u.String() != tt.expected {
+			t.Errorf("Cookie %q => %s, want %s", tt.value, u, tt.expected)
+		}
+	}
+}
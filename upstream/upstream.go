@@ -6,8 +6,32 @@ import (
 	"math/rand"
 	"net/http"
 	"net/url"
+	"sync/atomic"
 )
 
+// Register the built in balancers.
+func init() {
+	RegisterBalancer("first", func(s Source, settings map[string]string) (Provider, error) {
+		return First(s), checkSettings("first", settings)
+	})
+	RegisterBalancer("random", func(s Source, settings map[string]string) (Provider, error) {
+		return Random(s), checkSettings("random", settings)
+	})
+	RegisterBalancer("round_robin", func(s Source, settings map[string]string) (Provider, error) {
+		return RoundRobin(s), checkSettings("round_robin", settings)
+	})
+	RegisterBalancer("ip_hash", func(s Source, settings map[string]string) (Provider, error) {
+		if err := checkSettings("ip_hash", settings, "header"); err != nil {
+			return nil, err
+		}
+		p := &ipHashProvider{Source: s, header: "X-Forwarded-For"}
+		if h, ok := settings["header"]; ok {
+			p.header = h
+		}
+		return p, nil
+	})
+}
+
 // PickFn is used to select a URL from an array of URLs.
 type PickFn func(urls []*url.URL) *url.URL
 
@@ -30,6 +54,167 @@ type Source interface {
 	DebugInfo() map[string]string
 }
 
+// Result describes the outcome of a request proxied to an upstream.
+type Result struct {
+	// StatusCode returned by the upstream, zero if no response was received.
+	StatusCode int
+
+	// Err is set if the request to the upstream failed.
+	Err error
+
+	// Canceled is set if the client went away before the request completed, in
+	// which case the result says nothing about the upstream's health.
+	Canceled bool
+}
+
+// Failed returns true if the upstream couldn't be reached or responded with a
+// 5xx status. Canceled requests never fail.
+func (r Result) Failed() bool {
+	return !r.Canceled && (r.Err != nil || r.StatusCode >= 500)
+}
+
+// Reporter is implemented by Sources and Providers that want to be told the
+// outcome of requests proxied to the upstreams they returned.
+type Reporter interface {
+	Report(u *url.URL, res Result)
+}
+
+// Report passes the result of a request proxied to u, to s and any Sources it
+// wraps that implement Reporter.
+func Report(s Source, u *url.URL, res Result) {
+	walkDispatch(s, func(s Source) {
+		if r, ok := s.(Reporter); ok {
+			r.Report(u, res)
+		}
+	})
+}
+
+// Starter is implemented by Sources and Providers that want to be told when a
+// request is about to be proxied to an upstream. Every call to Start is
+// followed by a call to Report once the request completes.
+type Starter interface {
+	Start(u *url.URL)
+}
+
+// Start tells s, and any Sources it wraps that implement Starter, that a
+// request is about to be proxied to u.
+func Start(s Source, u *url.URL) {
+	walkDispatch(s, func(s Source) {
+		if st, ok := s.(Starter); ok {
+			st.Start(u)
+		}
+	})
+}
+
+// Reserver is implemented by Sources that limit how many requests an upstream
+// may take, such as a half-open circuit breaker. Reserve is called once a
+// Provider has picked u, before Start, and returns false if u can't take the
+// request. Release gives back a reservation that won't be used; one that is used
+// is given back by Report.
+type Reserver interface {
+	Reserve(u *url.URL) bool
+	Release(u *url.URL)
+}
+
+// Reserve asks s, and any Sources it wraps that implement Reserver, to reserve a
+// request to u. Returns false if any of them refuse, in which case reservations
+// already made are released.
+func Reserve(s Source, u *url.URL) bool {
+	reserved := []Reserver{}
+	ok := true
+	walkDispatch(s, func(s Source) {
+		if r, isReserver := s.(Reserver); isReserver && ok {
+			if ok = r.Reserve(u); ok {
+				reserved = append(reserved, r)
+			}
+		}
+	})
+	if !ok {
+		for _, r := range reserved {
+			r.Release(u)
+		}
+	}
+	return ok
+}
+
+// release gives back a reservation made with Reserve.
+func release(s Source, u *url.URL) {
+	walkDispatch(s, func(s Source) {
+		if r, ok := s.(Reserver); ok {
+			r.Release(u)
+		}
+	})
+}
+
+// ResponseModifier is implemented by Sources and Providers that need to modify
+// the headers sent to the client, such as to set a cookie. It is called before
+// headers from the upstream's response are added.
+type ResponseModifier interface {
+	ModifyResponse(req *http.Request, u *url.URL, header http.Header)
+}
+
+// ModifyResponse lets s, and any Sources it wraps that implement
+// ResponseModifier, modify the headers of the response to req, which is being
+// proxied to u.
+func ModifyResponse(s Source, req *http.Request, u *url.URL, header http.Header) {
+	walkDispatch(s, func(s Source) {
+		if rm, ok := s.(ResponseModifier); ok {
+			rm.ModifyResponse(req, u, header)
+		}
+	})
+}
+
+// Stopper is implemented by Sources that do work in the background, which
+// should be stopped once the Source is no longer used.
+type Stopper interface {
+	Stop()
+}
+
+// wrapper is implemented by Sources and Providers that compose other Sources.
+type wrapper interface {
+	sources() []Source
+}
+
+// Walk calls fn for s, and then recursively for each Source that s wraps.
+func Walk(s Source, fn func(Source)) {
+	fn(s)
+	if w, ok := s.(wrapper); ok {
+		for _, ws := range w.sources() {
+			Walk(ws, fn)
+		}
+	}
+}
+
+// dispatcher is implemented by wrappers that choose which of their Sources are
+// passed Reserve, Start, Report and ModifyResponse, rather than all of them.
+type dispatcher interface {
+	wrapper
+	dispatches()
+}
+
+// walkDispatch is Walk, except it doesn't descend into dispatchers, which pass
+// calls on to their Sources themselves.
+func walkDispatch(s Source, fn func(Source)) {
+	fn(s)
+	if _, ok := s.(dispatcher); ok {
+		return
+	}
+	if w, ok := s.(wrapper); ok {
+		for _, ws := range w.sources() {
+			walkDispatch(ws, fn)
+		}
+	}
+}
+
+// Stop stops s and any Sources it wraps that implement Stopper.
+func Stop(s Source) {
+	Walk(s, func(s Source) {
+		if st, ok := s.(Stopper); ok {
+			st.Stop()
+		}
+	})
+}
+
 // First returns an upstream Provider that always uses the first upstream in a
 // Source.
 func First(source Source) Provider {
@@ -47,16 +232,9 @@ func Random(source Source) Provider {
 
 // RoundRobin returns an Provider that cycles through the upstreams in a Source.
 func RoundRobin(source Source) Provider {
-	ch := make(chan int, 1)
-	go func() {
-		c := 0
-		for {
-			ch <- c
-			c++
-		}
-	}()
+	var next uint64
 	return &provider{Source: source, pickFn: func(urls []*url.URL) *url.URL {
-		return urls[<-ch%len(urls)]
+		return urls[(atomic.AddUint64(&next, 1)-1)%uint64(len(urls))]
 	}}
 }
 
@@ -66,6 +244,10 @@ type provider struct {
 	pickFn PickFn
 }
 
+func (p *provider) sources() []Source {
+	return []Source{p.Source}
+}
+
 func (p *provider) Get(req *http.Request) (*url.URL, error) {
 	urls, err := p.All()
 	if err != nil {
@@ -80,11 +262,16 @@ func (p *provider) Get(req *http.Request) (*url.URL, error) {
 // IPHash returns an Provider that sends traffic to a consistent backend based
 // on a hash of the requesting IP (via X-Forwarded-For or Remote_Addr).
 func IPHash(source Source) Provider {
-	return &ipHashProvider{Source: source}
+	return &ipHashProvider{Source: source, header: "X-Forwarded-For"}
 }
 
 type ipHashProvider struct {
 	Source
+	header string
+}
+
+func (p *ipHashProvider) sources() []Source {
+	return []Source{p.Source}
 }
 
 func (p *ipHashProvider) Get(req *http.Request) (*url.URL, error) {
@@ -93,14 +280,20 @@ func (p *ipHashProvider) Get(req *http.Request) (*url.URL, error) {
 		return nil, err
 	}
 
+	if len(urls) == 0 {
+		return nil, nil
+	}
+
 	h := fnv.New32()
-	h.Write([]byte(clientIP(req)))
+	h.Write([]byte(clientIP(req, p.header)))
 
-	return urls[int(h.Sum32())%len(urls)], nil
+	return urls[h.Sum32()%uint32(len(urls))], nil
 }
 
-func clientIP(req *http.Request) string {
-	if h := req.Header.Get("X-Forwarded-For"); h != "" {
+// clientIP returns the value of header, falling back to the request's remote
+// address if it isn't present.
+func clientIP(req *http.Request, header string) string {
+	if h := req.Header.Get(header); h != "" {
 		return h
 	}
 	return req.RemoteAddr
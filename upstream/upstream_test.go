@@ -2,6 +2,8 @@ package upstream
 
 import (
 	"net/http"
+	"net/url"
+	"runtime"
 	"testing"
 )
 
@@ -26,6 +28,16 @@ func TestRoundRobin(t *testing.T) {
 	}
 }
 
+func TestRoundRobinDoesNotLeakGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		RoundRobin(FixedSet("back-1.test.com")).Get(nil)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("Expected no new goroutines, was %d before and %d after", before, after)
+	}
+}
+
 func TestIPHash(t *testing.T) {
 	provider := IPHash(FixedSet(
 		"back-1.test.com",
@@ -63,3 +75,34 @@ func TestIPHash(t *testing.T) {
 		}
 	}
 }
+
+func TestGetBalancer(t *testing.T) {
+	RegisterBalancer("test_last", func(s Source, settings map[string]string) (Provider, error) {
+		return &provider{Source: s, pickFn: func(urls []*url.URL) *url.URL {
+			return urls[len(urls)-1]
+		}}, nil
+	})
+	defer delete(balancers, "test_last")
+
+	provider, err := GetBalancer("test_last", FixedSet("back-1.test.com", "back-2.test.com"), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if u, _ := provider.Get(nil); u.String() != "back-2.test.com" {
+		t.Errorf("Expected registered balancer to be used, got %s", u)
+	}
+
+	_, err = GetBalancer("fastest", FixedSet("back-1.test.com"), nil)
+	expected := "invalid balance 'fastest', should be one of (consistent_hash, first, ip_hash, least_conn, random, round_robin, test_last, weighted_round_robin)"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected error %q, was %v", expected, err)
+	}
+}
+
+func TestIPHashEmpty(t *testing.T) {
+	provider := IPHash(FixedSet())
+	req, _ := http.NewRequest("GET", "xxx", nil)
+	if u, err := provider.Get(req); u != nil || err != nil {
+		t.Errorf("Expected no upstream, was %v %v", u, err)
+	}
+}
@@ -0,0 +1,120 @@
+package upstream
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+func init() {
+	RegisterBalancer("weighted_round_robin", func(s Source, settings map[string]string) (Provider, error) {
+		return WeightedRoundRobin(s), checkSettings("weighted_round_robin", settings)
+	})
+}
+
+// Weigher is implemented by Sources that assign relative weights to their
+// upstreams.
+type Weigher interface {
+	Weight(u *url.URL) int
+}
+
+// Weight returns the weight of u according to the first Weigher found by
+// walking s. Upstreams default to a weight of 1.
+func Weight(s Source, u *url.URL) int {
+	w := 0
+	Walk(s, func(s Source) {
+		if wr, ok := s.(Weigher); ok && w == 0 {
+			w = wr.Weight(u)
+		}
+	})
+	if w <= 0 {
+		return 1
+	}
+	return w
+}
+
+// WeightedRoundRobin returns a Provider that cycles through upstreams in
+// proportion to their weight. It uses the smooth algorithm from nginx, so an
+// upstream with weight 5 among two with weight 1 is picked as a a b a c a a,
+// rather than in a burst of five.
+func WeightedRoundRobin(source Source) Provider {
+	return &weightedProvider{Source: source, current: map[string]int{}}
+}
+
+type weightedProvider struct {
+	Source
+
+	current map[string]int
+	mu      sync.Mutex
+}
+
+func (p *weightedProvider) Get(req *http.Request) (*url.URL, error) {
+	urls, err := p.All()
+	if err != nil {
+		return nil, err
+	}
+	if len(urls) == 0 {
+		return nil, nil
+	}
+
+	weights := make([]int, len(urls))
+	for i, u := range urls {
+		weights[i] = Weight(p.Source, u)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Forget upstreams that have left the source, such as after failing a health
+	// check, so they rejoin on an equal footing.
+	if len(p.current) > len(urls) {
+		present := map[string]bool{}
+		for _, u := range urls {
+			present[u.String()] = true
+		}
+		for k := range p.current {
+			if !present[k] {
+				delete(p.current, k)
+			}
+		}
+	}
+
+	var best *url.URL
+	total, bestCurrent := 0, 0
+	for i, u := range urls {
+		key := u.String()
+		p.current[key] += weights[i]
+		total += weights[i]
+		if best == nil || p.current[key] > bestCurrent {
+			best, bestCurrent = u, p.current[key]
+		}
+	}
+	p.current[best.String()] -= total
+	return best, nil
+}
+
+// DebugInfo adds the weight of each available upstream, and its share of the
+// total weight, to the Source's debug info. This is the configured split, not
+// observed traffic.
+func (p *weightedProvider) DebugInfo() map[string]string {
+	m := p.Source.DebugInfo()
+	urls, err := p.All()
+	if err != nil {
+		return m
+	}
+	weights := make([]int, len(urls))
+	total := 0
+	for i, u := range urls {
+		weights[i] = Weight(p.Source, u)
+		total += weights[i]
+	}
+	for i, u := range urls {
+		m["weight "+u.String()] = fmt.Sprintf("%d (%.1f%% of configured weight)", weights[i], 100*float64(weights[i])/float64(total))
+	}
+	return m
+}
+
+func (p *weightedProvider) sources() []Source {
+	return []Source{p.Source}
+}
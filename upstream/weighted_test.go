@@ -0,0 +1,72 @@
+package upstream
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestWeightedRoundRobinIsSmooth(t *testing.T) {
+	provider := WeightedRoundRobin(WeightedSet(
+		WeightedURL{"http://a", 5},
+		WeightedURL{"http://b", 1},
+		WeightedURL{"http://c", 1},
+	))
+	req, _ := http.NewRequest("GET", "http://test.com/", nil)
+
+	picks := []string{}
+	for i := 0; i < 14; i++ {
+		u, _ := provider.Get(req)
+		picks = append(picks, u.Host)
+	}
+	expected := "a a b a c a a a a b a c a a"
+	if actual := strings.Join(picks, " "); actual != expected {
+		t.Errorf("Unexpected picks, expected %s was %s", expected, actual)
+	}
+}
+
+func TestWeightedRoundRobinDefaultsToEqualWeights(t *testing.T) {
+	provider := WeightedRoundRobin(FixedSet("http://a", "http://b"))
+	req, _ := http.NewRequest("GET", "http://test.com/", nil)
+
+	counts := map[string]int{}
+	for i := 0; i < 10; i++ {
+		u, _ := provider.Get(req)
+		counts[u.Host]++
+	}
+	if counts["a"] != 5 || counts["b"] != 5 {
+		t.Errorf("Expected an even split, was %v", counts)
+	}
+
+	info := provider.DebugInfo()
+	if s := info["weight http://a"]; s != "1 (50.0% of configured weight)" {
+		t.Errorf("Unexpected weight, was %q", s)
+	}
+}
+
+func TestWeightedShareOfAvailableUpstreams(t *testing.T) {
+	set := WeightedSet(
+		WeightedURL{"http://a", 3},
+		WeightedURL{"http://b", 1},
+	)
+	provider := WeightedRoundRobin(set)
+	info := provider.DebugInfo()
+	if s := info["weight http://a"]; s != "3 (75.0% of configured weight)" {
+		t.Errorf("Unexpected weight for a, was %q", s)
+	}
+	if s := info["weight http://b"]; s != "1 (25.0% of configured weight)" {
+		t.Errorf("Unexpected weight for b, was %q", s)
+	}
+
+	// Weights are found through wrapping sources.
+	if w := Weight(EjectOutliers(set, OutlierDetection{}), mustURL("http://a")); w != 3 {
+		t.Errorf("Expected weight 3 through wrapper, was %d", w)
+	}
+}
+
+func TestWeightedSetRejectsInvalidWeights(t *testing.T) {
+	_, err := WeightedSet(WeightedURL{"http://a", 0}).All()
+	if err == nil || err.Error() != "invalid weight 0 for 'http://a', should be positive" {
+		t.Errorf("Unexpected error, was %v", err)
+	}
+}
@@ -3,6 +3,7 @@ package locus
 import (
 	"errors"
 	"fmt"
+	"math"
 	"net/http"
 	"time"
 
@@ -18,8 +19,85 @@ const SampleYAMLConfig = `
 # proxy.
 globals:
   port: 5556
+  # Addresses to listen on, for 'port' and the TLS port. If omitted all
+  # interfaces are used, IPv4 and IPv6.
+  listen:
+    - 127.0.0.1
+    - "::1"
+  # For more control, 'listeners' replaces 'port', 'listen' and the TLS port.
+  # Protocol is one of http (default), https, h2c or unix, where the address is
+  # the socket's path. Timeouts default to the global ones. Sites can be
+  # restricted to listeners by name, without this section the listeners are
+  # named 'http' and 'https'.
+  # listeners:
+  #   - name: public
+  #     address: ":443"
+  #     protocol: https
+  #   - name: internal
+  #     address: 10.0.0.5:8080
+  #     protocol: h2c
+  #     read_timeout: 5m
+  #     write_timeout: 5m
+  #     idle_timeout: 10m
+  #   - name: local
+  #     address: /var/run/locus.sock
+  #     protocol: unix
   read_timeout: 10s
   write_timeout: 20s
+  # How long in flight requests are given to complete on SIGTERM.
+  drain_timeout: 15s
+  # Upgraded connections, such as WebSockets, are closed after this long
+  # without traffic in either direction.
+  upgrade_idle_timeout: 10m
+  # Proxies in front of locus, as IPs or CIDR ranges, such as a load balancer
+  # that terminates TLS. The X-Forwarded-Proto header they send is passed on to
+  # upstreams. From anyone else it's replaced with the protocol the client
+  # connected to locus with.
+  trusted_proxies:
+    - 10.0.0.0/8
+  # Route requests to the most specific matching site, exact hosts before
+  # wildcards, then longer paths and more 'match' rules first. Without this the
+  # first matching site, in the order below, is used. Sites that can never be
+  # reached are logged when the config is loaded.
+  compiled_routing: true
+  # The 'admin' section serves /debug/configs, /debug/reload, /debug/vars and
+  # /debug/metrics on a separate address. They aren't served anywhere else.
+  # 'basic_auth' and 'allow_ips' are both optional, the client's address is
+  # checked against IPs or CIDR ranges. /debug/reload is refused unless at least
+  # one of them is set.
+  admin:
+    address: 127.0.0.1:5558
+    basic_auth:
+      username: ops
+      password: change-me
+    allow_ips:
+      - 127.0.0.1
+      - 10.0.0.0/8
+  # The 'tls' section enables a TLS listener, certificates are selected based on
+  # the SNI sent by the client.
+  tls:
+    port: 5443
+    certificates:
+      - cert_file: /etc/locus/certs/mysite.com.crt
+        key_file: /etc/locus/certs/mysite.com.key
+      - cert_file: /etc/locus/certs/othersite.com.crt
+        key_file: /etc/locus/certs/othersite.com.key
+    # If present, certificates for hosts bound by sites, that aren't covered by
+    # the files above, are obtained and renewed via ACME. To test against a local
+    # Pebble server use 'directory_url: https://localhost:14000/dir' and set
+    # 'ca_file' to Pebble's root certificate.
+    acme:
+      email: admin@mysite.com
+      cache_dir: /var/lib/locus/acme
+      directory_url: https://acme-v02.api.letsencrypt.org/directory
+    # If present, clients are asked for a certificate signed by 'ca_file'. Mode
+    # 'request' lets clients connect without one, 'require' doesn't. Verified
+    # subjects and SANs are sent upstream in the X-Client-Cert-Subject and
+    # X-Client-Cert-San headers. The CA file is read at startup, so this example
+    # is commented out.
+    # client_auth:
+    #   mode: request
+    #   ca_file: /etc/locus/client-ca.pem
 # The 'defaults' section contains settings to be applied to all sites.
 defaults:
   add_header:
@@ -45,6 +123,30 @@ sites:
       - http://search-2.mysite.com
       - http://search-3.mysite.com
     round_robin: true
+    # Upstreams failing active health checks are removed from rotation, until
+    # they pass again. Zero values use defaults.
+    health_check:
+      path: /healthz
+      expected_status: 200
+      interval: 10s
+      timeout: 2s
+      healthy_threshold: 2
+      unhealthy_threshold: 3
+    # Upstreams that fail requests, with connection errors or 5xx responses, too
+    # many times in a row are ejected. Each ejection doubles the time ejected.
+    outlier_detection:
+      consecutive_failures: 5
+      base_ejection_time: 30s
+      max_ejection_time: 5m
+    # Failed requests are resent to another upstream, up to 'max_attempts'
+    # times in total. Idempotent requests without a body are always eligible,
+    # others only if they have a body that fits within 'buffer_body' bytes.
+    # 'retry_on' defaults to connect_error, timeout, 502, 503 and 504.
+    retry:
+      max_attempts: 3
+      retry_on: [connect_error, timeout, 503]
+      per_try_timeout: 5s
+      buffer_body: 65536
   # 'fallthrough' is a site that uses DNS to fetch multiple upstream hosts and
   # handles all other requests to mysite.com. A single upstream without a scheme
   # demarks a DNS upstream.
@@ -55,7 +157,136 @@ sites:
       port: 4000
       path: /2016/mysite/
       ttl: 5m
-    round_robin: true
+    # 'balance' chooses how requests are spread across upstreams, one of
+    # 'random' (default), 'round_robin', 'weighted_round_robin', 'least_conn',
+    # 'ip_hash', 'first' or 'consistent_hash'. Consistent hashing takes a 'key' setting of 'ip',
+    # 'path', 'header:<name>' or 'cookie:<name>'.
+    balance: least_conn
+  # 'api_v2' takes requests from beta users, identified by a cookie, that ask
+  # for version 2 of the API in the Accept header. 'match' rules are combined
+  # with the binding, and all must be satisfied. Headers and cookies can be
+  # matched by 'value', 'regex' (unanchored) or just be 'present'. Other
+  # requests fall through to 'api' below.
+  - name: api_v2
+    bind: //api.mysite.com
+    upstream: http://api-v2.mysite.com
+    match:
+      methods: [GET, HEAD, POST]
+      headers:
+        - name: Accept
+          regex: ^application/vnd\.mysite\.v2\+json
+      cookies:
+        - name: beta
+          present: true
+  # 'api' keeps clients on the same upstream, based on the IP in a header set
+  # by a load balancer in front of Locus.
+  - name: api
+    bind: //api.mysite.com
+    upstream_set:
+      - http://api-1.mysite.com
+      - http://api-2.mysite.com
+    balance: ip_hash
+    balance_settings:
+      header: X-Real-IP
+    # Each upstream's circuit breaker opens when 'error_rate' of at least
+    # 'min_requests' requests, or 'error_count' requests, fail within 'window'.
+    # Open upstreams get no traffic, until 'open_timeout' has passed and
+    # 'half_open_requests' probes succeed. If every breaker is open requests
+    # fail fast with a 503.
+    circuit_breaker:
+      window: 10s
+      error_rate: 0.5
+      min_requests: 20
+      open_timeout: 30s
+      half_open_requests: 1
+  # 'media' runs on a mix of instance sizes, weights skew traffic towards the
+  # larger ones. Entries without a weight have a weight of 1. Weights are only
+  # allowed with 'balance: weighted_round_robin'.
+  - name: media
+    bind: //media.mysite.com
+    upstream_set:
+      - url: http://media-large.mysite.com
+        weight: 4
+      - http://media-small.mysite.com
+    balance: weighted_round_robin
+    # 'transport' gives the site its own connection pool to its upstreams.
+    # Unset values match Go's default transport.
+    transport:
+      dial_timeout: 5s
+      keep_alive: 30s
+      tls_handshake_timeout: 5s
+      response_header_timeout: 60s
+      idle_conn_timeout: 90s
+      max_idle_conns: 200
+      max_idle_conns_per_host: 50
+      max_conns_per_host: 100
+      disable_keep_alives: false
+      disable_compression: true
+      # 'tls' secures connections to HTTPS upstreams, such as those signed by an
+      # internal CA that require client certificates. Files are checked when the
+      # config is loaded, so this example is commented out.
+      # tls:
+      #   ca_file: /etc/locus/internal-ca.pem
+      #   cert_file: /etc/locus/client.pem
+      #   key_file: /etc/locus/client-key.pem
+      #   server_name: media.internal
+      #   min_version: "1.2"
+  # 'app' pins clients to the upstream that served their first request, using a
+  # cookie holding an opaque ID of the upstream. If 'secret' is omitted one is
+  # generated, and cookies won't survive restarts or reloads.
+  # 'bind_hosts' matches any of several hosts, and may be used with
+  # 'bind_location'. A "*" matches part or all of a single label, so quote it.
+  - name: app
+    bind_hosts:
+      - app.mysite.com
+      - www.app.mysite.com
+      - "app-*.mysite.com"
+      - "*.app.mysite.eu"
+    upstream_set:
+      - http://app-1.mysite.com
+      - http://app-2.mysite.com
+    sticky:
+      cookie: app_affinity
+      secret: change-me
+      max_age: 1h
+  # 'shop' sends 5% of users to a canary release. 'key' is optional, and keeps
+  # each user in the same group. It takes the same values as consistent hashing.
+  # Groups inherit upstream options, such as 'balance', from the site.
+  - name: shop
+    bind: //shop.mysite.com
+    balance: round_robin
+    split:
+      key: cookie:session
+      groups:
+        - name: canary
+          percent: 5
+          upstream: http://shop-canary.mysite.com
+        - name: stable
+          percent: 95
+          upstream_set:
+            - http://shop-1.mysite.com
+            - http://shop-2.mysite.com
+  # 'admin' is only served over TLS, to clients with a verified certificate,
+  # and of those only ones issued to the ops team. Other requests get a 403.
+  - name: admin
+    bind: //admin.mysite.com
+    upstream: http://admin.mysite.com
+    listeners: [https]
+    client_cert:
+      require: true
+      organizations: [MySite Ops]
+      sans: [ops@mysite.com]
+  # 'avatars' serves user avatars from a bucket. Paths in 'bind' are matched by
+  # plain prefix, 'match' can instead take one of 'path_exact', 'path_prefix'
+  # (whole segments, so /api doesn't match /apiary), 'path_regex' (the whole
+  # path, named groups are captured) or 'path_template', where {name} matches a
+  # segment and {name*} the rest of the path. Captures can be used in the
+  # upstream's path.
+  - name: avatars
+    bind: //www.mysite.com
+    upstream: http://avatars.mysite.com/users/{id}.png
+    match:
+      path_template: /users/{id}/avatar
   # 'redirect' will redirect any non-matched subdomains to the fallthrough route
   # above.
   - name: redirect
@@ -65,27 +296,218 @@ sites:
 `
 
 type globalSettings struct {
-	Port           uint16        `yaml:"port"`
-	ReadTimeout    time.Duration `yaml:"read_timeout"`
-	WriteTimeout   time.Duration `yaml:"write_timeout"`
-	VerboseLogging bool          `yaml:"verbose_logging"`
-	AccessLog      string        `yaml:"access_log"`
-	ErrorLog       string        `yaml:"error_log"`
+	Port               uint16         `yaml:"port"`
+	Listen             []string       `yaml:"listen"`
+	Listeners          []yamlListener `yaml:"listeners"`
+	ReadTimeout        time.Duration  `yaml:"read_timeout"`
+	WriteTimeout       time.Duration  `yaml:"write_timeout"`
+	DrainTimeout       time.Duration  `yaml:"drain_timeout"`
+	UpgradeIdleTimeout time.Duration  `yaml:"upgrade_idle_timeout"`
+	TrustedProxies     []string       `yaml:"trusted_proxies"`
+	VerboseLogging     bool           `yaml:"verbose_logging"`
+	CompiledRouting    bool           `yaml:"compiled_routing"`
+	AccessLog          string         `yaml:"access_log"`
+	ErrorLog           string         `yaml:"error_log"`
+	TLS                tlsSettings    `yaml:"tls"`
+	Admin              *adminYAML     `yaml:"admin"`
+}
+
+type adminYAML struct {
+	Address   string `yaml:"address"`
+	BasicAuth struct {
+		Username string `yaml:"username"`
+		Password string `yaml:"password"`
+	} `yaml:"basic_auth"`
+	AllowIPs []string `yaml:"allow_ips"`
+}
+
+type yamlListener struct {
+	Name         string        `yaml:"name"`
+	Address      string        `yaml:"address"`
+	Protocol     string        `yaml:"protocol"`
+	ReadTimeout  time.Duration `yaml:"read_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout"`
+}
+
+type tlsSettings struct {
+	Port         uint16                `yaml:"port"`
+	Certificates []yamlCertificateFile `yaml:"certificates"`
+	ACME         *acmeSettings         `yaml:"acme"`
+	ClientAuth   *clientAuthSettings   `yaml:"client_auth"`
+}
+
+type clientAuthSettings struct {
+	Mode   string `yaml:"mode"`
+	CAFile string `yaml:"ca_file"`
+}
+
+type acmeSettings struct {
+	Email        string `yaml:"email"`
+	CacheDir     string `yaml:"cache_dir"`
+	DirectoryURL string `yaml:"directory_url"`
+	CAFile       string `yaml:"ca_file"`
+}
+
+type yamlCertificateFile struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
 }
 
 type yamlSiteConfig struct {
 	Name             string            `yaml:"name"`
 	Bind             string            `yaml:"bind"`
 	BindHost         string            `yaml:"bind_host"`
+	BindHosts        []string          `yaml:"bind_hosts"`
 	BindLocation     string            `yaml:"bind_location"`
 	RoundRobin       bool              `yaml:"round_robin"`
+	Balance          string            `yaml:"balance"`
+	BalanceSettings  map[string]string `yaml:"balance_settings"`
 	Upstream         string            `yaml:"upstream"`
-	UpstreamSet      []string          `yaml:"upstream_set"`
+	UpstreamSet      []yamlUpstream    `yaml:"upstream_set"`
 	UpstreamSettings map[string]string `yaml:"upstream_settings"`
 	AddHeaders       map[string]string `yaml:"add_header"`
 	SetHeaders       map[string]string `yaml:"set_header"`
 	StripHeaders     []string          `yaml:"strip_header"`
 	Redirect         int               `yaml:"redirect"`
+	HealthCheck      *yamlHealthCheck  `yaml:"health_check"`
+	OutlierDetection *yamlOutlier      `yaml:"outlier_detection"`
+	Sticky           *yamlSticky       `yaml:"sticky"`
+	Split            *yamlSplit        `yaml:"split"`
+	Retry            *yamlRetry        `yaml:"retry"`
+	CircuitBreaker   *yamlBreaker      `yaml:"circuit_breaker"`
+	Transport        *yamlTransport    `yaml:"transport"`
+	ClientCert       *yamlClientCert   `yaml:"client_cert"`
+	Match            *yamlMatch        `yaml:"match"`
+	Listeners        []string          `yaml:"listeners"`
+}
+
+// yamlUpstream is an entry in an upstream_set, either a plain URL or a map
+// with 'url' and 'weight' keys.
+type yamlUpstream struct {
+	URL    string `yaml:"url"`
+	Weight int    `yaml:"weight"`
+}
+
+func (u *yamlUpstream) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var urlStr string
+	if err := unmarshal(&urlStr); err == nil {
+		u.URL, u.Weight = urlStr, 1
+		return nil
+	}
+	type plain yamlUpstream
+	p := plain{Weight: 1}
+	if err := unmarshal(&p); err != nil {
+		return err
+	}
+	*u = yamlUpstream(p)
+	return nil
+}
+
+type yamlSplit struct {
+	Key    string           `yaml:"key"`
+	Groups []yamlSplitGroup `yaml:"groups"`
+}
+
+// yamlSplitGroup takes the same upstream options as a site, unset options are
+// inherited from the site.
+type yamlSplitGroup struct {
+	Name             string            `yaml:"name"`
+	Percent          float64           `yaml:"percent"`
+	Balance          string            `yaml:"balance"`
+	BalanceSettings  map[string]string `yaml:"balance_settings"`
+	Upstream         string            `yaml:"upstream"`
+	UpstreamSet      []yamlUpstream    `yaml:"upstream_set"`
+	UpstreamSettings map[string]string `yaml:"upstream_settings"`
+	HealthCheck      *yamlHealthCheck  `yaml:"health_check"`
+	OutlierDetection *yamlOutlier      `yaml:"outlier_detection"`
+	CircuitBreaker   *yamlBreaker      `yaml:"circuit_breaker"`
+}
+
+type yamlSticky struct {
+	Cookie string        `yaml:"cookie"`
+	Secret string        `yaml:"secret"`
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+type yamlRetry struct {
+	MaxAttempts   int           `yaml:"max_attempts"`
+	RetryOn       []string      `yaml:"retry_on"`
+	PerTryTimeout time.Duration `yaml:"per_try_timeout"`
+	BufferBody    int64         `yaml:"buffer_body"`
+}
+
+type yamlTransport struct {
+	DialTimeout           time.Duration    `yaml:"dial_timeout"`
+	KeepAlive             time.Duration    `yaml:"keep_alive"`
+	TLSHandshakeTimeout   time.Duration    `yaml:"tls_handshake_timeout"`
+	ResponseHeaderTimeout time.Duration    `yaml:"response_header_timeout"`
+	IdleConnTimeout       time.Duration    `yaml:"idle_conn_timeout"`
+	MaxIdleConns          int              `yaml:"max_idle_conns"`
+	MaxIdleConnsPerHost   int              `yaml:"max_idle_conns_per_host"`
+	MaxConnsPerHost       int              `yaml:"max_conns_per_host"`
+	DisableKeepAlives     bool             `yaml:"disable_keep_alives"`
+	DisableCompression    bool             `yaml:"disable_compression"`
+	TLS                   *yamlUpstreamTLS `yaml:"tls"`
+}
+
+type yamlUpstreamTLS struct {
+	CAFile     string `yaml:"ca_file"`
+	CertFile   string `yaml:"cert_file"`
+	KeyFile    string `yaml:"key_file"`
+	ServerName string `yaml:"server_name"`
+	MinVersion string `yaml:"min_version"`
+}
+
+type yamlMatch struct {
+	PathExact    string          `yaml:"path_exact"`
+	PathPrefix   string          `yaml:"path_prefix"`
+	PathRegex    string          `yaml:"path_regex"`
+	PathTemplate string          `yaml:"path_template"`
+	Methods      []string        `yaml:"methods"`
+	Headers      []yamlMatchRule `yaml:"headers"`
+	Cookies      []yamlMatchRule `yaml:"cookies"`
+}
+
+// yamlMatchRule matches a header or cookie, exactly one of 'value', 'present'
+// or 'regex' should be set.
+type yamlMatchRule struct {
+	Name    string `yaml:"name"`
+	Value   string `yaml:"value"`
+	Present bool   `yaml:"present"`
+	Regex   string `yaml:"regex"`
+}
+
+type yamlClientCert struct {
+	Require       bool     `yaml:"require"`
+	CommonNames   []string `yaml:"common_names"`
+	Organizations []string `yaml:"organizations"`
+	SANs          []string `yaml:"sans"`
+}
+
+type yamlBreaker struct {
+	Window           time.Duration `yaml:"window"`
+	ErrorRate        float64       `yaml:"error_rate"`
+	MinRequests      int           `yaml:"min_requests"`
+	ErrorCount       int           `yaml:"error_count"`
+	OpenTimeout      time.Duration `yaml:"open_timeout"`
+	HalfOpenRequests int           `yaml:"half_open_requests"`
+}
+
+type yamlOutlier struct {
+	ConsecutiveFailures int           `yaml:"consecutive_failures"`
+	BaseEjectionTime    time.Duration `yaml:"base_ejection_time"`
+	MaxEjectionTime     time.Duration `yaml:"max_ejection_time"`
+}
+
+type yamlHealthCheck struct {
+	Path               string        `yaml:"path"`
+	Host               string        `yaml:"host"`
+	ExpectedStatus     int           `yaml:"expected_status"`
+	Interval           time.Duration `yaml:"interval"`
+	Timeout            time.Duration `yaml:"timeout"`
+	HealthyThreshold   int           `yaml:"healthy_threshold"`
+	UnhealthyThreshold int           `yaml:"unhealthy_threshold"`
 }
 
 func (c *yamlSiteConfig) merge(o yamlSiteConfig) {
@@ -98,12 +520,21 @@ func (c *yamlSiteConfig) merge(o yamlSiteConfig) {
 	if o.BindHost != "" {
 		c.BindHost = o.BindHost
 	}
+	if len(o.BindHosts) > 0 {
+		c.BindHosts = o.BindHosts
+	}
 	if o.BindLocation != "" {
 		c.BindLocation = o.BindLocation
 	}
 	if o.RoundRobin {
 		c.RoundRobin = o.RoundRobin
 	}
+	if o.Balance != "" {
+		c.Balance = o.Balance
+	}
+	for k, v := range o.BalanceSettings {
+		c.BalanceSettings[k] = v
+	}
 	if o.Upstream != "" {
 		c.Upstream = o.Upstream
 	}
@@ -125,6 +556,36 @@ func (c *yamlSiteConfig) merge(o yamlSiteConfig) {
 	if o.Redirect != 0 {
 		c.Redirect = o.Redirect
 	}
+	if o.HealthCheck != nil {
+		c.HealthCheck = o.HealthCheck
+	}
+	if o.OutlierDetection != nil {
+		c.OutlierDetection = o.OutlierDetection
+	}
+	if o.Sticky != nil {
+		c.Sticky = o.Sticky
+	}
+	if o.Split != nil {
+		c.Split = o.Split
+	}
+	if o.Retry != nil {
+		c.Retry = o.Retry
+	}
+	if o.CircuitBreaker != nil {
+		c.CircuitBreaker = o.CircuitBreaker
+	}
+	if o.Transport != nil {
+		c.Transport = o.Transport
+	}
+	if o.ClientCert != nil {
+		c.ClientCert = o.ClientCert
+	}
+	if len(o.Listeners) > 0 {
+		c.Listeners = o.Listeners
+	}
+	if o.Match != nil {
+		c.Match = o.Match
+	}
 }
 
 type yamlConfig struct {
@@ -145,6 +606,7 @@ func loadConfigFromYAML(data []byte) ([]*Config, *globalSettings, error) {
 	for _, site := range yc.Sites {
 		c := yamlSiteConfig{
 			UpstreamSettings: map[string]string{},
+			BalanceSettings:  map[string]string{},
 			AddHeaders:       map[string]string{},
 			SetHeaders:       map[string]string{},
 		}
@@ -152,14 +614,16 @@ func loadConfigFromYAML(data []byte) ([]*Config, *globalSettings, error) {
 		c.merge(site)
 
 		cfg := &Config{}
+		cfgs = append(cfgs, cfg)
 		err := siteFromYAML(c, cfg)
 		if err != nil {
+			stopConfigs(cfgs)
 			return nil, nil, fmt.Errorf("error loading config: %s", err)
 		}
 		if cfg.UpstreamProvider == nil {
+			stopConfigs(cfgs)
 			return nil, nil, fmt.Errorf("missing upstream in %s, must specify one of 'upstream' or 'upstream_set'", cfg.Name)
 		}
-		cfgs = append(cfgs, cfg)
 	}
 
 	return cfgs, &yc.Globals, nil
@@ -167,6 +631,7 @@ func loadConfigFromYAML(data []byte) ([]*Config, *globalSettings, error) {
 
 func siteFromYAML(site yamlSiteConfig, cfg *Config) error {
 	cfg.Name = site.Name
+	cfg.Listeners = site.Listeners
 
 	if site.Bind != "" {
 		if site.BindHost != "" || site.BindLocation != "" {
@@ -177,6 +642,12 @@ func siteFromYAML(site yamlSiteConfig, cfg *Config) error {
 			return err
 		}
 	}
+	if len(site.BindHosts) > 0 {
+		if site.Bind != "" || site.BindHost != "" {
+			return fmt.Errorf("'bind_hosts' can not be used with 'bind' or 'bind_host'")
+		}
+		cfg.BindHosts(site.BindHosts...)
+	}
 	if site.BindHost != "" {
 		cfg.BindHost(site.BindHost)
 	}
@@ -184,7 +655,58 @@ func siteFromYAML(site yamlSiteConfig, cfg *Config) error {
 		cfg.BindLocation(site.BindLocation)
 	}
 
-	up, err := upstreamFromYAML(site)
+	if m := site.Match; m != nil {
+		if err := matchFromYAML(m, cfg); err != nil {
+			return err
+		}
+	}
+
+	if cc := site.ClientCert; cc != nil {
+		cfg.ClientCert = ClientCertPolicy{
+			Require:       cc.Require,
+			CommonNames:   cc.CommonNames,
+			Organizations: cc.Organizations,
+			SANs:          cc.SANs,
+		}
+	}
+
+	if t := site.Transport; t != nil {
+		settings := TransportSettings{
+			DialTimeout:           t.DialTimeout,
+			KeepAlive:             t.KeepAlive,
+			TLSHandshakeTimeout:   t.TLSHandshakeTimeout,
+			ResponseHeaderTimeout: t.ResponseHeaderTimeout,
+			IdleConnTimeout:       t.IdleConnTimeout,
+			MaxIdleConns:          t.MaxIdleConns,
+			MaxIdleConnsPerHost:   t.MaxIdleConnsPerHost,
+			MaxConnsPerHost:       t.MaxConnsPerHost,
+			DisableKeepAlives:     t.DisableKeepAlives,
+			DisableCompression:    t.DisableCompression,
+		}
+		if t.TLS != nil {
+			ut := UpstreamTLS{
+				CAFile:     t.TLS.CAFile,
+				CertFile:   t.TLS.CertFile,
+				KeyFile:    t.TLS.KeyFile,
+				ServerName: t.TLS.ServerName,
+			}
+			if t.TLS.MinVersion != "" {
+				v, err := ParseTLSVersion(t.TLS.MinVersion)
+				if err != nil {
+					return err
+				}
+				ut.MinVersion = v
+			}
+			tlsConfig, err := ut.ClientConfig()
+			if err != nil {
+				return err
+			}
+			settings.TLSClientConfig = tlsConfig
+		}
+		cfg.Transport = NewTransport(settings)
+	}
+
+	up, err := upstreamFromYAML(site, cfg.Transport)
 	if err != nil {
 		return err
 	}
@@ -192,6 +714,18 @@ func siteFromYAML(site yamlSiteConfig, cfg *Config) error {
 		cfg.Upstream(up)
 	}
 
+	if r := site.Retry; r != nil {
+		cfg.Retry = RetryPolicy{
+			MaxAttempts:   r.MaxAttempts,
+			RetryOn:       r.RetryOn,
+			PerTryTimeout: r.PerTryTimeout,
+			BufferBody:    r.BufferBody,
+		}
+		if err := cfg.Retry.Validate(); err != nil {
+			return err
+		}
+	}
+
 	for key, value := range site.AddHeaders {
 		cfg.AddHeader(key, value)
 	}
@@ -217,7 +751,182 @@ func siteFromYAML(site yamlSiteConfig, cfg *Config) error {
 	return nil
 }
 
-func upstreamFromYAML(site yamlSiteConfig) (upstream.Provider, error) {
+// matchFromYAML adds the path, method, header and cookie rules in m to the
+// config's Matcher. A path rule replaces any path from 'bind'.
+func matchFromYAML(m *yamlMatch, cfg *Config) error {
+	paths := 0
+	for _, p := range []string{m.PathExact, m.PathPrefix, m.PathRegex, m.PathTemplate} {
+		if p != "" {
+			paths++
+		}
+	}
+	if paths > 1 {
+		return errors.New("'match' can only specify one of 'path_exact', 'path_prefix', 'path_regex' or 'path_template'")
+	}
+	switch {
+	case m.PathExact != "":
+		cfg.BindPathExact(m.PathExact)
+	case m.PathPrefix != "":
+		cfg.BindPathPrefix(m.PathPrefix)
+	case m.PathRegex != "":
+		if err := cfg.BindPathRegexp(m.PathRegex); err != nil {
+			return err
+		}
+	case m.PathTemplate != "":
+		if err := cfg.BindPathTemplate(m.PathTemplate); err != nil {
+			return err
+		}
+	}
+
+	cfg.BindMethod(m.Methods...)
+	for _, h := range m.Headers {
+		if err := h.validate("header"); err != nil {
+			return err
+		}
+		if h.Regex != "" {
+			if err := cfg.BindHeaderRegexp(h.Name, h.Regex); err != nil {
+				return err
+			}
+		} else {
+			cfg.BindHeader(h.Name, h.Value)
+		}
+	}
+	for _, c := range m.Cookies {
+		if err := c.validate("cookie"); err != nil {
+			return err
+		}
+		if c.Regex != "" {
+			if err := cfg.BindCookieRegexp(c.Name, c.Regex); err != nil {
+				return err
+			}
+		} else {
+			cfg.BindCookie(c.Name, c.Value)
+		}
+	}
+	return nil
+}
+
+func (r yamlMatchRule) validate(kind string) error {
+	if r.Name == "" {
+		return fmt.Errorf("missing name for %s match", kind)
+	}
+	set := 0
+	for _, ok := range []bool{r.Value != "", r.Present, r.Regex != ""} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("%s match for '%s' must specify one of 'value', 'present' or 'regex'", kind, r.Name)
+	}
+	return nil
+}
+
+// upstreamFromYAML returns the site's Provider, transport is used for health
+// checks and may be nil.
+func upstreamFromYAML(site yamlSiteConfig, transport http.RoundTripper) (upstream.Provider, error) {
+	var p upstream.Provider
+	var err error
+	if site.Split != nil {
+		if site.Upstream != "" || site.UpstreamSet != nil {
+			return nil, errors.New("'split' can not be used with 'upstream' or 'upstream_set'")
+		}
+		p, err = splitFromYAML(site, transport)
+	} else {
+		p, err = balancedFromYAML(site, transport)
+	}
+	if p == nil || err != nil {
+		return nil, err
+	}
+
+	if st := site.Sticky; st != nil {
+		p = upstream.Sticky(p, upstream.StickySettings{
+			Cookie: st.Cookie,
+			Secret: []byte(st.Secret),
+			MaxAge: st.MaxAge,
+		})
+	}
+	return p, nil
+}
+
+// splitFromYAML returns a Provider that splits traffic between the site's
+// groups, each of which inherits upstream options from the site.
+func splitFromYAML(site yamlSiteConfig, transport http.RoundTripper) (upstream.Provider, error) {
+	var key upstream.KeyFn
+	if site.Split.Key != "" {
+		k, err := upstream.ParseKey(site.Split.Key)
+		if err != nil {
+			return nil, err
+		}
+		key = k
+	}
+	if len(site.Split.Groups) == 0 {
+		return nil, errors.New("'split' must have at least one group")
+	}
+
+	groups := []upstream.SplitGroup{}
+	names := map[string]bool{}
+	total := 0.0
+	for _, g := range site.Split.Groups {
+		if g.Name == "" {
+			return nil, errors.New("missing name for split group")
+		} else if names[g.Name] {
+			return nil, fmt.Errorf("duplicate split group '%s'", g.Name)
+		} else if g.Percent < 0 {
+			return nil, fmt.Errorf("invalid percent %g for split group '%s'", g.Percent, g.Name)
+		}
+		names[g.Name] = true
+		total += g.Percent
+
+		gs := yamlSiteConfig{
+			Balance:          site.Balance,
+			BalanceSettings:  site.BalanceSettings,
+			RoundRobin:       site.RoundRobin,
+			Upstream:         g.Upstream,
+			UpstreamSet:      g.UpstreamSet,
+			UpstreamSettings: map[string]string{},
+			HealthCheck:      site.HealthCheck,
+			OutlierDetection: site.OutlierDetection,
+			CircuitBreaker:   site.CircuitBreaker,
+		}
+		if g.Balance != "" {
+			gs.Balance, gs.BalanceSettings, gs.RoundRobin = g.Balance, g.BalanceSettings, false
+		} else if g.BalanceSettings != nil {
+			gs.BalanceSettings = g.BalanceSettings
+		}
+		for k, v := range site.UpstreamSettings {
+			gs.UpstreamSettings[k] = v
+		}
+		for k, v := range g.UpstreamSettings {
+			gs.UpstreamSettings[k] = v
+		}
+		if g.HealthCheck != nil {
+			gs.HealthCheck = g.HealthCheck
+		}
+		if g.OutlierDetection != nil {
+			gs.OutlierDetection = g.OutlierDetection
+		}
+		if g.CircuitBreaker != nil {
+			gs.CircuitBreaker = g.CircuitBreaker
+		}
+
+		p, err := balancedFromYAML(gs, transport)
+		if err != nil {
+			return nil, fmt.Errorf("split group '%s': %s", g.Name, err)
+		} else if p == nil {
+			return nil, fmt.Errorf("missing upstream in split group '%s'", g.Name)
+		}
+		groups = append(groups, upstream.SplitGroup{Name: g.Name, Percent: g.Percent, Provider: p})
+	}
+	if math.Abs(total-100) > 0.001 {
+		return nil, fmt.Errorf("split percentages must add up to 100, was %g", total)
+	}
+	return upstream.Split(key, groups...), nil
+}
+
+// balancedFromYAML returns a Provider that balances between the site's
+// upstreams, or nil if the site doesn't specify any.
+func balancedFromYAML(site yamlSiteConfig, transport http.RoundTripper) (upstream.Provider, error) {
 	// Because of lack of polymorphic YAML entries, there are two possible places
 	// to look for upstreams. But the presence of both is invalid.
 	var s upstream.Source
@@ -226,7 +935,11 @@ func upstreamFromYAML(site yamlSiteConfig) (upstream.Provider, error) {
 	} else if site.Upstream != "" && site.UpstreamSet != nil {
 		return nil, errors.New("must specify one of 'upstream' or 'upstream_set' not both")
 	} else if site.UpstreamSet != nil {
-		s = upstream.FixedSet(site.UpstreamSet...)
+		urls := make([]upstream.WeightedURL, len(site.UpstreamSet))
+		for i, u := range site.UpstreamSet {
+			urls[i] = upstream.WeightedURL{URL: u.URL, Weight: u.Weight}
+		}
+		s = upstream.WeightedSet(urls...)
 	} else {
 		ss, err := upstream.Get(site.Upstream, site.UpstreamSettings)
 		if err != nil {
@@ -243,8 +956,58 @@ func upstreamFromYAML(site yamlSiteConfig) (upstream.Provider, error) {
 		return nil, fmt.Errorf("invalid upstream: %s", err)
 	}
 
+	if hc := site.HealthCheck; hc != nil {
+		s = upstream.HealthChecked(s, upstream.HealthCheck{
+			Path:               hc.Path,
+			Host:               hc.Host,
+			ExpectedStatus:     hc.ExpectedStatus,
+			Interval:           hc.Interval,
+			Timeout:            hc.Timeout,
+			HealthyThreshold:   hc.HealthyThreshold,
+			UnhealthyThreshold: hc.UnhealthyThreshold,
+			Transport:          transport,
+		})
+	}
+
+	if od := site.OutlierDetection; od != nil {
+		s = upstream.EjectOutliers(s, upstream.OutlierDetection{
+			ConsecutiveFailures: od.ConsecutiveFailures,
+			BaseEjectionTime:    od.BaseEjectionTime,
+			MaxEjectionTime:     od.MaxEjectionTime,
+		})
+	}
+
+	if cb := site.CircuitBreaker; cb != nil {
+		if cb.ErrorRate < 0 || cb.ErrorRate > 1 {
+			return nil, fmt.Errorf("invalid error_rate %g, should be between 0 and 1", cb.ErrorRate)
+		}
+		s = upstream.CircuitBreaker(s, upstream.BreakerSettings{
+			Window:           cb.Window,
+			ErrorRate:        cb.ErrorRate,
+			MinRequests:      cb.MinRequests,
+			ErrorCount:       cb.ErrorCount,
+			OpenTimeout:      cb.OpenTimeout,
+			HalfOpenRequests: cb.HalfOpenRequests,
+		})
+	}
+
+	// 'round_robin: true' predates 'balance' and is kept for compatibility.
+	balance := site.Balance
 	if site.RoundRobin {
-		return upstream.RoundRobin(s), nil
+		if balance != "" && balance != "round_robin" {
+			return nil, fmt.Errorf("'round_robin' can not be used with 'balance: %s'", balance)
+		}
+		balance = "round_robin"
+	}
+	if balance == "" {
+		balance = "random"
+	}
+	if balance != "weighted_round_robin" {
+		for _, u := range site.UpstreamSet {
+			if u.Weight != 1 {
+				return nil, fmt.Errorf("weight for '%s' requires 'balance: weighted_round_robin', was '%s'", u.URL, balance)
+			}
+		}
 	}
-	return upstream.Random(s), nil
+	return upstream.GetBalancer(balance, s, site.BalanceSettings)
 }
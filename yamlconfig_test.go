@@ -1,11 +1,15 @@
 package locus
 
 import (
+	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"reflect"
 	"testing"
 	"time"
+
+	"github.com/dpup/locus/upstream"
 )
 
 func TestLoadConfig(t *testing.T) {
@@ -27,10 +31,53 @@ func TestLoadConfig(t *testing.T) {
 		t.Errorf("Expected write timeout to be 20s, was %s", globals.WriteTimeout)
 	}
 
+	if globals.DrainTimeout != 15*time.Second {
+		t.Errorf("Expected drain timeout to be 15s, was %s", globals.DrainTimeout)
+	}
+	if globals.UpgradeIdleTimeout != 10*time.Minute {
+		t.Errorf("Expected upgrade idle timeout to be 10m, was %s", globals.UpgradeIdleTimeout)
+	}
+
+	if !reflect.DeepEqual(globals.TrustedProxies, []string{"10.0.0.0/8"}) {
+		t.Errorf("Unexpected trusted proxies, was %v", globals.TrustedProxies)
+	}
+
+	if !reflect.DeepEqual(globals.Listen, []string{"127.0.0.1", "::1"}) {
+		t.Errorf("Unexpected listen addresses, was %v", globals.Listen)
+	}
+
+	if a := globals.Admin; a == nil || a.Address != "127.0.0.1:5558" || a.BasicAuth.Username != "ops" ||
+		!reflect.DeepEqual(a.AllowIPs, []string{"127.0.0.1", "10.0.0.0/8"}) {
+		t.Errorf("Unexpected admin settings, was %+v", a)
+	}
+
+	if !globals.CompiledRouting {
+		t.Error("Expected compiled routing to be enabled")
+	}
+
+	if globals.TLS.Port != 5443 {
+		t.Errorf("Expected TLS port 5443, was %d", globals.TLS.Port)
+	}
+
+	if len(globals.TLS.Certificates) != 2 || globals.TLS.Certificates[1].KeyFile != "/etc/locus/certs/othersite.com.key" {
+		t.Errorf("Unexpected TLS certificates, was %v", globals.TLS.Certificates)
+	}
+
+	if globals.TLS.ACME == nil || globals.TLS.ACME.CacheDir != "/var/lib/locus/acme" {
+		t.Errorf("Unexpected ACME settings, was %v", globals.TLS.ACME)
+	}
+
 	about := cfgs[0]
 	search := cfgs[1]
 	fallthru := cfgs[2]
-	redirect := cfgs[3]
+	apiV2 := cfgs[3]
+	api := cfgs[4]
+	media := cfgs[5]
+	app := cfgs[6]
+	shop := cfgs[7]
+	admin := cfgs[8]
+	avatars := cfgs[9]
+	redirect := cfgs[10]
 
 	// Verify the first site has a single URL upstream.
 	actual1, err := about.UpstreamProvider.All()
@@ -52,6 +99,23 @@ func TestLoadConfig(t *testing.T) {
 		t.Errorf("Unexpected upstreams, expected '%s' was '%s'", expected2, actual2)
 	}
 
+	// Verify the second site is health checked.
+	if c := search.UpstreamProvider.DebugInfo()["health check"]; c != "GET /healthz expecting 200 every 10s" {
+		t.Errorf("Unexpected health check, was %q", c)
+	}
+	search.stop()
+
+	// And has outlier detection.
+	var od *upstream.OutlierDetector
+	upstream.Walk(search.UpstreamProvider, func(s upstream.Source) {
+		if o, ok := s.(*upstream.OutlierDetector); ok {
+			od = o
+		}
+	})
+	if od == nil {
+		t.Error("Expected search upstreams to have outlier detection")
+	}
+
 	// Verify the third site uses DNS.
 	actual3, err := fallthru.UpstreamProvider.All()
 	expected3 := []*url.URL{
@@ -64,6 +128,9 @@ func TestLoadConfig(t *testing.T) {
 	if !reflect.DeepEqual(actual3, expected3) {
 		t.Errorf("Unexpected upstreams, expected '%s' was '%s'", expected3, actual3)
 	}
+	if p := fmt.Sprintf("%T", fallthru.UpstreamProvider); p != "*upstream.leastConnProvider" {
+		t.Errorf("Expected least_conn provider for 'fallthru', was %s", p)
+	}
 	info := fallthru.UpstreamProvider.DebugInfo()
 	if info["allow stale"] != "true" {
 		t.Errorf("Expected AllowStale to be true, was %s", info["allow stale"])
@@ -72,6 +139,141 @@ func TestLoadConfig(t *testing.T) {
 		t.Errorf("Expected TTL to be 5m0s, was %s", info["TTL"])
 	}
 
+	// Verify the fourth site only matches beta users asking for v2.
+	var matchTests = []struct {
+		method   string
+		accept   string
+		cookie   string
+		expected bool
+	}{
+		{"GET", "application/vnd.mysite.v2+json", "1", true},
+		{"POST", "application/vnd.mysite.v2+json; charset=utf-8", "1", true},
+		{"DELETE", "application/vnd.mysite.v2+json", "1", false},
+		{"GET", "application/json", "1", false},
+		{"GET", "application/vnd.mysite.v2+json", "", false},
+	}
+	for _, tt := range matchTests {
+		req := httptest.NewRequest(tt.method, "http://api.mysite.com/", nil)
+		req.Header.Set("Accept", tt.accept)
+		if tt.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "beta", Value: tt.cookie})
+		}
+		if ok, reason := apiV2.Match(req); ok != tt.expected {
+			t.Errorf("%s with Accept %q and cookie %q => %v, want %v (%s)", tt.method, tt.accept, tt.cookie, ok, tt.expected, reason)
+		}
+	}
+
+	// Verify the fifth site hashes on the configured header, not the default
+	// X-Forwarded-For.
+	seen := map[string]bool{}
+	for i := 0; i < 10; i++ {
+		req1, req2 := mustReq("http://api.mysite.com"), mustReq("http://api.mysite.com")
+		req1.Header.Set("X-Real-IP", fmt.Sprintf("10.0.0.%d", i))
+		req2.Header.Set("X-Real-IP", fmt.Sprintf("10.0.0.%d", i))
+		req2.Header.Set("X-Forwarded-For", "192.168.0.1")
+		u1, _ := api.UpstreamProvider.Get(req1)
+		u2, _ := api.UpstreamProvider.Get(req2)
+		if u1.String() != u2.String() {
+			t.Errorf("Expected X-Forwarded-For to be ignored, was %s and %s", u1, u2)
+		}
+		seen[u1.String()] = true
+	}
+	if len(seen) != 2 {
+		t.Errorf("Expected clients to be spread across both upstreams, was %v", seen)
+	}
+	if b := api.UpstreamProvider.DebugInfo()["breaker"]; b != "opens at 50% of at least 20 requests in 10s" {
+		t.Errorf("Unexpected circuit breaker, was %q", b)
+	}
+
+	expectedRetry := RetryPolicy{
+		MaxAttempts:   3,
+		RetryOn:       []string{"connect_error", "timeout", "503"},
+		PerTryTimeout: 5 * time.Second,
+		BufferBody:    65536,
+	}
+	if !reflect.DeepEqual(search.Retry, expectedRetry) {
+		t.Errorf("Unexpected retry policy, wanted %+v was %+v", expectedRetry, search.Retry)
+	}
+	if about.Retry.MaxAttempts != 0 {
+		t.Errorf("Expected no retries by default, was %+v", about.Retry)
+	}
+
+	// Verify the sixth site is weighted.
+	mediaInfo := media.UpstreamProvider.DebugInfo()
+	if s := mediaInfo["weight http://media-large.mysite.com"]; s != "4 (80.0% of configured weight)" {
+		t.Errorf("Unexpected weight for large media upstream, was %q", s)
+	}
+	if s := mediaInfo["weight http://media-small.mysite.com"]; s != "1 (20.0% of configured weight)" {
+		t.Errorf("Unexpected weight for small media upstream, was %q", s)
+	}
+
+	tr, ok := media.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("Expected media site to have a dedicated transport, was %T", media.Transport)
+	}
+	if tr.ResponseHeaderTimeout != 60*time.Second || tr.MaxIdleConnsPerHost != 50 ||
+		tr.MaxConnsPerHost != 100 || !tr.DisableCompression || tr.DisableKeepAlives {
+		t.Errorf("Unexpected transport settings: %+v", tr)
+	}
+	if about.Transport != nil {
+		t.Errorf("Expected sites to share the default transport, was %T", about.Transport)
+	}
+
+	// Verify the seventh site is sticky.
+	if c := app.UpstreamProvider.DebugInfo()["sticky cookie"]; c != "app_affinity" {
+		t.Errorf("Expected sticky cookie 'app_affinity', was %q", c)
+	}
+	for _, host := range []string{"app.mysite.com", "www.app.mysite.com", "app-beta.mysite.com", "de.app.mysite.eu"} {
+		if ok, _ := app.Match(mustReq("http://" + host + "/")); !ok {
+			t.Errorf("Expected 'app' to match %s", host)
+		}
+	}
+	if ok, _ := app.Match(mustReq("http://www.mysite.com/")); ok {
+		t.Errorf("Expected 'app' not to match www.mysite.com")
+	}
+
+	// Verify the eighth site splits traffic, keyed on the session cookie.
+	shopInfo := shop.UpstreamProvider.DebugInfo()
+	if s := shopInfo["split canary"]; s != "5.0%" {
+		t.Errorf("Unexpected canary share, was %q", s)
+	}
+	if s := shopInfo["split stable"]; s != "95.0%" {
+		t.Errorf("Unexpected stable share, was %q", s)
+	}
+	req := mustReq("http://shop.mysite.com/")
+	req.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+	first, _ := shop.UpstreamProvider.Get(req)
+	for i := 0; i < 10; i++ {
+		u, _ := shop.UpstreamProvider.Get(req)
+		if (u.Host == "shop-canary.mysite.com") != (first.Host == "shop-canary.mysite.com") {
+			t.Errorf("Expected session to stay in one group, was %s then %s", first, u)
+		}
+	}
+
+	// Verify the ninth site requires a client certificate from the ops team.
+	expectedPolicy := ClientCertPolicy{
+		Require:       true,
+		Organizations: []string{"MySite Ops"},
+		SANs:          []string{"ops@mysite.com"},
+	}
+	if !reflect.DeepEqual(admin.ClientCert, expectedPolicy) {
+		t.Errorf("Unexpected client cert policy, was %+v", admin.ClientCert)
+	}
+	if !reflect.DeepEqual(admin.Listeners, []string{"https"}) {
+		t.Errorf("Expected 'admin' to be restricted to the https listener, was %v", admin.Listeners)
+	}
+
+	// Verify the tenth site rewrites avatar requests using the path template.
+	req = mustReq("http://www.mysite.com/users/123/avatar")
+	if ok, _, params := avatars.match(req); !ok || params["id"] != "123" {
+		t.Errorf("Expected avatar path to match with id 123, was %v %v", ok, params)
+	} else if proxyreq, err := avatars.Direct(withPathParams(req, params)); err != nil || proxyreq.URL.String() != "http://avatars.mysite.com/users/123.png" {
+		t.Errorf("Unexpected avatar upstream, was %v %v", proxyreq.URL, err)
+	}
+	if ok, _ := avatars.Match(mustReq("http://www.mysite.com/users/123/avatar/large")); ok {
+		t.Error("Expected longer avatar path not to match")
+	}
+
 	// Check that global AddHeader set.
 	if v, ok := about.addHeaders["X-Proxied-For"]; !ok || !reflect.DeepEqual(v, []string{"Locus"}) {
 		t.Errorf("Unexpected global header for 'X-Proxied-For', was '%v'", v)
@@ -92,3 +294,101 @@ func TestLoadConfig(t *testing.T) {
 		t.Errorf("Unexpected redirect, wanted %d was %d", http.StatusMovedPermanently, redirect.Redirect)
 	}
 }
+
+func TestBalanceErrors(t *testing.T) {
+	var tests = []struct {
+		site     string
+		expected string
+	}{
+		{"balance: fastest", "invalid balance 'fastest', should be one of (consistent_hash, first, ip_hash, least_conn, random, round_robin, weighted_round_robin)"},
+		{"balance: ip_hash\n    balance_settings:\n      key: foo", "invalid setting 'key' for 'ip_hash', should be one of (header)"},
+		{"balance: random\n    balance_settings:\n      key: foo", "'random' doesn't accept settings, was given 'key'"},
+		{"balance: least_conn\n    round_robin: true", "'round_robin' can not be used with 'balance: least_conn'"},
+		{"circuit_breaker:\n      error_rate: 50", "invalid error_rate 50, should be between 0 and 1"},
+		{"bind_host: a.com\n    bind_hosts: [b.com]", "'bind_hosts' can not be used with 'bind' or 'bind_host'"},
+		{"retry:\n      retry_on: [404]", "invalid retry condition '404', should be one of (connect_error, timeout) or a 5xx status code"},
+	}
+	for _, tt := range tests {
+		_, _, err := loadConfigFromYAML([]byte("sites:\n  - name: test\n    upstream: http://test.com\n    " + tt.site))
+		if err == nil || err.Error() != "error loading config: "+tt.expected {
+			t.Errorf("Expected error %q, was %v", tt.expected, err)
+		}
+	}
+}
+
+func TestUpstreamSetWeights(t *testing.T) {
+	yml := `
+sites:
+  - name: test
+    upstream_set:
+      - url: http://a.test.com
+        weight: 0
+      - http://b.test.com
+`
+	_, _, err := loadConfigFromYAML([]byte(yml))
+	expected := "error loading config: invalid upstream: invalid weight 0 for 'http://a.test.com', should be positive"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected error %q, was %v", expected, err)
+	}
+
+	// Weights would be silently ignored by other balancers.
+	for balance, name := range map[string]string{"": "random", "balance: least_conn": "least_conn", "round_robin: true": "round_robin"} {
+		yml := "sites:\n  - name: test\n    upstream_set:\n      - url: http://a.test.com\n        weight: 3\n      - http://b.test.com\n    " + balance
+		_, _, err := loadConfigFromYAML([]byte(yml))
+		expected := "error loading config: weight for 'http://a.test.com' requires 'balance: weighted_round_robin', was '" + name + "'"
+		if err == nil || err.Error() != expected {
+			t.Errorf("Expected error %q, was %v", expected, err)
+		}
+	}
+}
+
+func TestSplitErrors(t *testing.T) {
+	var tests = []struct {
+		split    string
+		expected string
+	}{
+		{"groups: []", "'split' must have at least one group"},
+		{"key: nope\n      groups: []", "invalid key 'nope', should be one of (ip, path, header:<name>, cookie:<name>)"},
+		{"groups:\n        - {percent: 100, upstream: http://a.com}", "missing name for split group"},
+		{"groups:\n        - {name: a, percent: 50, upstream: http://a.com}\n        - {name: a, percent: 50, upstream: http://b.com}", "duplicate split group 'a'"},
+		{"groups:\n        - {name: a, percent: 50, upstream: http://a.com}\n        - {name: b, percent: 40, upstream: http://b.com}", "split percentages must add up to 100, was 90"},
+		{"groups:\n        - {name: a, percent: 100}", "missing upstream in split group 'a'"},
+		{"groups:\n        - {name: a, percent: 100, upstream: http://a.com, balance: fastest}", "split group 'a': invalid balance 'fastest', should be one of (consistent_hash, first, ip_hash, least_conn, random, round_robin, weighted_round_robin)"},
+	}
+	for _, tt := range tests {
+		_, _, err := loadConfigFromYAML([]byte("sites:\n  - name: test\n    split:\n      " + tt.split))
+		if err == nil || err.Error() != "error loading config: "+tt.expected {
+			t.Errorf("Expected error %q, was %v", tt.expected, err)
+		}
+	}
+
+	_, _, err := loadConfigFromYAML([]byte("sites:\n  - name: test\n    upstream: http://a.com\n    split:\n      groups: []"))
+	expected := "error loading config: 'split' can not be used with 'upstream' or 'upstream_set'"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected error %q, was %v", expected, err)
+	}
+}
+
+func TestMatchErrors(t *testing.T) {
+	var tests = []struct {
+		match    string
+		expected string
+	}{
+		{"headers: [{value: a}]", "missing name for header match"},
+		{"headers: [{name: Accept}]", "header match for 'Accept' must specify one of 'value', 'present' or 'regex'"},
+		{"headers: [{name: Accept, value: a, present: true}]", "header match for 'Accept' must specify one of 'value', 'present' or 'regex'"},
+		{"headers: [{name: Accept, regex: '('}]", "invalid regexp for header 'Accept': error parsing regexp: missing closing ): `(`"},
+		{"cookies: [{name: beta, value: a, regex: b}]", "cookie match for 'beta' must specify one of 'value', 'present' or 'regex'"},
+		{"path_exact: /a, path_prefix: /b", "'match' can only specify one of 'path_exact', 'path_prefix', 'path_regex' or 'path_template'"},
+		{"path_regex: '/(?P<id>'", "invalid path regexp '/(?P<id>': error parsing regexp: missing closing ): `^(?:/(?P<id>)$`"},
+		{"path_template: '/users/{id'", "invalid path template '/users/{id', parameters should look like {name} or {name*}"},
+	}
+	for _, tt := range tests {
+		yaml := "sites:\n  - name: test\n    upstream: http://a.com\n    match: {" + tt.match + "}"
+		_, _, err := loadConfigFromYAML([]byte(yaml))
+		expected := "error loading config: " + tt.expected
+		if err == nil || err.Error() != expected {
+			t.Errorf("Expected error %q, was %v", expected, err)
+		}
+	}
+}